@@ -0,0 +1,60 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"time"
+)
+
+// AcquireInfo describes how a connection is checked out by GetDetailed.
+type AcquireInfo struct {
+	// Wait is the time the checkout takes, including waiting for the Budget and
+	// dialing.
+	Wait time.Duration
+
+	// Dialed reports whether a connection is dialed for the checkout.
+	Dialed bool
+
+	// Slot is the index of the pool's slot, -1 for a one-time connection.
+	Slot int
+
+	// Endpoint is the address the connection is dialed to.
+	Endpoint string
+
+	// Utilization is the utilization of the pool after the checkout, see Stats.
+	Utilization float64
+}
+
+// dialed marks that a connection is dialed, info may be nil.
+func (info *AcquireInfo) dialed() {
+	if info != nil {
+		info.Dialed = true
+	}
+}
+
+// GetDetailed see Pool interface.
+func (p *pool) GetDetailed(ctx context.Context) (Conn, AcquireInfo, error) {
+	start := p.clock.Now()
+	info := AcquireInfo{Slot: -1, Endpoint: p.address}
+	c, err := p.acquire(ctx, &info)
+	info.Wait = p.clock.Now().Sub(start)
+	if err != nil {
+		return nil, info, err
+	}
+	info.Slot = c.(*conn).pc.slot
+	info.Utilization = p.utilization()
+	return c, info, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDetailed(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 2
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c1, info, err := p.GetDetailed(context.Background())
+	require.NoError(t, err)
+	require.False(t, info.Dialed)
+	require.Equal(t, 0, info.Slot)
+	require.Equal(t, *endpoint, info.Endpoint)
+	require.Equal(t, 0.5, info.Utilization)
+
+	// the second grows the pool
+	c2, info, err := p.GetDetailed(context.Background())
+	require.NoError(t, err)
+	require.True(t, info.Dialed)
+	require.Equal(t, c2.Info().Slot, info.Slot)
+	require.Equal(t, 1.0, info.Utilization)
+	require.Positive(t, info.Wait)
+
+	// the third is a one-time connection
+	c3, info, err := p.GetDetailed(context.Background())
+	require.NoError(t, err)
+	require.True(t, info.Dialed)
+	require.Equal(t, -1, info.Slot)
+
+	require.NoError(t, c1.Close())
+	require.NoError(t, c2.Close())
+	require.NoError(t, c3.Close())
+}
+
+func TestGetDetailedError(t *testing.T) {
+	p, err := New(*endpoint, DefaultOptions)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	_, info, err := p.GetDetailed(context.Background())
+	require.Equal(t, ErrClosed, err)
+	require.False(t, info.Dialed)
+	require.Equal(t, -1, info.Slot)
+}
+
+func TestMultiGetDetailed(t *testing.T) {
+	a := startEchoServer(t)
+	opt := DefaultOptions
+	opt.DialFunc = failingDial("b:1")
+	mp, err := NewMulti([]string{a, "b:1"}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	c, info, err := mp.GetDetailed(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, a, info.Endpoint)
+	require.NoError(t, c.Close())
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamLimit is the AIMD controller of the effective MaxConcurrentStreams of
+// the connections, see AdaptiveStreamsLatency.
+type streamLimit struct {
+	// atomic, math.Float64bits of the limit, the effective limit is it rounded
+	// down.
+	limit uint64
+
+	// atomic, the number of Gets waiting for the conns checked out to drop below
+	// the cap, see admit.
+	waiters int32
+
+	mu sync.Mutex
+	// closed when a conn is given back while Gets are waiting.
+	released chan struct{}
+}
+
+func newStreamLimit(limit int) streamLimit {
+	return streamLimit{limit: math.Float64bits(float64(limit)), released: make(chan struct{})}
+}
+
+// streamLimit returns the effective MaxConcurrentStreams of the connections.
+func (p *pool) streamLimit() int32 {
+	if p.opt.AdaptiveStreamsLatency <= 0 {
+		return int32(p.opt.MaxConcurrentStreams)
+	}
+	return int32(math.Float64frombits(atomic.LoadUint64(&p.limiter.limit)))
+}
+
+func (p *pool) adaptiveStreamsBackoff() float64 {
+	if p.opt.AdaptiveStreamsBackoff > 0 {
+		return p.opt.AdaptiveStreamsBackoff
+	}
+	return DefaultAdaptiveStreamsBackoff
+}
+
+// adapt adjusts the stream limit by an RPC of the latency finished with err on
+// pc: the limit is backed off if it's slower than AdaptiveStreamsLatency or
+// overloaded the backend, otherwise it's increased by one if at least half of
+// it is in use on pc.
+func (pc *physicalConn) adapt(ctx context.Context, latency time.Duration, err error) {
+	p := pc.pool
+	l := &p.limiter
+	for {
+		bits := atomic.LoadUint64(&l.limit)
+		limit := math.Float64frombits(bits)
+		next := limit
+		switch {
+		case latency > p.opt.AdaptiveStreamsLatency || overloaded(ctx, err):
+			if next *= p.adaptiveStreamsBackoff(); next < 1 {
+				next = 1
+			}
+		case 2*atomic.LoadInt32(&pc.ref) >= int32(limit):
+			if next++; next > float64(p.opt.MaxConcurrentStreams) {
+				next = float64(p.opt.MaxConcurrentStreams)
+			}
+		default:
+			return
+		}
+		if atomic.CompareAndSwapUint64(&l.limit, bits, math.Float64bits(next)) {
+			return
+		}
+	}
+}
+
+// overloaded reports whether err tells the backend is overloaded, the deadline
+// of the caller's own ctx passing doesn't.
+func overloaded(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// admit caps the conns checked out at the stream limit of MaxActive connections
+// when AdaptiveStreamsLatency is set, so the pool doesn't grow nor hand out
+// one-time connections beyond the limit. ref is the conns checked out with the
+// Get's own, the Gets beyond the cap wait for a conn to be given back if Wait
+// is set, bounded by ctx, or fail with ErrExhausted. their reference is given
+// back while they wait, ref is returned as it's taken again.
+func (p *pool) admit(ctx context.Context, ref int32) (int32, error) {
+	if p.opt.AdaptiveStreamsLatency <= 0 {
+		return ref, nil
+	}
+	l := &p.limiter
+	for ref > p.streamLimit()*int32(p.opt.MaxActive) {
+		p.decrRef()
+		if !p.opt.Wait {
+			return 0, ErrExhausted
+		}
+		if err := l.wait(ctx, p); err != nil {
+			return 0, err
+		}
+		ref = p.incrRef()
+		if err := p.stateErr(); err != nil {
+			p.decrRef()
+			return 0, err
+		}
+	}
+	return ref, nil
+}
+
+// wait waits for a conn to be given back while the conns checked out are at
+// the cap, see admit.
+func (l *streamLimit) wait(ctx context.Context, p *pool) error {
+	atomic.AddInt32(&l.waiters, 1)
+	defer atomic.AddInt32(&l.waiters, -1)
+	l.mu.Lock()
+	released := l.released
+	l.mu.Unlock()
+	// the conn given back before the waiter is seen
+	if atomic.LoadInt32(&p.ref) < p.streamLimit()*int32(p.opt.MaxActive) {
+		return nil
+	}
+	atomic.AddInt32(&p.waiting, 1)
+	defer atomic.AddInt32(&p.waiting, -1)
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// release wakes up the Gets waiting in admit, a conn is given back.
+func (l *streamLimit) release() {
+	if atomic.LoadInt32(&l.waiters) == 0 {
+		return
+	}
+	l.mu.Lock()
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// adaptiveInterceptor adapts the stream limit by the latency of the unary RPCs.
+func (pc *physicalConn) adaptiveInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := pc.pool.clock.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	pc.adapt(ctx, pc.pool.clock.Now().Sub(start), err)
+	return err
+}
+
+// adaptiveStreamInterceptor adapts the stream limit by how long the streams
+// take to be created, the streams themselves may be long-lived.
+func (pc *physicalConn) adaptiveStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := pc.pool.clock.Now()
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	pc.adapt(ctx, pc.pool.clock.Now().Sub(start), err)
+	return s, err
+}
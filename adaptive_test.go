@@ -0,0 +1,157 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdaptiveStreams(t *testing.T) {
+	var overloaded int32 = 1
+	address := startEchoServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		_ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.LoadInt32(&overloaded) == 1 {
+			return nil, status.Error(codes.ResourceExhausted, "overloaded")
+		}
+		return handler(ctx, req)
+	}))
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 8
+	opt.AdaptiveStreamsLatency = time.Minute
+	opt.AdaptiveStreamsBackoff = 0.5
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.EqualValues(t, 8, p.Stats().StreamLimit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := p.Get()
+	require.NoError(t, err)
+	defer c.Close()
+	say := func() {
+		c.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+	}
+
+	// backed off by the overloaded backend, at least one stream is left
+	for _, limit := range []int{4, 2, 1, 1} {
+		say()
+		require.EqualValues(t, limit, p.Stats().StreamLimit)
+	}
+	require.False(t, c.TryAcquireStream())
+
+	// increased while at least half of the limit is in use
+	atomic.StoreInt32(&overloaded, 0)
+	for _, limit := range []int{2, 3, 3} {
+		say()
+		require.EqualValues(t, limit, p.Stats().StreamLimit)
+	}
+	require.True(t, c.TryAcquireStream())
+	for _, limit := range []int{4, 5, 5} {
+		say()
+		require.EqualValues(t, limit, p.Stats().StreamLimit)
+	}
+	c.ReleaseStream()
+
+	// the slow RPCs back it off too
+	opt.AdaptiveStreamsLatency = time.Nanosecond
+	p, err = New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{}))
+	require.EqualValues(t, 4, p.Stats().StreamLimit)
+}
+
+func TestAdaptiveStreamsCap(t *testing.T) {
+	address := startEchoServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		_ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, status.Error(codes.ResourceExhausted, "overloaded")
+	}))
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 2
+	opt.MaxConcurrentStreams = 4
+	opt.AdaptiveStreamsLatency = time.Minute
+	opt.AdaptiveStreamsBackoff = 0.5
+	opt.Wait = true
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// backed off to 1 stream, the pool serves 2 conns at most and doesn't grow
+	// beyond them nor dial one-time connections
+	for p.Stats().StreamLimit > 1 {
+		p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+	}
+	c1, err := p.Get()
+	require.NoError(t, err)
+	c2, err := p.Get()
+	require.NoError(t, err)
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	_, err = p.GetContext(short)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 2, p.Stats().Ref)
+	require.Equal(t, int64(2), p.Counters().Dials)
+
+	// the Gets waiting are admitted as the conns are given back
+	got := make(chan error, 1)
+	go func() {
+		c, err := p.GetContext(ctx)
+		if err == nil {
+			c.Close()
+		}
+		got <- err
+	}()
+	require.Eventually(t, func() bool { return p.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, c1.Close())
+	require.NoError(t, <-got)
+	require.NoError(t, c2.Close())
+}
+
+func TestAdaptiveStreamsCallerDeadline(t *testing.T) {
+	address := startEchoServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		_ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}))
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxConcurrentStreams = 8
+	opt.AdaptiveStreamsLatency = time.Minute
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the caller's own deadline passing isn't the backend overloaded
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.EqualValues(t, 8, p.Stats().StreamLimit)
+}
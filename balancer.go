@@ -0,0 +1,331 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// Scheme is the scheme of the pool resolver, and the name of the pool balancer.
+// a grpc.ClientConn of "pool:///host:port" dialed with BalancerDialOptions
+// manages its connections to host:port like a pool, so the existing stubs get
+// the slot and stream capacity management underneath.
+const Scheme = "pool"
+
+func init() {
+	balancer.Register(balancerBuilder{})
+}
+
+// BalancerDialOptions returns the dial options of a grpc.ClientConn managed by
+// the pool balancer, with the MaxIdle, MaxActive and MaxConcurrentStreams of
+// option. the balancer keeps MaxIdle connections, and grows up to MaxActive when
+// all of them have MaxConcurrentStreams RPCs in flight, it shrinks back to MaxIdle
+// once no RPC is in flight. the other options don't apply, the credentials and
+// such are set by the caller as usual.
+func BalancerDialOptions(option Options) []grpc.DialOption {
+	option = option.derive()
+	return []grpc.DialOption{grpc.WithResolvers(resolverBuilder{config: balancerConfig{
+		MaxIdle:              option.MaxIdle,
+		MaxActive:            option.MaxActive,
+		MaxConcurrentStreams: option.MaxConcurrentStreams,
+	}})}
+}
+
+// BalancerDialOptions returns the dial options of a grpc.ClientConn managed by
+// the pool balancer with the manager's options, see BalancerDialOptions.
+func (m *Manager) BalancerDialOptions() []grpc.DialOption {
+	return BalancerDialOptions(m.opt)
+}
+
+// resolverBuilder resolves "pool:///host:port" to host:port, with the service
+// config selecting the pool balancer.
+type resolverBuilder struct {
+	config balancerConfig
+}
+
+func (b resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	lb, err := json.Marshal(b.config)
+	if err != nil {
+		return nil, err
+	}
+	sc := cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:%s}]}`, Scheme, lb))
+	if sc.Err != nil {
+		return nil, sc.Err
+	}
+	err = cc.UpdateState(resolver.State{
+		Addresses:     []resolver.Address{{Addr: target.Endpoint()}},
+		ServiceConfig: sc,
+	})
+	return nopResolver{}, err
+}
+
+func (b resolverBuilder) Scheme() string {
+	return Scheme
+}
+
+type nopResolver struct{}
+
+func (nopResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (nopResolver) Close() {}
+
+type balancerConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	MaxIdle              int `json:"maxIdle"`
+	MaxActive            int `json:"maxActive"`
+	MaxConcurrentStreams int `json:"maxConcurrentStreams"`
+}
+
+type balancerBuilder struct{}
+
+func (balancerBuilder) Build(cc balancer.ClientConn, _ balancer.BuildOptions) balancer.Balancer {
+	return &poolBalancer{cc: cc}
+}
+
+func (balancerBuilder) Name() string {
+	return Scheme
+}
+
+func (balancerBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := balancerConfig{MaxIdle: DefaultOptions.MaxIdle, MaxActive: DefaultOptions.MaxActive,
+		MaxConcurrentStreams: DefaultOptions.MaxConcurrentStreams}
+	if err := json.Unmarshal(js, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.MaxIdle <= 0 || cfg.MaxActive <= 0 || cfg.MaxIdle > cfg.MaxActive || cfg.MaxConcurrentStreams <= 0 {
+		return nil, fmt.Errorf("invalid pool balancer config: %s", js)
+	}
+	return cfg, nil
+}
+
+// poolBalancer keeps the slots of SubConns to the address like pool keeps its
+// connections.
+type poolBalancer struct {
+	cc balancer.ClientConn
+
+	mu     sync.Mutex
+	config balancerConfig
+	addrs  []resolver.Address
+	slots  []*balancerSlot
+	err    error
+	closed bool
+
+	// atomic, set to 1 while a slot is being added.
+	growing int32
+
+	// atomic, set to 1 while the slots are being shrunk.
+	shrinking int32
+
+	// atomic, the number of RPCs in flight on all of the slots.
+	inflight int32
+}
+
+type balancerSlot struct {
+	sc    balancer.SubConn
+	state connectivity.State
+
+	// atomic, the number of RPCs in flight.
+	inflight int32
+}
+
+func (b *poolBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	config, ok := s.BalancerConfig.(balancerConfig)
+	if !ok || len(s.ResolverState.Addresses) == 0 {
+		return balancer.ErrBadResolverState
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.config = config
+	b.addrs = s.ResolverState.Addresses
+	for _, slot := range b.slots {
+		b.cc.UpdateAddresses(slot.sc, b.addrs)
+	}
+	for len(b.slots) < b.config.MaxIdle {
+		if err := b.addSlot(); err != nil {
+			return err
+		}
+	}
+	b.updateState()
+	return nil
+}
+
+func (b *poolBalancer) ResolverError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+	if len(b.slots) == 0 {
+		b.updateState()
+	}
+}
+
+func (b *poolBalancer) UpdateSubConnState(balancer.SubConn, balancer.SubConnState) {}
+
+func (b *poolBalancer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, slot := range b.slots {
+		slot.sc.Shutdown()
+	}
+	b.slots = nil
+}
+
+// addSlot adds a slot connecting to the address, it must be called with mu held.
+func (b *poolBalancer) addSlot() error {
+	slot := &balancerSlot{state: connectivity.Idle}
+	sc, err := b.cc.NewSubConn(b.addrs, balancer.NewSubConnOptions{
+		StateListener: func(s balancer.SubConnState) { b.updateSlot(slot, s) },
+	})
+	if err != nil {
+		return err
+	}
+	slot.sc = sc
+	b.slots = append(b.slots, slot)
+	sc.Connect()
+	return nil
+}
+
+// grow adds a slot unless there are MaxActive of them.
+func (b *poolBalancer) grow() {
+	defer atomic.StoreInt32(&b.growing, 0)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed && len(b.slots) < b.config.MaxActive {
+		b.addSlot()
+	}
+}
+
+// shrink shuts down the slots beyond MaxIdle unless RPCs are in flight again.
+func (b *poolBalancer) shrink() {
+	defer atomic.StoreInt32(&b.shrinking, 0)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || len(b.slots) <= b.config.MaxIdle || atomic.LoadInt32(&b.inflight) > 0 {
+		return
+	}
+	for _, slot := range b.slots[b.config.MaxIdle:] {
+		slot.sc.Shutdown()
+	}
+	b.slots = b.slots[:b.config.MaxIdle:b.config.MaxIdle]
+	b.updateState()
+}
+
+// done is called once an RPC picked on slot finishes, the slots are shrunk once
+// none is in flight.
+func (b *poolBalancer) done(slot *balancerSlot) {
+	atomic.AddInt32(&slot.inflight, -1)
+	if atomic.AddInt32(&b.inflight, -1) == 0 && atomic.CompareAndSwapInt32(&b.shrinking, 0, 1) {
+		go b.shrink()
+	}
+}
+
+func (b *poolBalancer) updateSlot(slot *balancerSlot, s balancer.SubConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	slot.state = s.ConnectivityState
+	switch s.ConnectivityState {
+	case connectivity.Idle:
+		slot.sc.Connect()
+	case connectivity.Ready:
+		b.err = nil
+	case connectivity.TransientFailure:
+		b.err = s.ConnectionError
+	}
+	b.updateState()
+}
+
+// updateState updates the state and picker of the ClientConn by the slots, it
+// must be called with mu held.
+func (b *poolBalancer) updateState() {
+	p := &balancerPicker{balancer: b, maxStreams: int32(b.config.MaxConcurrentStreams)}
+	state := connectivity.TransientFailure
+	for _, slot := range b.slots {
+		switch slot.state {
+		case connectivity.Ready:
+			state = connectivity.Ready
+			p.ready = append(p.ready, slot)
+		case connectivity.Connecting, connectivity.Idle:
+			if state != connectivity.Ready {
+				state = connectivity.Connecting
+			}
+		}
+	}
+	p.full = len(b.slots) >= b.config.MaxActive
+	p.err = b.err
+	b.cc.UpdateState(balancer.State{ConnectivityState: state, Picker: p})
+}
+
+// balancerPicker picks the ready slots round robin, skipping the ones with
+// MaxConcurrentStreams RPCs in flight. when all of them are, a slot is added
+// and the least loaded one is picked meanwhile.
+type balancerPicker struct {
+	balancer   *poolBalancer
+	ready      []*balancerSlot
+	full       bool
+	maxStreams int32
+	err        error
+
+	// atomic, used to select slot round robin.
+	index uint32
+}
+
+func (p *balancerPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.ready) == 0 {
+		if p.err != nil {
+			return balancer.PickResult{}, status.Errorf(codes.Unavailable, "pool balancer: %v", p.err)
+		}
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	var picked *balancerSlot
+	next := atomic.AddUint32(&p.index, 1)
+	for i := 0; i < len(p.ready); i++ {
+		slot := p.ready[(int(next)+i)%len(p.ready)]
+		if picked == nil || atomic.LoadInt32(&slot.inflight) < atomic.LoadInt32(&picked.inflight) {
+			picked = slot
+		}
+		if atomic.LoadInt32(&slot.inflight) < p.maxStreams {
+			picked = slot
+			break
+		}
+	}
+	if atomic.LoadInt32(&picked.inflight) >= p.maxStreams && !p.full &&
+		atomic.CompareAndSwapInt32(&p.balancer.growing, 0, 1) {
+		go p.balancer.grow()
+	}
+
+	atomic.AddInt32(&picked.inflight, 1)
+	atomic.AddInt32(&p.balancer.inflight, 1)
+	return balancer.PickResult{
+		SubConn: picked.sc,
+		Done:    func(balancer.DoneInfo) { p.balancer.done(picked) },
+	}, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/stats"
+)
+
+// connCounter counts the connections accepted and ended by a server.
+type connCounter struct {
+	countingHandler
+	conns int32
+	ended int32
+}
+
+func (h *connCounter) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	atomic.AddInt32(&h.conns, 1)
+	return ctx
+}
+
+func (h *connCounter) HandleConn(_ context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnEnd); ok {
+		atomic.AddInt32(&h.ended, 1)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	h := &connCounter{}
+	address := startEchoServer(t, grpc.StatsHandler(h))
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 2
+	opt.MaxConcurrentStreams = 1
+	opts := append(BalancerDialOptions(opt), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	cc, err := grpc.NewClient(Scheme+":///"+address, opts...)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := pb.NewEchoClient(cc)
+	res, err := client.Say(ctx, &pb.EchoRequest{Message: []byte("hi")})
+	require.NoError(t, err)
+	require.EqualValues(t, "hi", string(res.Message))
+	require.EqualValues(t, 1, atomic.LoadInt32(&h.conns))
+
+	// the stream in flight fills the only slot, so another one is added
+	desc := &grpc.StreamDesc{StreamName: "Say"}
+	cs, err := cc.NewStream(ctx, desc, "/pb.Echo/Say", grpc.WaitForReady(true))
+	require.NoError(t, err)
+	cs2, err := cc.NewStream(ctx, desc, "/pb.Echo/Say", grpc.WaitForReady(true))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&h.conns) == 2
+	}, 3*time.Second, time.Millisecond)
+
+	for _, s := range []grpc.ClientStream{cs, cs2} {
+		require.NoError(t, s.SendMsg(&pb.EchoRequest{Message: []byte("hi")}))
+		require.NoError(t, s.CloseSend())
+		require.NoError(t, s.RecvMsg(&pb.EchoResponse{}))
+	}
+
+	// it's shrunk back to MaxIdle once they're finished
+	for _, s := range []grpc.ClientStream{cs, cs2} {
+		require.Error(t, s.RecvMsg(&pb.EchoResponse{}))
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&h.ended) == 1
+	}, 3*time.Second, time.Millisecond)
+	_, err = client.Say(ctx, &pb.EchoRequest{Message: []byte("hi")})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, atomic.LoadInt32(&h.conns))
+}
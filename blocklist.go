@@ -0,0 +1,194 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBlockedEndpoint is the error resulting if the endpoint of a MultiPool is
+// blocked or not allowed.
+var ErrBlockedEndpoint = errors.New("endpoint is blocked")
+
+// ErrNoEndpoint is the error resulting if all of the endpoints of a MultiPool
+// are blocked or not allowed.
+var ErrNoEndpoint = errors.New("no endpoint is allowed")
+
+// Block see MultiPool interface.
+func (mp *multiPool) Block(address string, d time.Duration) error {
+	if !mp.known(address) {
+		return ErrUnknownEndpoint
+	}
+	mp.mu.Lock()
+	mp.blockSeq++
+	seq := mp.blockSeq
+	mp.blocked[address] = seq
+	mp.mu.Unlock()
+	log.Printf("multi pool endpoint blocked: %s, duration: %v\n", address, d)
+	if d > 0 {
+		mp.clock.AfterFunc(d, func() { mp.unblock(address, seq) })
+	}
+	return mp.update()
+}
+
+// Unblock see MultiPool interface.
+func (mp *multiPool) Unblock(address string) error {
+	if !mp.known(address) {
+		return ErrUnknownEndpoint
+	}
+	mp.mu.Lock()
+	delete(mp.blocked, address)
+	mp.mu.Unlock()
+	log.Printf("multi pool endpoint unblocked: %s\n", address)
+	return mp.update()
+}
+
+// unblock lifts the Block of seq when its duration passes, unless the address
+// is blocked again meanwhile.
+func (mp *multiPool) unblock(address string, seq uint64) {
+	mp.mu.Lock()
+	if mp.blocked[address] != seq {
+		mp.mu.Unlock()
+		return
+	}
+	delete(mp.blocked, address)
+	mp.mu.Unlock()
+	log.Printf("multi pool endpoint unblocked: %s\n", address)
+	if err := mp.update(); err != nil {
+		log.Printf("multi pool endpoint unblock failed: %s, err: %v\n", address, err)
+	}
+}
+
+// Allow see MultiPool interface.
+func (mp *multiPool) Allow(addresses ...string) error {
+	var allowed map[string]bool
+	if len(addresses) > 0 {
+		allowed = make(map[string]bool, len(addresses))
+		for _, address := range addresses {
+			if !mp.known(address) {
+				return ErrUnknownEndpoint
+			}
+			allowed[address] = true
+		}
+	}
+	mp.mu.Lock()
+	mp.allowed = allowed
+	mp.mu.Unlock()
+	log.Printf("multi pool endpoints allowed: %v\n", addresses)
+	return mp.update()
+}
+
+// known reports whether address is an address the pool is created with.
+func (mp *multiPool) known(address string) bool {
+	for _, a := range mp.addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded reports whether the endpoint of address is blocked or not allowed.
+func (mp *multiPool) isExcluded(address string) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.excludedLocked(address)
+}
+
+func (mp *multiPool) excludedLocked(address string) bool {
+	_, blocked := mp.blocked[address]
+	return blocked || mp.allowed != nil && !mp.allowed[address]
+}
+
+// update drains the endpoints excluded, and dials and probes the ones no longer
+// excluded like NewMulti, the failed ones are reported by Warnings.
+func (mp *multiPool) update() error {
+	mp.mu.Lock()
+	if mp.closed {
+		mp.mu.Unlock()
+		return ErrClosed
+	}
+	endpoints := make([]*endpointPool, 0, len(mp.endpoints))
+	for _, e := range mp.endpoints {
+		if !mp.excludedLocked(e.address) {
+			endpoints = append(endpoints, e)
+			continue
+		}
+		mp.excluded[e] = struct{}{}
+		go mp.drainExcluded(e)
+	}
+	mp.endpoints = endpoints
+	var dial []string
+	for _, address := range mp.addresses {
+		if !mp.excludedLocked(address) && !mp.presentLocked(address) {
+			dial = append(dial, address)
+		}
+	}
+	mp.mu.Unlock()
+
+	// dial without the lock held, the other endpoints are in use meanwhile
+	var errs []error
+	for _, address := range dial {
+		p, err := mp.dialEndpoint(address)
+		mp.mu.Lock()
+		switch {
+		case err != nil:
+			w := EndpointError{Address: address, Err: err}
+			mp.warnings = append(mp.warnings[:len(mp.warnings):len(mp.warnings)], w)
+			errs = append(errs, w)
+		case mp.closed || mp.excludedLocked(address) || mp.presentLocked(address):
+			p.Close()
+		default:
+			e := &endpointPool{address: address, pool: p}
+			e.pool.SetBypass(BypassMode(atomic.LoadInt32(&mp.bypass)))
+			mp.endpoints = append(mp.endpoints[:len(mp.endpoints):len(mp.endpoints)], e)
+			log.Printf("multi pool endpoint restored: %s\n", address)
+		}
+		mp.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// presentLocked reports whether address is an endpoint, or a failed one.
+func (mp *multiPool) presentLocked(address string) bool {
+	for _, e := range mp.endpoints {
+		if e.address == address {
+			return true
+		}
+	}
+	for _, w := range mp.warnings {
+		if w.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// drainExcluded drains the pool of the excluded endpoint e until its conns are
+// given back, or its DrainGracePeriod passes.
+func (mp *multiPool) drainExcluded(e *endpointPool) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainGracePeriodOf(e.pool))
+	defer cancel()
+	if err := e.pool.Drain(ctx); err != nil && err != ErrClosed {
+		log.Printf("drain excluded endpoint failed, address: %s, err: %v\n", e.address, err)
+	}
+	mp.mu.Lock()
+	delete(mp.excluded, e)
+	mp.mu.Unlock()
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// used records the time pc is borrowed or given back, see TestOnBorrow.
+func (p *pool) used(pc *physicalConn) {
+	if pc.slot >= 0 {
+		atomic.StoreInt64(&pc.track.usedAt, p.clock.Now().UnixNano())
+	}
+}
+
+// borrow verifies the connection of c by TestOnBorrow if it has been idle for
+// TestOnBorrowIdle. the connection failing it is evicted, and the checkout is
+// moved to another connection of the pool. the ones being replaced are skipped,
+// a one-time connection is dialed within ctx if all of them are.
+func (p *pool) borrow(ctx context.Context, c *conn, info *AcquireInfo) (Conn, error) {
+	for attempt := 0; attempt < p.opt.MaxActive; attempt++ {
+		pc := c.pc
+		if pc.slot < 0 || atomic.LoadInt32(&pc.ref) > 1 {
+			return c, nil
+		}
+		if pc.state() != ConnReplacing {
+			idleFor := p.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&pc.track.usedAt)))
+			p.used(pc)
+			if idleFor < p.opt.TestOnBorrowIdle {
+				return c, nil
+			}
+			cc := pc.cc.Load()
+			if cc == nil {
+				return c, nil
+			}
+			err := p.opt.TestOnBorrow(cc, idleFor)
+			if err == nil {
+				return c, nil
+			}
+			p.evict(pc, fmt.Sprintf("test on borrow failed, idle: %v, err: %v", idleFor, err))
+		}
+		c.undo()
+
+		if c = p.pick(ctx); c == nil {
+			return nil, p.pickErr()
+		}
+	}
+	c.undo()
+	pc, err := p.dial(ctx, -1, p.opt.Wait)
+	if err != nil {
+		p.decrRef()
+		return nil, err
+	}
+	info.dialed()
+	return p.checkout(pc, true), nil
+}
+
+// undo gives back the checkout of c which isn't handed out, the reference of
+// the pool is kept for another one.
+func (c *conn) undo() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.drop()
+}
+
+// giveBack inspects the connection of a conn being closed by TestOnReturn, the
+// connection failing it is evicted.
+func (p *pool) giveBack(pc *physicalConn) {
+	if pc.slot < 0 {
+		return
+	}
+	cc := pc.cc.Load()
+	if cc == nil {
+		return
+	}
+	var lastErr error
+	if err := pc.track.lastErr.Load(); err != nil {
+		lastErr = *err
+	}
+	if err := p.opt.TestOnReturn(cc, lastErr); err != nil {
+		p.evict(pc, "test on return failed: "+err.Error())
+	}
+}
+
+// finished records the error of an RPC finished on pc, see TestOnReturn.
+func (pc *physicalConn) finished(err error) {
+	pc.track.lastErr.Store(&err)
+}
+
+// returnInterceptor records the error of the unary RPCs, see TestOnReturn.
+func (pc *physicalConn) returnInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	pc.finished(err)
+	return err
+}
+
+// returnStreamInterceptor is like returnInterceptor for the streams, they're
+// finished once RecvMsg fails, io.EOF is recorded as success.
+func (pc *physicalConn) returnStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		pc.finished(err)
+		return nil, err
+	}
+	return &returnStream{ClientStream: s, pc: pc}, nil
+}
+
+type returnStream struct {
+	grpc.ClientStream
+	pc *physicalConn
+}
+
+func (s *returnStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.pc.finished(nil)
+	} else if err != nil {
+		s.pc.finished(err)
+	}
+	return err
+}
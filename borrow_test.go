@@ -0,0 +1,123 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestOnBorrow(t *testing.T) {
+	var tests, fails int32
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.TestOnBorrowIdle = 20 * time.Millisecond
+	opt.TestOnBorrow = func(_ *grpc.ClientConn, idleFor time.Duration) error {
+		atomic.AddInt32(&tests, 1)
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			return errors.New("corpse")
+		}
+		return nil
+	}
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the connections used recently aren't verified
+	c, err := p.Get()
+	require.NoError(t, err)
+	generation := c.Info().Generation
+	require.NoError(t, c.Close())
+	require.EqualValues(t, 0, atomic.LoadInt32(&tests))
+
+	// the idle one failing is replaced in background, a one-time connection is
+	// handed out meanwhile since there is no other
+	time.Sleep(30 * time.Millisecond)
+	atomic.StoreInt32(&fails, 1)
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&tests))
+	require.Equal(t, -1, c.Info().Slot)
+	_, err = c.ClientConn()
+	require.NoError(t, err)
+	require.Equal(t, 1, p.Stats().Ref)
+	require.NoError(t, c.Close())
+	require.Equal(t, 0, p.Stats().Ref)
+	require.Eventually(t, func() bool {
+		return p.Counters().Evictions == 1
+	}, time.Second, time.Millisecond)
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.Greater(t, c.Info().Generation, generation)
+	require.NoError(t, c.Close())
+	require.EqualValues(t, 1, atomic.LoadInt32(&tests))
+
+	// the idle one passing is handed out
+	time.Sleep(30 * time.Millisecond)
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, atomic.LoadInt32(&tests))
+	require.NoError(t, c.Close())
+}
+
+func TestOnReturn(t *testing.T) {
+	returns := make(chan error, 4)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.TestOnReturn = func(_ *grpc.ClientConn, lastErr error) error {
+		select {
+		case returns <- lastErr:
+		default:
+		}
+		return lastErr
+	}
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	generation := c.Info().Generation
+	require.NoError(t, c.Value().Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.NoError(t, c.Close())
+	require.NoError(t, <-returns)
+
+	// the connection which just failed is evicted
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.Equal(t, generation, c.Info().Generation)
+	err = c.Value().Invoke(ctx, "/pb.Echo/Missing", &pb.EchoRequest{}, &pb.EchoResponse{})
+	require.Error(t, err)
+	require.NoError(t, c.Close())
+	require.Equal(t, err, <-returns)
+	require.Eventually(t, func() bool {
+		c, err := p.Get()
+		require.NoError(t, err)
+		defer c.Close()
+		return c.Info().Generation > generation
+	}, 3*time.Second, time.Millisecond)
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BrokenPolicy is what happens to the connection of a Conn marked broken by
+// MarkBroken once the Conn is closed.
+type BrokenPolicy int
+
+const (
+	// BrokenReturn gives the connection back to the pool as usual, it's the default.
+	BrokenReturn BrokenPolicy = iota
+
+	// BrokenValidate validates the connection in background, by TestOnReturn with
+	// the marked error if it's set, or by a health check, see HealthCheckService.
+	// the connection failing it is evicted, the servers without the health service
+	// pass it. the connection isn't tested by TestOnReturn again as it's given back.
+	BrokenValidate
+
+	// BrokenEvict evicts the connection.
+	BrokenEvict
+)
+
+func (b BrokenPolicy) String() string {
+	switch b {
+	case BrokenReturn:
+		return "return"
+	case BrokenValidate:
+		return "validate"
+	case BrokenEvict:
+		return "evict"
+	}
+	return "unknown"
+}
+
+// MarkBroken see Conn interface.
+func (c *conn) MarkBroken(err error) {
+	c.debug.used(c, "MarkBroken")
+	if err != nil {
+		c.broken.Store(&err)
+	}
+}
+
+// returnBroken applies BrokenPolicy to pc of a conn marked broken by err, it's
+// called as the conn is closed. it reports whether pc is evicted or validated,
+// so it's not tested by TestOnReturn again.
+func (p *pool) returnBroken(pc *physicalConn, err error) bool {
+	switch p.opt.BrokenPolicy {
+	case BrokenEvict:
+		p.evict(pc, fmt.Sprintf("conn marked broken: %v", err))
+		return true
+	case BrokenValidate:
+		if pc.slot < 0 {
+			return false
+		}
+		p.spawn("validate", pc.slot, func() {
+			if err := p.validateBroken(pc, err); err != nil {
+				p.evict(pc, fmt.Sprintf("conn marked broken failed validation: %v", err))
+			}
+		})
+		return true
+	}
+	return false
+}
+
+// validateBroken validates pc marked broken by err, see BrokenValidate.
+func (p *pool) validateBroken(pc *physicalConn, err error) error {
+	if p.opt.TestOnReturn != nil {
+		cc := pc.cc.Load()
+		if cc == nil {
+			return nil
+		}
+		return p.opt.TestOnReturn(cc, err)
+	}
+	if err := p.check(pc); err != nil && status.Code(err) != codes.Unimplemented {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestBrokenPolicy(t *testing.T) {
+	errBroken := errors.New("transport is closing")
+	// returned closes a conn marked broken, then one not marked which is given
+	// back as usual
+	returned := func(policy BrokenPolicy, testOnReturn func(*grpc.ClientConn, error) error) *pool {
+		opt := DefaultOptions
+		opt.MaxIdle = 1
+		opt.BrokenPolicy = policy
+		opt.TestOnReturn = testOnReturn
+		p, err := New(startEchoServer(t), opt)
+		require.NoError(t, err)
+		t.Cleanup(func() { p.Close() })
+
+		c, err := p.Get()
+		require.NoError(t, err)
+		c.MarkBroken(errBroken)
+		require.NoError(t, c.Close())
+		c, err = p.Get()
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		return p.(*pool)
+	}
+
+	p := returned(BrokenReturn, nil)
+	require.Zero(t, p.Counters().Evictions)
+	p = returned(BrokenEvict, nil)
+	require.Eventually(t, func() bool { return p.Counters().Evictions == 1 }, time.Second, time.Millisecond)
+
+	// the echo server has no health service, it passes the validation
+	p = returned(BrokenValidate, nil)
+	require.NoError(t, p.validateBroken(p.liveConns()[0], errBroken))
+
+	// the validation by TestOnReturn takes the place of the test as it's given
+	// back
+	var calls int32
+	validated := make(chan struct{})
+	p = returned(BrokenValidate, func(_ *grpc.ClientConn, err error) error {
+		atomic.AddInt32(&calls, 1)
+		if err == errBroken {
+			close(validated)
+		}
+		return err
+	})
+	<-validated
+	require.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	require.Eventually(t, func() bool { return p.Counters().Evictions == 1 }, time.Second, time.Millisecond)
+}
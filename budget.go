@@ -0,0 +1,274 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the resources of a Budget.
+const (
+	budgetConnections = iota
+	budgetStreams
+)
+
+// Budget is a process-wide cap on the connections and streams of the pools
+// sharing it, so one noisy dependency can't consume the whole file-descriptor
+// budget. the pools share it by setting the same Budget in their Options.
+//
+// Under contention the budget is allocated weighted max-min fair: a released
+// connection or stream goes to the waiting pool using the least of it relative
+// to its BudgetWeight. the weighted share of a BudgetCritical pool is reserved,
+// the other pools can't use it even while the pool doesn't.
+type Budget struct {
+	max [2]int
+
+	mu     sync.Mutex
+	used   [2]int
+	shares map[*budgetShare]struct{}
+
+	// closed and replaced whenever a connection or stream is released.
+	released chan struct{}
+
+	// the waiter queues of the normal and the critical shares.
+	classes [2]budgetClass
+}
+
+// budgetClass is the waiter queue of the shares of a priority class.
+type budgetClass struct {
+	waiting int
+	waits   latencyWindow
+	shed    int
+}
+
+func (c *budgetClass) stats() BudgetClassStats {
+	return BudgetClassStats{
+		Waiting: c.waiting,
+		WaitP50: c.waits.percentile(50),
+		WaitP90: c.waits.percentile(90),
+		WaitP99: c.waits.percentile(99),
+		Shed:    c.shed,
+	}
+}
+
+// budgetShare is the share of a pool in a Budget.
+type budgetShare struct {
+	budget   *Budget
+	weight   int
+	critical bool
+	used     [2]int
+
+	// measures the waits of the pool's acquires.
+	clock Clock
+
+	// the number of acquires waiting.
+	waiting [2]int
+}
+
+// BudgetStats is a snapshot of the usage of a Budget.
+type BudgetStats struct {
+	// Connections is the number of connections open.
+	Connections int
+
+	// Streams is the number of logic connections checked out.
+	Streams int
+
+	MaxConnections int
+	MaxStreams     int
+
+	// Normal and Critical are the waiter queues of the pools with BudgetCritical
+	// unset and set, so the operators can verify the critical pools are protected
+	// under saturation.
+	Normal   BudgetClassStats
+	Critical BudgetClassStats
+}
+
+// BudgetClassStats is the waiter queue of the pools of a priority class.
+type BudgetClassStats struct {
+	// Waiting is the number of Gets and dials waiting for the budget.
+	Waiting int
+
+	// WaitP50, WaitP90 and WaitP99 are the percentiles of the recent waits.
+	WaitP50 time.Duration
+	WaitP90 time.Duration
+	WaitP99 time.Duration
+
+	// Shed is the number of Gets and dials failed for the budget.
+	Shed int
+}
+
+// NewBudget return a budget of maxConnections connections and maxStreams logic
+// connections checked out at a time, zero means no cap.
+func NewBudget(maxConnections, maxStreams int) *Budget {
+	return &Budget{
+		max:      [2]int{maxConnections, maxStreams},
+		shares:   make(map[*budgetShare]struct{}),
+		released: make(chan struct{}),
+	}
+}
+
+// Stats returns the usage of the budget.
+func (b *Budget) Stats() BudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BudgetStats{
+		Connections:    b.used[budgetConnections],
+		Streams:        b.used[budgetStreams],
+		MaxConnections: b.max[budgetConnections],
+		MaxStreams:     b.max[budgetStreams],
+		Normal:         b.classes[0].stats(),
+		Critical:       b.classes[1].stats(),
+	}
+}
+
+// join adds the share of a pool to the budget, its waits are measured by clock.
+func (b *Budget) join(weight int, critical bool, clock Clock) *budgetShare {
+	if weight <= 0 {
+		weight = 1
+	}
+	s := &budgetShare{budget: b, weight: weight, critical: critical, clock: clock}
+	b.mu.Lock()
+	b.shares[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// leave removes the share from the budget, what it still uses is released as
+// usual, but its reservation is given up.
+func (s *budgetShare) leave() {
+	b := s.budget
+	b.mu.Lock()
+	delete(b.shares, s)
+	b.broadcast()
+	b.mu.Unlock()
+}
+
+// acquire takes a connection or a stream from the budget. when it can't be
+// taken it waits for a release if wait is true, until ctx or closed is done,
+// otherwise returns ErrExhausted. waiting is increased while it waits.
+func (s *budgetShare) acquire(ctx context.Context, closed <-chan struct{}, r int, wait bool, waiting *int32) error {
+	b := s.budget
+	b.mu.Lock()
+	if b.max[r] <= 0 {
+		b.used[r]++
+		s.used[r]++
+		b.mu.Unlock()
+		return nil
+	}
+
+	class := &b.classes[s.class()]
+	s.waiting[r]++
+	defer func() {
+		s.waiting[r]--
+		b.mu.Unlock()
+	}()
+	var start time.Time
+	for {
+		if b.allow(s, r) {
+			b.used[r]++
+			s.used[r]++
+			if !start.IsZero() {
+				class.waits.add(s.clock.Now().Sub(start))
+			}
+			return nil
+		}
+		if !wait {
+			class.shed++
+			return ErrExhausted
+		}
+		if start.IsZero() {
+			start = s.clock.Now()
+			class.waiting++
+			defer func() { class.waiting-- }()
+		}
+		if waiting != nil {
+			atomic.AddInt32(waiting, 1)
+			defer atomic.AddInt32(waiting, -1)
+			waiting = nil
+		}
+		released := b.released
+		b.mu.Unlock()
+		select {
+		case <-released:
+			b.mu.Lock()
+		case <-ctx.Done():
+			b.mu.Lock()
+			class.shed++
+			return ctx.Err()
+		case <-closed:
+			b.mu.Lock()
+			class.shed++
+			return ErrClosed
+		}
+	}
+}
+
+// class returns the index of the priority class of s in Budget.classes.
+func (s *budgetShare) class() int {
+	if s.critical {
+		return 1
+	}
+	return 0
+}
+
+// release gives back a connection or a stream.
+func (s *budgetShare) release(r int) {
+	b := s.budget
+	b.mu.Lock()
+	b.used[r]--
+	s.used[r]--
+	b.broadcast()
+	b.mu.Unlock()
+}
+
+// allow reports whether s may take the resource r, it must be called with mu
+// held. s may take it if the budget isn't used up, the reservations of the
+// other critical shares are left, and no waiting share uses less of it relative
+// to its weight.
+func (b *Budget) allow(s *budgetShare, r int) bool {
+	free := b.max[r] - b.used[r]
+	if free <= 0 {
+		return false
+	}
+
+	var weights int
+	for o := range b.shares {
+		weights += o.weight
+	}
+	for o := range b.shares {
+		if o == s {
+			continue
+		}
+		if o.critical {
+			if reserved := b.max[r]*o.weight/weights - o.used[r]; reserved > 0 {
+				free -= reserved
+			}
+		}
+		// o is more deserving if o.used/o.weight < s.used/s.weight.
+		if o.waiting[r] > 0 && o.used[r]*s.weight < s.used[r]*o.weight {
+			return false
+		}
+	}
+	return free > 0
+}
+
+// broadcast wakes up the waiting acquires, it must be called with mu held.
+func (b *Budget) broadcast() {
+	close(b.released)
+	b.released = make(chan struct{})
+}
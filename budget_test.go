@@ -0,0 +1,171 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudget(t *testing.T) {
+	budget := NewBudget(3, 2)
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.Budget = budget
+
+	opt.MaxIdle = 2
+	p1, err := New("127.0.0.1:50000", opt)
+	require.NoError(t, err)
+	defer p1.Close()
+	opt.MaxIdle = 1
+	p2, err := New("127.0.0.1:50001", opt)
+	require.NoError(t, err)
+	_, err = New("127.0.0.1:50002", opt)
+	require.EqualError(t, err, "dial is not able to fill the pool: pool is exhausted")
+	require.EqualValues(t, 3, budget.Stats().Connections)
+
+	c1, err := p1.Get()
+	require.NoError(t, err)
+	c2, err := p2.Get()
+	require.NoError(t, err)
+	_, err = p1.Get()
+	require.EqualError(t, err, ErrExhausted.Error())
+	require.EqualValues(t, 2, budget.Stats().Streams)
+
+	require.NoError(t, c2.Close())
+	c3, err := p1.Get()
+	require.NoError(t, err)
+	require.NoError(t, c3.Close())
+	require.NoError(t, c1.Close())
+	require.EqualValues(t, 0, budget.Stats().Streams)
+
+	require.NoError(t, p2.Close())
+	require.EqualValues(t, 2, budget.Stats().Connections)
+}
+
+func TestBudgetWait(t *testing.T) {
+	budget := NewBudget(0, 1)
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.Budget = budget
+	opt.Wait = true
+	p, err := New("127.0.0.1:50000", opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	time.AfterFunc(10*time.Millisecond, func() { c.Close() })
+	c, err = p.GetContext(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	// the timed out Get is shed, the other waited
+	stats := budget.Stats().Normal
+	require.Equal(t, 0, stats.Waiting)
+	require.Equal(t, 1, stats.Shed)
+	require.GreaterOrEqual(t, stats.WaitP99, 5*time.Millisecond)
+	require.Equal(t, BudgetClassStats{}, budget.Stats().Critical)
+}
+
+func TestBudgetCritical(t *testing.T) {
+	budget := NewBudget(0, 4)
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.Budget = budget
+	opt.BudgetCritical = true
+	critical, err := New("127.0.0.1:50000", opt)
+	require.NoError(t, err)
+	defer critical.Close()
+	opt.BudgetCritical = false
+	bestEffort, err := New("127.0.0.1:50001", opt)
+	require.NoError(t, err)
+	defer bestEffort.Close()
+
+	// half of the budget is reserved for the critical pool
+	for i := 0; i < 2; i++ {
+		_, err = bestEffort.Get()
+		require.NoError(t, err)
+	}
+	_, err = bestEffort.Get()
+	require.EqualError(t, err, ErrExhausted.Error())
+	for i := 0; i < 2; i++ {
+		_, err = critical.Get()
+		require.NoError(t, err)
+	}
+	_, err = critical.Get()
+	require.EqualError(t, err, ErrExhausted.Error())
+	require.Equal(t, 1, budget.Stats().Normal.Shed)
+	require.Equal(t, 1, budget.Stats().Critical.Shed)
+}
+
+func TestBudgetWeighted(t *testing.T) {
+	budget := NewBudget(0, 4)
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.Budget = budget
+	opt.Wait = true
+	opt.BudgetWeight = 3
+	heavy, err := New("127.0.0.1:50000", opt)
+	require.NoError(t, err)
+	defer heavy.Close()
+	opt.BudgetWeight = 1
+	light, err := New("127.0.0.1:50001", opt)
+	require.NoError(t, err)
+	defer light.Close()
+
+	var lights []Conn
+	for i := 0; i < 2; i++ {
+		_, err = heavy.Get()
+		require.NoError(t, err)
+		c, err := light.Get()
+		require.NoError(t, err)
+		lights = append(lights, c)
+	}
+
+	got := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, p := range map[string]Pool{"heavy": heavy, "light": light} {
+		go func(name string, p Pool) {
+			if _, err := p.GetContext(ctx); err == nil {
+				got <- name
+			}
+		}(name, p)
+	}
+	waiting := func(p Pool) int {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		return p.(*pool).share.waiting[budgetStreams]
+	}
+	require.Eventually(t, func() bool {
+		return waiting(heavy) == 1 && waiting(light) == 1
+	}, time.Second, time.Millisecond)
+
+	// heavy uses 2/3 of its weight and light 1/1, so heavy is served first
+	require.NoError(t, lights[0].Close())
+	require.EqualValues(t, "heavy", <-got)
+}
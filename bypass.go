@@ -0,0 +1,133 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// BypassMode is how the Gets bypass the pool's connections, see SetBypass.
+type BypassMode int32
+
+const (
+	// BypassOff hands out the pool's connections, it's the default.
+	BypassOff BypassMode = iota
+
+	// BypassShared hands out a single connection shared by all of the Gets, it's
+	// dialed by the first Get and closed once the bypass is switched off.
+	BypassShared
+
+	// BypassDial dials a one-time connection for every Get, it's closed when the
+	// conn is closed.
+	BypassDial
+)
+
+func (m BypassMode) String() string {
+	switch m {
+	case BypassOff:
+		return "off"
+	case BypassShared:
+		return "shared"
+	case BypassDial:
+		return "dial"
+	}
+	return "unknown"
+}
+
+// SetBypass see Pool interface.
+func (p *pool) SetBypass(mode BypassMode) {
+	if old := BypassMode(atomic.SwapInt32(&p.bypass, int32(mode))); old != mode {
+		log.Printf("pool bypass: %v ---> %v, address: %s\n", old, mode, p.address)
+	}
+	if mode != BypassShared {
+		p.dropShared()
+	}
+}
+
+// getBypassed is get while the bypass is switched on, the reference of the pool
+// has been taken.
+func (p *pool) getBypassed(ctx context.Context, mode BypassMode, info *AcquireInfo) (Conn, error) {
+	if mode == BypassDial {
+		pc, err := p.dial(ctx, -1, p.opt.Wait)
+		if err != nil {
+			p.decrRef()
+			return nil, err
+		}
+		info.dialed()
+		return p.checkout(pc, true), nil
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		pc, err := p.sharedConn(ctx, info)
+		if err != nil {
+			p.decrRef()
+			return nil, err
+		}
+		if pc == nil {
+			break
+		}
+		if p.claim(pc) {
+			return p.checkoutClaimed(pc, false), nil
+		}
+	}
+	// the bypass is switched off meanwhile
+	return p.picked(ctx, p.pick(ctx), info)
+}
+
+// sharedConn returns the connection of BypassShared, it's dialed if there is
+// none. it's nil if the bypass is switched off.
+func (p *pool) sharedConn(ctx context.Context, info *AcquireInfo) (*physicalConn, error) {
+	p.bypassMu.Lock()
+	defer p.bypassMu.Unlock()
+
+	if err := p.stateErr(); err != nil {
+		return nil, err
+	}
+	if BypassMode(atomic.LoadInt32(&p.bypass)) != BypassShared {
+		return nil, nil
+	}
+	if p.shared == nil {
+		pc, err := p.dial(ctx, -1, p.opt.Wait)
+		if err != nil {
+			return nil, err
+		}
+		info.dialed()
+		p.shared = pc
+	}
+	return p.shared, nil
+}
+
+// dropShared retires the connection of BypassShared, if any.
+func (p *pool) dropShared() {
+	p.bypassMu.Lock()
+	pc := p.shared
+	p.shared = nil
+	p.bypassMu.Unlock()
+	if pc != nil {
+		pc.retire()
+	}
+}
+
+// SetBypass see Pool interface. every endpoint is switched to mode, so are the
+// endpoints recovered or restored later.
+func (mp *multiPool) SetBypass(mode BypassMode) {
+	atomic.StoreInt32(&mp.bypass, int32(mode))
+	endpoints, _ := mp.snapshot()
+	for _, e := range endpoints {
+		e.pool.SetBypass(mode)
+	}
+}
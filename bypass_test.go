@@ -0,0 +1,97 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetBypass(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// every Get shares a single connection apart from the pool's
+	p.SetBypass(BypassShared)
+	c1, err := p.Get()
+	require.NoError(t, err)
+	c2, err := p.Get()
+	require.NoError(t, err)
+	shared := c1.(*conn).pc
+	require.Equal(t, -1, shared.slot)
+	require.Same(t, shared, c2.(*conn).pc)
+	require.NoError(t, c1.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.NoError(t, c1.Close())
+	require.NoError(t, c2.Close())
+	require.NotNil(t, shared.cc.Load())
+	require.EqualValues(t, 2, p.Stats().Current)
+	require.EqualValues(t, 0, p.Stats().Ref)
+
+	// every Get dials a connection closed along with the conn
+	p.SetBypass(BypassDial)
+	require.Nil(t, shared.cc.Load())
+	c1, err = p.Get()
+	require.NoError(t, err)
+	c2, err = p.Get()
+	require.NoError(t, err)
+	require.Equal(t, -1, c1.(*conn).pc.slot)
+	require.NotSame(t, c1.(*conn).pc, c2.(*conn).pc)
+	require.NoError(t, c1.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.NoError(t, c1.Close())
+	require.Nil(t, c1.(*conn).pc.cc.Load())
+	require.NoError(t, c2.Close())
+
+	// the shared connection checked out is closed once it's given back
+	p.SetBypass(BypassShared)
+	c1, err = p.Get()
+	require.NoError(t, err)
+	p.SetBypass(BypassOff)
+	shared = c1.(*conn).pc
+	require.NotNil(t, shared.cc.Load())
+	require.NoError(t, c1.Close())
+	require.Nil(t, shared.cc.Load())
+
+	c1, err = p.Get()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, c1.(*conn).pc.slot, 0)
+	require.NoError(t, c1.Close())
+	require.EqualValues(t, 0, p.Stats().Ref)
+}
+
+func TestSetBypassMulti(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	mp, err := NewMulti([]string{startEchoServer(t), startEchoServer(t)}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	mp.SetBypass(BypassDial)
+	for i := 0; i < 2; i++ {
+		c, err := mp.Get()
+		require.NoError(t, err)
+		require.Equal(t, -1, c.(*conn).pc.slot)
+		require.NoError(t, c.Close())
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Invoke see grpc.ClientConnInterface. A connection is checked out of the pool
+// for the duration of the call and given back once the call returns. the call
+// is bounded by Options.CallTimeout if ctx has no deadline.
+func (p *pool) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	return invoke(ctx, p, p.opt.CallTimeout, method, args, reply, opts...)
+}
+
+// NewStream see grpc.ClientConnInterface. A connection is checked out of the pool
+// and given back when the stream finishes, that is when the ctx is done or the
+// stream returns an error as described by grpc.ClientConn.NewStream. If the
+// stream can't be created because the connection has just died, it's retried
+// on another connection, see Options.NewStreamRetries.
+func (p *pool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return newStream(ctx, p, p.opt.newStreamRetries(), desc, method, opts...)
+}
+
+// invoke makes a unary call on a connection checked out of p, bounded by timeout
+// if ctx has no deadline and timeout is positive.
+func invoke(ctx context.Context, p Pool, timeout time.Duration, method string, args, reply interface{},
+	opts ...grpc.CallOption) error {
+	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if c := coalescerOf(p); c != nil && c.method(method) {
+		m, ok := message(reply)
+		shared, options, sharable := sharedCallOptions(opts)
+		if ok && sharable {
+			if key, ok := coalesceKey(ctx, method, options, args); ok {
+				return c.do(ctx, key, m, func(ctx context.Context, reply proto.Message) error {
+					return invokeOnce(ctx, p, method, args, reply, shared...)
+				})
+			}
+		}
+	}
+	return invokeOnce(ctx, p, method, args, reply, opts...)
+}
+
+// invokeOnce makes a unary call on a connection checked out of p.
+func invokeOnce(ctx context.Context, p Pool, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	retryBudgetOf(p).request()
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Invoke(ctx, method, args, reply, opts...)
+}
+
+// newStream creates a stream on a connection checked out of p.
+func newStream(ctx context.Context, p Pool, retries int, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	budget := retryBudgetOf(p)
+	budget.request()
+	for attempt := 0; ; attempt++ {
+		s, err := newStreamOnce(ctx, p, desc, method, opts...)
+		if err == nil || attempt >= retries || !connDied(ctx, err) || !budget.retry() {
+			return s, err
+		}
+	}
+}
+
+// newStreamOnce creates a stream on a connection checked out of p, the
+// connection is evicted if it has died.
+func newStreamOnce(ctx context.Context, p Pool, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cs, err := c.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		if nc, ok := c.(*conn); ok && connDied(ctx, err) && nc.transportFailed() {
+			nc.pool.evict(nc.pc, fmt.Sprintf("new stream failed: %v", err))
+		}
+		cancel()
+		c.Close()
+		return nil, err
+	}
+
+	s := &stream{ClientStream: cs, desc: desc, conn: c, cancel: cancel}
+	context.AfterFunc(ctx, s.finish)
+	return s, nil
+}
+
+// connDied reports whether err of creating a stream is caused by the connection
+// rather than the call, so the stream can be created on another connection.
+func connDied(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return err == ErrConnReset || status.Code(err) == codes.Unavailable
+}
+
+// transportFailed reports whether the connection of c is in TransientFailure,
+// so the Unavailable of the stream is caused by its transport rather than e.g.
+// the backend or a proxy rejecting it.
+func (c *conn) transportFailed() bool {
+	cc := c.pc.cc.Load()
+	return cc != nil && cc.GetState() == connectivity.TransientFailure
+}
+
+// stream is wrapped grpc.ClientStream, it gives the connection back to
+// the pool exactly once when the stream finishes.
+type stream struct {
+	grpc.ClientStream
+	desc   *grpc.StreamDesc
+	conn   Conn
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (s *stream) finish() {
+	s.once.Do(func() {
+		s.cancel()
+		s.conn.Close()
+	})
+}
+
+func (s *stream) Header() (md metadata.MD, err error) {
+	md, err = s.ClientStream.Header()
+	if err != nil {
+		s.finish()
+	}
+	return md, err
+}
+
+func (s *stream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err != nil && err != io.EOF {
+		s.finish()
+	}
+	return err
+}
+
+func (s *stream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.desc.ServerStreams {
+		s.finish()
+	}
+	return err
+}
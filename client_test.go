@@ -0,0 +1,482 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+type echoServer struct{}
+
+func (s *echoServer) Say(_ context.Context, req *pb.EchoRequest) (*pb.EchoResponse, error) {
+	return &pb.EchoResponse{Message: req.Message}, nil
+}
+
+// startEchoServer starts an in-process echo server and returns its address.
+func startEchoServer(t *testing.T, opts ...grpc.ServerOption) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := grpc.NewServer(opts...)
+	pb.RegisterEchoServer(s, &echoServer{})
+	go s.Serve(listen)
+	t.Cleanup(s.Stop)
+
+	return listen.Addr().String()
+}
+
+func TestPoolInvoke(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res := &pb.EchoResponse{}
+	err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res)
+	require.NoError(t, err)
+	require.EqualValues(t, "hi", string(res.Message))
+	require.EqualValues(t, 0, p.(*pool).ref)
+}
+
+func TestPoolNewStream(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	desc := &grpc.StreamDesc{StreamName: "Say"}
+	cs, err := p.NewStream(ctx, desc, "/pb.Echo/Say")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, p.(*pool).ref)
+
+	require.NoError(t, cs.SendMsg(&pb.EchoRequest{Message: []byte("hi")}))
+	require.NoError(t, cs.CloseSend())
+	res := &pb.EchoResponse{}
+	require.NoError(t, cs.RecvMsg(res))
+	require.EqualValues(t, "hi", string(res.Message))
+	require.EqualValues(t, 0, p.(*pool).ref)
+}
+
+type countingHandler struct {
+	rpcs int32
+}
+
+func (h *countingHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	atomic.AddInt32(&h.rpcs, 1)
+	return ctx
+}
+
+func (h *countingHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (h *countingHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *countingHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func TestStatsHandler(t *testing.T) {
+	h := &countingHandler{}
+	opt := DefaultOptions
+	opt.StatsHandler = h
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 3, atomic.LoadInt32(&h.rpcs))
+}
+
+func TestSLAReplace(t *testing.T) {
+	slow := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		time.Sleep(5 * time.Millisecond)
+		return handler(ctx, req)
+	})
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.SLALatency = time.Millisecond
+	opt.SLAWindow = 20 * time.Millisecond
+	p, err := New(startEchoServer(t, slow), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.Eventually(t, func() bool {
+		err := p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{})
+		require.NoError(t, err)
+		return atomic.LoadInt32(&nativePool.liveConns()[0].attempts) > 1
+	}, 3*time.Second, time.Millisecond)
+}
+
+func TestUsageReport(t *testing.T) {
+	reports := make(chan []ConnUsage, 16)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.UsageReport = func(usages []ConnUsage) {
+		select {
+		case reports <- usages:
+		default:
+		}
+	}
+	opt.UsageReportInterval = 10 * time.Millisecond
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+		require.NoError(t, err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case usages := <-reports:
+			require.Len(t, usages, 1)
+			if usages[0].Streams == 2 {
+				require.EqualValues(t, 0, usages[0].Slot)
+				require.EqualValues(t, true, usages[0].BytesSent > 0)
+				require.EqualValues(t, true, usages[0].BytesReceived > 0)
+				return
+			}
+		case <-timeout:
+			t.Fatal("no usage report of the streams")
+		}
+	}
+}
+
+func TestNewStreamRetry(t *testing.T) {
+	address := startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.MaxActive = 2
+	opt.NewStreamRetries = 1
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		if req.SlotIndex == 0 {
+			// the connection of slot 0 is dead
+			req.Target = "127.0.0.1:1"
+		}
+		return dialDefault(req)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	desc := &grpc.StreamDesc{StreamName: "Say"}
+
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	for i := 0; i < 4; i++ {
+		cs, err := p.NewStream(ctx, desc, "/pb.Echo/Say")
+		require.NoError(t, err)
+		require.NoError(t, cs.SendMsg(&pb.EchoRequest{Message: []byte("hi")}))
+		require.NoError(t, cs.CloseSend())
+		require.NoError(t, cs.RecvMsg(&pb.EchoResponse{}))
+	}
+
+	// they're off by default
+	opt.NewStreamRetries = 0
+	p, err = New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	var failed bool
+	for i := 0; i < 4; i++ {
+		if _, err := p.NewStream(ctx, desc, "/pb.Echo/Say"); err != nil {
+			failed = true
+		}
+	}
+	require.EqualValues(t, true, failed)
+
+	// the healthy connections aren't evicted for the Unavailable of the calls
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		req.DialOptions = append(req.DialOptions, grpc.WithChainStreamInterceptor(
+			func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, grpc.Streamer,
+				...grpc.CallOption) (grpc.ClientStream, error) {
+				return nil, status.Error(codes.Unavailable, "rejected")
+			}))
+		return dialDefault(req)
+	}
+	p, err = New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	_, err = p.NewStream(ctx, desc, "/pb.Echo/Say")
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	for _, pc := range p.(*pool).liveConns() {
+		require.Equal(t, ConnReady, pc.state())
+	}
+}
+
+// countingCodec is the proto codec counting the messages marshaled.
+type countingCodec struct {
+	marshaled int32
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&c.marshaled, 1)
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (c *countingCodec) Name() string {
+	return "proto"
+}
+
+func TestDefaultDialerOptions(t *testing.T) {
+	codec := &countingCodec{}
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxRecvMsgSize = 16
+	opt.Codec = codec
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := &pb.EchoResponse{}
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+	require.EqualValues(t, 1, atomic.LoadInt32(&codec.marshaled))
+
+	err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: make([]byte, 64)}, res)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestCallTimeout(t *testing.T) {
+	deadlines := make(chan bool, 2)
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		_, ok := ctx.Deadline()
+		deadlines <- ok
+		return handler(ctx, req)
+	})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.CallTimeout = time.Minute
+	p, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	require.NoError(t, p.Invoke(context.Background(), "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.True(t, <-deadlines)
+
+	opt.CallTimeout = 0
+	p2, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p2.Close()
+	require.NoError(t, p2.Invoke(context.Background(), "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.False(t, <-deadlines)
+}
+
+func TestConnClientConnInterface(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	var cc grpc.ClientConnInterface = c
+	res := &pb.EchoResponse{}
+	require.NoError(t, cc.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+	require.EqualValues(t, "hi", string(res.Message))
+
+	cs, err := cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "Say"}, "/pb.Echo/Say")
+	require.NoError(t, err)
+	require.NoError(t, cs.SendMsg(&pb.EchoRequest{Message: []byte("hi")}))
+	require.NoError(t, cs.CloseSend())
+	require.NoError(t, cs.RecvMsg(res))
+
+	p.Close()
+	require.ErrorIs(t, cc.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, res), ErrConnReset)
+	_, err = cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "Say"}, "/pb.Echo/Say")
+	require.ErrorIs(t, err, ErrConnReset)
+}
+
+func TestConnInvokeOn(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 2
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := p.Get()
+	require.NoError(t, err)
+	defer c.Close()
+	say := func() error {
+		return c.InvokeOn(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+	}
+	stream := func() grpc.ClientStream {
+		cs, err := c.NewStreamOn(ctx, &grpc.StreamDesc{StreamName: "Say"}, "/pb.Echo/Say")
+		require.NoError(t, err)
+		require.NoError(t, cs.SendMsg(&pb.EchoRequest{Message: []byte("hi")}))
+		require.NoError(t, cs.CloseSend())
+		return cs
+	}
+	require.NoError(t, say())
+
+	// the conn covers the first stream, the second takes one of the connection
+	s1 := stream()
+	s2 := stream()
+	require.EqualValues(t, 2, p.Stats().Ref)
+	require.Equal(t, ErrStreamLimit, say())
+
+	require.NoError(t, s2.RecvMsg(&pb.EchoResponse{}))
+	require.Eventually(t, func() bool { return p.Stats().Ref == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, say())
+	require.EqualValues(t, 1, p.Stats().Ref)
+	require.NoError(t, s1.RecvMsg(&pb.EchoResponse{}))
+	require.NoError(t, say())
+}
+
+func TestDenyRawConn(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.DenyRawConn = true
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := p.Get()
+	require.NoError(t, err)
+	defer c.Close()
+	require.Nil(t, c.Value())
+	_, err = c.ClientConn()
+	require.Equal(t, ErrRawConnDenied, err)
+
+	// the conn and the pool work as grpc.ClientConnInterface
+	req := &pb.EchoRequest{Message: []byte("hi")}
+	require.NoError(t, c.InvokeOn(ctx, "/pb.Echo/Say", req, &pb.EchoResponse{}))
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", req, &pb.EchoResponse{}))
+	cs, err := p.NewStream(ctx, &grpc.StreamDesc{StreamName: "Say"}, "/pb.Echo/Say")
+	require.NoError(t, err)
+	require.NoError(t, cs.SendMsg(req))
+	require.NoError(t, cs.CloseSend())
+	require.NoError(t, cs.RecvMsg(&pb.EchoResponse{}))
+	res, err := Hedge(ctx, p, time.Second, func(ctx context.Context, cc grpc.ClientConnInterface) (*pb.EchoResponse, error) {
+		res := &pb.EchoResponse{}
+		return res, cc.Invoke(ctx, "/pb.Echo/Say", req, res)
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, "hi", string(res.Message))
+}
+
+func TestTrackUsage(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.TrackUsage = true
+	opt.Registry = NewRegistry()
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: make([]byte, 1024)}, &pb.EchoResponse{})
+		require.NoError(t, err)
+	}
+
+	stats := p.Stats()
+	require.Greater(t, stats.BytesSent, int64(2*1024))
+	require.Greater(t, stats.BytesReceived, int64(2*1024))
+	require.Len(t, stats.Connections, 2)
+	var sent int64
+	for _, u := range stats.Connections {
+		sent += u.BytesSent
+	}
+	require.Equal(t, stats.BytesSent, sent)
+
+	var metrics strings.Builder
+	require.NoError(t, opt.Registry.WriteMetrics(&metrics))
+	require.Contains(t, metrics.String(), fmt.Sprintf("pool_sent_bytes_total{target=%q,identity=\"\",replica=\"0\"} %v",
+		stats.Address, stats.BytesSent))
+}
+
+func TestEndpointTransportCredentials(t *testing.T) {
+	plain, secure := startEchoServer(t), startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.TransportCredentials = insecure.NewCredentials()
+	// the echo servers are plaintext, the handshake to secure fails
+	opt.EndpointTransportCredentials = map[string]credentials.TransportCredentials{
+		secure: credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}),
+	}
+	mp, err := NewMulti([]string{plain, secure}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := mp.GetEndpoint(ctx, plain)
+	require.NoError(t, err)
+	require.NoError(t, c.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.NoError(t, c.Close())
+
+	// the handshake of the probe fails
+	_, err = mp.GetEndpoint(ctx, secure)
+	var endpointErr EndpointError
+	require.ErrorAs(t, err, &endpointErr)
+	require.Equal(t, secure, endpointErr.Address)
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import "time"
+
+// Clock is the time source of the pool, the timeouts, intervals, latencies and
+// error decay of the pool are measured by it. it's replaced to simulate a pool
+// deterministically, see the pooltest package.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f once d passes, in its own goroutine, or in the goroutine
+	// moving a simulated clock forward, so f mustn't wait for that goroutine.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the timer of AfterFunc of Clock.
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker is the ticker of NewTicker of Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock of package time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// clocked is implemented by the pools of this package.
+type clocked interface {
+	poolClock() Clock
+}
+
+// clockOf returns the Clock of p, the real one if p isn't of this package.
+func clockOf(p Pool) Clock {
+	if c, ok := p.(clocked); ok {
+		return c.poolClock()
+	}
+	return realClock{}
+}
+
+func (p *pool) poolClock() Clock {
+	return p.clock
+}
+
+func (mp *multiPool) poolClock() Clock {
+	return mp.clock
+}
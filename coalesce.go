@@ -0,0 +1,186 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// coalescer collapses the identical unary calls in flight into one, see
+// Options.CoalesceMethod.
+type coalescer struct {
+	method func(method string) bool
+
+	// spawn runs the shared calls in their own goroutines, see pool.spawn.
+	spawn func(f func())
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in flight shared by the identical calls.
+type flight struct {
+	done  chan struct{}
+	reply proto.Message
+	err   error
+}
+
+func newCoalescer(method func(method string) bool, spawn func(f func())) *coalescer {
+	if method == nil {
+		return nil
+	}
+	return &coalescer{method: method, spawn: spawn, flights: make(map[string]*flight)}
+}
+
+// coalesced is implemented by the pools of this package.
+type coalesced interface {
+	coalescer() *coalescer
+}
+
+// coalescerOf returns the coalescer of p, nil if CoalesceMethod isn't set.
+func coalescerOf(p Pool) *coalescer {
+	if c, ok := p.(coalesced); ok {
+		return c.coalescer()
+	}
+	return nil
+}
+
+func (p *pool) coalescer() *coalescer {
+	return p.coalesce
+}
+
+func (mp *multiPool) coalescer() *coalescer {
+	return mp.coalesce
+}
+
+// message returns m as a proto message, false if it isn't one.
+func message(m interface{}) (proto.Message, bool) {
+	switch m := m.(type) {
+	case proto.Message:
+		return m, true
+	case protoadapt.MessageV1:
+		return protoadapt.MessageV2Of(m), true
+	}
+	return nil, false
+}
+
+// coalesceKey returns the key of a call, the calls of the same method, call
+// options, see sharedCallOptions, request and outgoing metadata are identical.
+// it's false if args isn't a proto message.
+func coalesceKey(ctx context.Context, method, options string, args interface{}) (string, bool) {
+	m, ok := message(args)
+	if !ok {
+		return "", false
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(options))
+	h.Write([]byte{0})
+	h.Write(b)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range md[k] {
+			h.Write([]byte{0})
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write([]byte(v))
+		}
+	}
+	return string(h.Sum(nil)), true
+}
+
+// do makes the call identified by key by call, or waits for the identical call
+// in flight, and copies its response into reply. the call is made with the ctx
+// of the first caller, detached from its cancellation but with its deadline.
+func (c *coalescer) do(ctx context.Context, key string, reply proto.Message,
+	call func(ctx context.Context, reply proto.Message) error) error {
+	c.mu.Lock()
+	f, ok := c.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{}), reply: reply.ProtoReflect().New().Interface()}
+		c.flights[key] = f
+		callCtx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			callCtx, cancel = context.WithDeadline(callCtx, deadline)
+		}
+		c.spawn(func() {
+			defer cancel()
+			f.err = call(callCtx, f.reply)
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+			close(f.done)
+		})
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return f.err
+		}
+		proto.Reset(reply)
+		proto.Merge(reply, f.reply)
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// sharedCallOptions drops the call options writing to the caller's variables,
+// e.g. grpc.Header, from opts of a call shared by the identical calls. the others
+// are returned with their key, the calls setting different ones aren't identical.
+// it's false if the call can't be shared: opts carry the caller's own credentials,
+// grpc.PerRPCCredentials, its own callback, grpc.OnFinish, or options it doesn't
+// know, they may tell the calls apart.
+func sharedCallOptions(opts []grpc.CallOption) ([]grpc.CallOption, string, bool) {
+	shared := make([]grpc.CallOption, 0, len(opts))
+	var key strings.Builder
+	for _, opt := range opts {
+		switch opt.(type) {
+		case grpc.HeaderCallOption, grpc.TrailerCallOption, grpc.PeerCallOption:
+			continue
+		case grpc.FailFastCallOption, grpc.CompressorCallOption, grpc.ContentSubtypeCallOption,
+			grpc.MaxRecvMsgSizeCallOption, grpc.MaxSendMsgSizeCallOption, grpc.MaxRetryRPCBufferSizeCallOption,
+			grpc.StaticMethodCallOption:
+			fmt.Fprintf(&key, "%T%v;", opt, opt)
+		default:
+			return nil, "", false
+		}
+		shared = append(shared, opt)
+	}
+	return shared, key.String(), true
+}
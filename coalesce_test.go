@@ -0,0 +1,130 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoalesce(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return handler(ctx, req)
+	})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.CoalesceMethod = func(method string) bool { return method == "/pb.Echo/Say" }
+	p, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	say := func(ctx context.Context, message string, opts ...grpc.CallOption) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &pb.EchoResponse{}
+			require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte(message)}, res, opts...))
+			require.Equal(t, message, string(res.Message))
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		say(ctx, "hi")
+	}
+	// the other requests or metadata aren't identical
+	say(ctx, "hello")
+	say(metadata.AppendToOutgoingContext(ctx, "tenant", "a"), "hi")
+	// nor the other call options, the callbacks of grpc.OnFinish fire
+	say(ctx, "hi", grpc.MaxCallRecvMsgSize(1<<20))
+	var finished int32
+	say(ctx, "hi", grpc.OnFinish(func(error) { atomic.AddInt32(&finished, 1) }))
+
+	// the callers leaving don't cancel the shared call
+	left, leave := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Invoke(left, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	leave()
+	require.Equal(t, codes.Canceled, status.Code(<-errs))
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 5 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.EqualValues(t, 5, atomic.LoadInt32(&calls))
+	require.EqualValues(t, 1, atomic.LoadInt32(&finished))
+	require.Empty(t, p.(*pool).coalesce.flights)
+}
+
+func TestCoalesceCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	release := make(chan struct{})
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mu.Lock()
+		tokens = append(tokens, md.Get("authorization")...)
+		mu.Unlock()
+		<-release
+		return handler(ctx, req)
+	})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.CoalesceMethod = func(method string) bool { return true }
+	p, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the calls of different callers' credentials aren't shared
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, token := range []string{"alice", "bob"} {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			err := p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{},
+				grpc.PerRPCCredentials(tokenCredentials(token)))
+			require.NoError(t, err)
+		}(token)
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(tokens) == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.ElementsMatch(t, []string{"Bearer alice", "Bearer bob"}, tokens)
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// validCompressors reports whether all of the compressors are registered.
+func (o Options) validCompressors() bool {
+	lists := [][]string{o.Compressors}
+	for _, names := range o.EndpointCompressors {
+		lists = append(lists, names)
+	}
+	for _, names := range lists {
+		for _, name := range names {
+			if encoding.GetCompressor(name) == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compressors returns the compressors of the pool's canonical address.
+func (p *pool) compressors() []string {
+	if names, ok := p.opt.EndpointCompressors[p.key.Target]; ok {
+		return names
+	}
+	return p.opt.Compressors
+}
+
+// compressorOption returns the call option of the compressor negotiated by pc,
+// and its index. the option is nil when it has fallen back to none.
+func (pc *physicalConn) compressorOption() (grpc.CallOption, int32) {
+	names := pc.pool.compressors()
+	i := atomic.LoadInt32(&pc.compressor)
+	if int(i) >= len(names) {
+		return nil, i
+	}
+	return grpc.UseCompressor(names[i]), i
+}
+
+// fallback moves pc to the compressor after i, unless another RPC has done it.
+func (pc *physicalConn) fallback(i int32, err error) {
+	if atomic.CompareAndSwapInt32(&pc.compressor, i, i+1) {
+		log.Printf("compressor %s is unsupported, address: %s, err: %v\n",
+			pc.pool.compressors()[i], pc.pool.address, err)
+	}
+}
+
+// unsupportedCompressor reports whether the backend rejects the RPC because it
+// doesn't support the compressor.
+func unsupportedCompressor(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.Unimplemented && strings.Contains(s.Message(), "grpc-encoding")
+}
+
+// compressionInterceptor sends the unary RPCs with the compressor negotiated,
+// the RPC rejected for the compressor is retried with the next one. the caller's
+// compressor takes precedence.
+func (pc *physicalConn) compressionInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	for {
+		opt, i := pc.compressorOption()
+		if opt == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		err := invoker(ctx, method, req, reply, cc, append([]grpc.CallOption{opt}, opts...)...)
+		if !unsupportedCompressor(err) {
+			return err
+		}
+		pc.fallback(i, err)
+	}
+}
+
+// compressionStreamInterceptor is like compressionInterceptor for the streams,
+// they aren't retried, the compressor is negotiated by the unary RPCs.
+func (pc *physicalConn) compressionStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if opt, _ := pc.compressorOption(); opt != nil {
+		opts = append([]grpc.CallOption{opt}, opts...)
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
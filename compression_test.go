@@ -0,0 +1,96 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+)
+
+// rejectingDial dials connections whose backend rejects the compressor name
+// like a grpc server that doesn't support it.
+func rejectingDial(name string, rejected *int32) func(req DialRequest) (*grpc.ClientConn, error) {
+	return func(req DialRequest) (*grpc.ClientConn, error) {
+		reject := func(ctx context.Context, method string, req, reply interface{},
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			for _, opt := range opts {
+				if c, ok := opt.(grpc.CompressorCallOption); ok && c.CompressorType == name {
+					atomic.AddInt32(rejected, 1)
+					return status.Errorf(codes.Unimplemented,
+						"grpc: Decompressor is not installed for grpc-encoding %q", name)
+				}
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		req.DialOptions = append(req.DialOptions, grpc.WithChainUnaryInterceptor(reject))
+		return dialDefault(req)
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	var rejected int32
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.Compressors = []string{"gzip"}
+	opt.DialFunc = rejectingDial("gzip", &rejected)
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		res := &pb.EchoResponse{}
+		require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+		require.Equal(t, "hi", string(res.Message))
+	}
+	// only the first RPC is rejected, the connection falls back to none
+	require.EqualValues(t, 1, atomic.LoadInt32(&rejected))
+	require.EqualValues(t, 1, atomic.LoadInt32(&p.(*pool).conns[0].compressor))
+}
+
+func TestEndpointCompressors(t *testing.T) {
+	var rejected int32
+	address := startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.Compressors = []string{"gzip"}
+	opt.EndpointCompressors = map[string][]string{address: nil}
+	opt.DialFunc = rejectingDial("gzip", &rejected)
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.EqualValues(t, 0, atomic.LoadInt32(&rejected))
+}
+
+func TestInvalidCompressor(t *testing.T) {
+	opt := DefaultOptions
+	opt.Compressors = []string{"unregistered"}
+	_, err := New(*endpoint, opt)
+	require.Error(t, err)
+}
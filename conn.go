@@ -15,54 +15,491 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
+// ErrConnReset is the error resulting if the underlying connection of a Conn
+// has been reset or evicted by the pool.
+var ErrConnReset = errors.New("connection is reset")
+
+// ErrRawConnDenied is the error of ClientConn if DenyRawConn is set.
+var ErrRawConnDenied = errors.New("raw connection is denied, use the conn as grpc.ClientConnInterface")
+
+// ErrStreamLimit is the error of InvokeOn and NewStreamOn if the connection is
+// at its stream limit.
+var ErrStreamLimit = errors.New("connection is at its stream limit")
+
 // Conn single grpc connection inerface
 type Conn interface {
-	// Value return the actual grpc connection type *grpc.ClientConn.
+	// Value return the actual grpc connection type *grpc.ClientConn, nil if
+	// DenyRawConn is set.
 	Value() *grpc.ClientConn
 
+	// ClientConn is like Value but returns ErrConnReset instead of nil if the
+	// underlying connection has been reset or evicted by the pool, and
+	// ErrRawConnDenied if DenyRawConn is set.
+	ClientConn() (*grpc.ClientConn, error)
+
+	// Info describes the underlying connection.
+	Info() ConnInfo
+
+	// TryAcquireStream takes one more of the MaxConcurrentStreams of the
+	// underlying connection, beyond the one the conn itself holds, for callers
+	// creating their own streams on it. it reports false if the connection is
+	// at the limit, or has been reset or evicted. every stream taken must be
+	// given back by ReleaseStream, Close gives back the ones left.
+	TryAcquireStream() bool
+
+	// ReleaseStream gives back a stream taken by TryAcquireStream.
+	ReleaseStream()
+
+	// MarkBroken tells the pool the connection failed the caller with err, e.g. a
+	// transport error, it's handled by BrokenPolicy once the conn is closed.
+	MarkBroken(err error)
+
+	// InvokeOn is like Invoke but counted in the streams of the connection: the
+	// conn itself covers one call in flight, the calls beyond it take a stream by
+	// TryAcquireStream for their duration, or fail with ErrStreamLimit.
+	InvokeOn(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error
+
+	// NewStreamOn is like NewStream but counted like InvokeOn, until the stream
+	// finishes.
+	NewStreamOn(ctx context.Context, desc *grpc.StreamDesc, method string,
+		opts ...grpc.CallOption) (grpc.ClientStream, error)
+
 	// Close decrease the reference of grpc connection, instead of close it.
 	// if the pool is full, just close it.
 	Close() error
+
+	// ClientConnInterface lets the conn be passed straight into generated clients
+	// without exposing the grpc.ClientConn, the RPCs are made on the underlying
+	// connection and fail with ErrConnReset once it's reset or evicted.
+	grpc.ClientConnInterface
+}
+
+// ConnInfo describes the underlying connection of a Conn.
+type ConnInfo struct {
+	// Generation is increased by the pool for every connection it dials, so the
+	// callers caching client stubs or streams per connection can tell when the
+	// underlying connection has changed and rebuild them.
+	Generation uint64
+
+	// Slot is the index of the pool's slot, -1 for a one-time connection.
+	Slot int
+}
+
+// physicalConn is the grpc.ClientConn held by the pool, it's shared by all of
+// the conns checked out of it.
+type physicalConn struct {
+	cc   atomic.Pointer[grpc.ClientConn]
+	pool *pool
+
+	// the index of pool's slot, -1 for a one-time connection.
+	slot int
+
+	// the generation of the connection, see ConnInfo.
+	generation uint64
+
+	// atomic, the number of conns checked out of it.
+	ref int32
+
+	// atomic, the ConnState of the connection, see to.
+	lifecycle int32
+
+	// atomic, the index of the compressor negotiated, see Options.Compressors.
+	compressor int32
+
+	// atomic, the number of times the slot has been dialed up to it, see
+	// DialRequest.Attempt.
+	attempts int32
+
+	// atomic, the times it became ready, and the readies its last disconnect
+	// cause is counted at, see disconnected.
+	readies int32
+	counted int32
+
+	// nil unless the pool tracks its connections, see pool.tracking.
+	track *connTracking
+}
+
+const (
+	// connBudget is the memory budget of a physicalConn, the grpc.ClientConn
+	// excluded.
+	connBudget = 64
+
+	// trackingBudget is the memory budget of a connTracking.
+	trackingBudget = 1024
+)
+
+// connTracking is the per-connection tracking state, it's fixed-size so that a
+// connection never costs more than trackingBudget however long it lives.
+type connTracking struct {
+	// the unix nano time it's dialed, and the consecutive flaps of its slot,
+	// tracked when FlapThreshold is set.
+	dialedAt int64
+	flaps    int32
+
+	// atomic, the unix nano time it's last borrowed or given back, tracked when
+	// TestOnBorrow is set.
+	usedAt int64
+
+	// atomic, the unix nano time it last had an RPC answered by the server,
+	// tracked when HealthCheckInterval is set.
+	servedAt int64
+
+	// atomic, the unix nano time its next stream is due at, tracked when
+	// MaxStreamRate is set.
+	paced int64
+
+	// the error of the last RPC finished on it, tracked when TestOnReturn is set.
+	lastErr atomic.Pointer[error]
+
+	// recent unary RPC latencies, tracked when SLALatency is set.
+	latency latencyWindow
+
+	// decayed count of connection errors, tracked when QuarantineErrors is set.
+	errors decayCounter
+
+	// counted when UsageReport is set.
+	usage usage
+}
+
+// retire resets the connection once all of the conns checked out of it are
+// given back, or EvictLinger passes. it must be called after pc is removed from
+// the slots.
+func (pc *physicalConn) retire() {
+	var linger time.Duration
+	if !pc.pool.opt.WatchMode {
+		linger = pc.pool.opt.EvictLinger
+	}
+	pc.drain(linger)
+}
+
+// rotate retires pc replaced by npc. in WatchMode it waits for npc to be ready
+// first, so the watches re-established by OnDraining land on a live connection.
+func (p *pool) rotate(pc, npc *physicalConn) {
+	cc := npc.cc.Load()
+	if !p.opt.WatchMode || cc == nil {
+		pc.retire()
+		return
+	}
+	p.spawn("rotate", pc.slot, func() {
+		defer pc.retire()
+		cc.Connect()
+		for state := cc.GetState(); state != connectivity.Ready && state != connectivity.Shutdown; state = cc.GetState() {
+			if !cc.WaitForStateChange(p.ctx, state) {
+				return
+			}
+		}
+	})
+}
+
+// drain resets the connection once all of the conns checked out of it are
+// given back, or linger passes if it's positive. OnDraining is notified if any
+// of them is still checked out.
+func (pc *physicalConn) drain(linger time.Duration) {
+	if _, ok := pc.to(ConnDraining); !ok {
+		return
+	}
+	atomic.AddInt32(&pc.pool.draining, 1)
+	if atomic.LoadInt32(&pc.ref) == 0 {
+		pc.reset()
+		return
+	}
+	var deadline time.Time
+	if linger > 0 {
+		deadline = pc.pool.clock.Now().Add(linger)
+		pc.pool.clock.AfterFunc(linger, func() { pc.reset() })
+	}
+	// the last conn may have been given back before it's draining
+	if atomic.LoadInt32(&pc.ref) == 0 {
+		pc.reset()
+		return
+	}
+	pc.pool.notifyDraining(pc, deadline)
+}
+
+// notifyDraining calls OnDraining for pc in its own goroutine, if it's set.
+func (p *pool) notifyDraining(pc *physicalConn, deadline time.Time) {
+	if p.opt.OnDraining == nil {
+		return
+	}
+	info := pc.info()
+	p.spawn("on-draining", pc.slot, func() { p.opt.OnDraining(info, deadline) })
+}
+
+func (pc *physicalConn) reset() error {
+	if prev, ok := pc.to(ConnClosed); ok && prev == ConnDraining {
+		atomic.AddInt32(&pc.pool.draining, -1)
+	}
+	if cc := pc.cc.Swap(nil); cc != nil {
+		pc.pool.releaseSocket()
+		return cc.Close()
+	}
+	return nil
 }
 
 // Conn is wrapped grpc.ClientConn. to provide close and value method.
+// a conn is created for every checkout, so it can be closed only once.
 type conn struct {
-	cc   *grpc.ClientConn
+	pc   *physicalConn
 	pool *pool
 	once bool
+
+	// atomic, set to 1 when the conn has been given back to the pool.
+	returned int32
+
+	// atomic, the number of streams taken by TryAcquireStream.
+	streams int32
+
+	// atomic, the number of calls of InvokeOn and NewStreamOn in flight.
+	calls int32
+
+	// the error the conn is marked broken with, see MarkBroken.
+	broken atomic.Pointer[error]
+
+	// fires when the conn is checked out longer than MaxCheckoutDuration.
+	timer Timer
+
+	debug connDebug
 }
 
 // Value see Conn interface.
 func (c *conn) Value() *grpc.ClientConn {
-	return c.cc
+	c.debug.used(c, "Value")
+	if c.pool.opt.DenyRawConn {
+		return nil
+	}
+	return c.pc.cc.Load()
+}
+
+// ClientConn see Conn interface.
+func (c *conn) ClientConn() (*grpc.ClientConn, error) {
+	c.debug.used(c, "ClientConn")
+	if c.pool.opt.DenyRawConn {
+		return nil, ErrRawConnDenied
+	}
+	if cc := c.pc.cc.Load(); cc != nil {
+		return cc, nil
+	}
+	return nil, ErrConnReset
+}
+
+// Invoke see Conn interface.
+func (c *conn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	c.debug.used(c, "Invoke")
+	cc := c.pc.cc.Load()
+	if cc == nil {
+		return ErrConnReset
+	}
+	return cc.Invoke(ctx, method, args, reply, opts...)
+}
+
+// NewStream see Conn interface.
+func (c *conn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c.debug.used(c, "NewStream")
+	cc := c.pc.cc.Load()
+	if cc == nil {
+		return nil, ErrConnReset
+	}
+	return cc.NewStream(ctx, desc, method, opts...)
+}
+
+// InvokeOn see Conn interface.
+func (c *conn) InvokeOn(ctx context.Context, method string, args, reply interface{},
+	opts ...grpc.CallOption) error {
+	release, err := c.startCall()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.Invoke(ctx, method, args, reply, opts...)
+}
+
+// NewStreamOn see Conn interface.
+func (c *conn) NewStreamOn(ctx context.Context, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	release, err := c.startCall()
+	if err != nil {
+		return nil, err
+	}
+	cs, err := c.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	// the ctx of the stream is done once it finishes
+	go func() {
+		<-cs.Context().Done()
+		release()
+	}()
+	return cs, nil
+}
+
+// startCall counts a call of InvokeOn or NewStreamOn, it takes a stream unless
+// it's the only call in flight. release is called once the call finishes.
+func (c *conn) startCall() (release func(), err error) {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		return func() { atomic.AddInt32(&c.calls, -1) }, nil
+	}
+	if !c.TryAcquireStream() {
+		atomic.AddInt32(&c.calls, -1)
+		if c.pc.cc.Load() == nil {
+			return nil, ErrConnReset
+		}
+		return nil, ErrStreamLimit
+	}
+	return func() {
+		c.ReleaseStream()
+		atomic.AddInt32(&c.calls, -1)
+	}, nil
+}
+
+// Info see Conn interface.
+func (c *conn) Info() ConnInfo {
+	c.debug.used(c, "Info")
+	return c.pc.info()
+}
+
+// TryAcquireStream see Conn interface.
+func (c *conn) TryAcquireStream() bool {
+	c.debug.used(c, "TryAcquireStream")
+	pc := c.pc
+	for {
+		ref := atomic.LoadInt32(&pc.ref)
+		if ref >= c.pool.streamLimit() || pc.cc.Load() == nil {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&pc.ref, ref, ref+1) {
+			break
+		}
+	}
+	atomic.AddInt32(&c.streams, 1)
+	c.pool.incrRef()
+	// a retire or release racing with it either sees the stream, or is seen
+	if pc.retired() || atomic.LoadInt32(&c.returned) == 1 {
+		c.ReleaseStream()
+		return false
+	}
+	return true
+}
+
+// ReleaseStream see Conn interface.
+func (c *conn) ReleaseStream() {
+	for {
+		streams := atomic.LoadInt32(&c.streams)
+		if streams == 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&c.streams, streams, streams-1) {
+			break
+		}
+	}
+	c.unref()
+	c.pool.decrRef()
+}
+
+// releaseStreams gives back the streams left by TryAcquireStream.
+func (c *conn) releaseStreams() {
+	for atomic.LoadInt32(&c.streams) > 0 {
+		c.ReleaseStream()
+	}
+}
+
+func (pc *physicalConn) info() ConnInfo {
+	return ConnInfo{Generation: pc.generation, Slot: pc.slot}
 }
 
 // Close see Conn interface.
 func (c *conn) Close() error {
-	c.pool.decrRef()
+	c.debug.closed(c)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.once && c.pool.opt.ReuseOverflow {
+		return c.pool.closeOverflow(c)
+	}
+	var tested bool
+	if err := c.broken.Load(); err != nil && atomic.LoadInt32(&c.returned) == 0 {
+		tested = c.pool.returnBroken(c.pc, *err)
+	}
+	if c.pool.opt.TestOnReturn != nil && !tested && atomic.LoadInt32(&c.returned) == 0 {
+		c.pool.giveBack(c.pc)
+	}
+	c.release()
 	if c.once {
-		return c.reset()
+		return c.pc.reset()
 	}
 	return nil
 }
 
-func (c *conn) reset() error {
-	cc := c.cc
-	c.cc = nil
-	c.once = false
-	if cc != nil {
-		return cc.Close()
+// release gives the conn back to the pool's accounting along with the streams
+// it took, only the first call works.
+func (c *conn) release() {
+	if c.drop() {
+		c.pool.counters.closes.Add(1)
+		c.pool.decrRef()
+		c.pool.releaseBudget(budgetStreams)
 	}
-	return nil
+	c.releaseStreams()
+}
+
+// drop gives back the checkout of the physical connection only, the pool's
+// reference and Budget are kept. it reports whether it's the first call.
+func (c *conn) drop() bool {
+	if !atomic.CompareAndSwapInt32(&c.returned, 0, 1) {
+		return false
+	}
+	if c.pool.opt.TestOnBorrow != nil {
+		c.pool.used(c.pc)
+	}
+	c.unref()
+	return true
 }
 
-func (p *pool) wrapConn(cc *grpc.ClientConn, once bool) *conn {
-	return &conn{
-		cc:   cc,
+// unref gives back a reference of the physical connection, it's reset once
+// it's retired and the last reference is given back.
+func (c *conn) unref() {
+	ref := atomic.AddInt32(&c.pc.ref, -1)
+	debugRef(c.pc, ref)
+	if ref == 0 && c.pc.retired() {
+		c.pc.reset()
+	}
+}
+
+// expire is called when the conn is checked out longer than MaxCheckoutDuration.
+func (c *conn) expire() {
+	atomic.AddInt32(&c.pool.expired, 1)
+	log.Printf("conn checked out more than %v, address: %s, forceReturn: %v\n",
+		c.pool.opt.MaxCheckoutDuration, c.pool.address, c.pool.opt.ForceReturn)
+	if c.pool.opt.ForceReturn {
+		c.release()
+	}
+}
+
+func (p *pool) checkout(pc *physicalConn, once bool) *conn {
+	atomic.AddInt32(&pc.ref, 1)
+	return p.checkoutClaimed(pc, once)
+}
+
+// checkoutClaimed is checkout of pc whose reference has been taken, see claim.
+func (p *pool) checkoutClaimed(pc *physicalConn, once bool) *conn {
+	pc.rewarm()
+	c := &conn{
+		pc:   pc,
 		pool: p,
 		once: once,
 	}
+	if p.opt.MaxCheckoutDuration > 0 {
+		c.timer = p.clock.AfterFunc(p.opt.MaxCheckoutDuration, c.expire)
+	}
+	return c
 }
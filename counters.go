@@ -0,0 +1,95 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counters are the cumulative counters of a pool since it's created, they're
+// always counted, so the basic observability is kept even without a metrics
+// integration, see Pool.Counters.
+type Counters struct {
+	// Gets is the number of checkouts, GetErrors of them failed. GetWait is the
+	// total time they take, GetWait / Gets is the mean latency of Get.
+	Gets      int64
+	GetErrors int64
+	GetWait   time.Duration
+
+	// Dials is the number of connections dialed, DialErrors of them failed.
+	Dials      int64
+	DialErrors int64
+
+	// Evictions is the number of connections replaced by newly dialed ones, the
+	// connections closed as the pool shrinks or as EvictLinger passes aren't
+	// counted.
+	Evictions int64
+
+	// Closes is the number of conns closed, i.e. given back to the pool, the
+	// repeated Close of a conn and the conns given back by ForceReturn count once.
+	Closes int64
+}
+
+// counters are the atomic counterparts of Counters.
+type counters struct {
+	gets       atomic.Int64
+	getErrors  atomic.Int64
+	getWait    atomic.Int64
+	dials      atomic.Int64
+	dialErrors atomic.Int64
+	evictions  atomic.Int64
+	closes     atomic.Int64
+}
+
+// counted counts a Get started at start, failed if err isn't nil.
+func (c *counters) counted(start, now time.Time, err error) {
+	c.gets.Add(1)
+	c.getWait.Add(int64(now.Sub(start)))
+	if err != nil {
+		c.getErrors.Add(1)
+	}
+}
+
+// Counters see Pool interface.
+func (p *pool) Counters() Counters {
+	c := &p.counters
+	return Counters{
+		Gets:       c.gets.Load(),
+		GetErrors:  c.getErrors.Load(),
+		GetWait:    time.Duration(c.getWait.Load()),
+		Dials:      c.dials.Load(),
+		DialErrors: c.dialErrors.Load(),
+		Evictions:  c.evictions.Load(),
+		Closes:     c.closes.Load(),
+	}
+}
+
+// Counters see Pool interface. the counters of the current endpoints are summed.
+func (mp *multiPool) Counters() Counters {
+	var sum Counters
+	endpoints, _ := mp.snapshot()
+	for _, e := range endpoints {
+		c := e.pool.Counters()
+		sum.Gets += c.Gets
+		sum.GetErrors += c.GetErrors
+		sum.GetWait += c.GetWait
+		sum.Dials += c.Dials
+		sum.DialErrors += c.DialErrors
+		sum.Evictions += c.Evictions
+		sum.Closes += c.Closes
+	}
+	return sum
+}
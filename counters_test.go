@@ -0,0 +1,68 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestCounters(t *testing.T) {
+	var failing int32
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.Faults = NewFaults()
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("dial failed")
+		}
+		return dialDefault(req)
+	}
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, Counters{Dials: 1}, p.Counters())
+
+	for i := 0; i < 2; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+	}
+	opt.Faults.FailGets(ErrExhausted, time.Minute)
+	_, err = p.Get()
+	require.ErrorIs(t, err, ErrExhausted)
+	opt.Faults.Reset()
+
+	// the evicted connection is replaced, once the dial succeeds
+	pc := p.(*pool).conns[0]
+	atomic.StoreInt32(&failing, 1)
+	require.False(t, p.(*pool).replace(pc))
+	atomic.StoreInt32(&failing, 0)
+	p.(*pool).evict(pc, "test")
+	require.Eventually(t, func() bool { return p.Counters().Evictions == 1 }, time.Second, time.Millisecond)
+
+	c := p.Counters()
+	require.EqualValues(t, 3, c.Gets)
+	require.EqualValues(t, 1, c.GetErrors)
+	require.Greater(t, c.GetWait, time.Duration(0))
+	require.EqualValues(t, 3, c.Dials)
+	require.EqualValues(t, 1, c.DialErrors)
+	require.EqualValues(t, 2, c.Closes)
+}
@@ -0,0 +1,34 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !pooldebug
+
+package pool
+
+// debugBuild reports whether the pool is built with the pooldebug tag.
+const debugBuild = false
+
+// connDebug is the misuse detector of a conn, it's empty and its checks are
+// no-ops unless built with the pooldebug tag.
+type connDebug struct{}
+
+func (d *connDebug) used(*conn, string) {}
+
+func (d *connDebug) closed(*conn) {}
+
+func debugRef(*physicalConn, int32) {}
+
+func debugSlot(*pool, int, *physicalConn) {}
+
+func debugTransition(*physicalConn, ConnState, ConnState) {}
@@ -0,0 +1,76 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pooldebug
+
+package pool
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// debugBuild reports whether the pool is built with the pooldebug tag.
+const debugBuild = true
+
+// connDebug is the misuse detector of a conn built with the pooldebug tag, it
+// panics on a conn used or closed after it's closed, telling where it's closed.
+type connDebug struct {
+	mu       sync.Mutex
+	closedAt []byte
+}
+
+// used panics if c is closed.
+func (d *connDebug) used(c *conn, op string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closedAt != nil {
+		panic(fmt.Sprintf("pooldebug: %s on closed conn, %s, closed at:\n%s", op, describe(c.pc), d.closedAt))
+	}
+}
+
+// closed panics if c is closed already, or records where it's closed.
+func (d *connDebug) closed(c *conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closedAt != nil {
+		panic(fmt.Sprintf("pooldebug: conn closed twice, %s, first closed at:\n%s", describe(c.pc), d.closedAt))
+	}
+	d.closedAt = debug.Stack()
+}
+
+// debugRef panics if the ref of pc is negative.
+func debugRef(pc *physicalConn, ref int32) {
+	if ref < 0 {
+		panic(fmt.Sprintf("pooldebug: negative ref %d, %s", ref, describe(pc)))
+	}
+}
+
+// debugSlot panics if pc isn't the connection of slot i of p.
+func debugSlot(p *pool, i int, pc *physicalConn) {
+	if pc != nil && (pc.pool != p || pc.slot != i) {
+		panic(fmt.Sprintf("pooldebug: slot %d of %s holds %s", i, p.address, describe(pc)))
+	}
+}
+
+func debugTransition(pc *physicalConn, prev, next ConnState) {
+	panic(fmt.Sprintf("pooldebug: conn moved from %v to %v, %s", prev, next, describe(pc)))
+}
+
+func describe(pc *physicalConn) string {
+	return fmt.Sprintf("address: %s, slot: %d, generation: %d, ref: %d, state: %v",
+		pc.pool.address, pc.slot, pc.generation, atomic.LoadInt32(&pc.ref), pc.state())
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pooldebug
+
+package pool
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugMisuse(t *testing.T) {
+	p, nativePool, _, err := newPool(nil)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.Panics(t, func() { c.Value() })
+	require.Panics(t, func() { c.ClientConn() })
+	require.Panics(t, func() { c.Close() })
+
+	require.Panics(t, func() { debugRef(nativePool.conns[0], -1) })
+	require.Panics(t, func() { debugSlot(nativePool, 1, nativePool.conns[0]) })
+	require.NotPanics(t, func() { debugSlot(nativePool, 0, nativePool.conns[0]) })
+
+	// describe reads the ref of a conn checked out meanwhile
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c, err := p.Get()
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+		}
+	}()
+	live := nativePool.liveConns()
+	for i := 0; i < 100; i++ {
+		require.Contains(t, describe(live[i%len(live)]), "ref: ")
+		runtime.Gosched()
+	}
+	<-done
+
+	// a dialing conn is never retired
+	require.Panics(t, func() { (&physicalConn{pool: nativePool}).to(ConnDraining) })
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// Healthy see Pool interface.
+func (p *pool) Healthy() bool {
+	return atomic.LoadInt32(&p.degraded) == 0
+}
+
+// countGet counts the consecutive failed Gets, the pool is degraded once they
+// reach MaxGetFailures, and recovers on the first Get succeeding, so does the
+// pool failing the SmokeTest.
+func (p *pool) countGet(err error) {
+	if err == nil {
+		if atomic.LoadInt32(&p.getFailures) != 0 {
+			atomic.StoreInt32(&p.getFailures, 0)
+		}
+		if atomic.CompareAndSwapInt32(&p.degraded, 1, 0) {
+			log.Printf("pool recovered, address: %s\n", p.address)
+		}
+		return
+	}
+	if errors.Is(err, ErrClosed) || errors.Is(err, ErrClosing) || errors.Is(err, context.Canceled) {
+		return
+	}
+	if p.opt.MaxGetFailures <= 0 || atomic.AddInt32(&p.getFailures, 1) < int32(p.opt.MaxGetFailures) ||
+		!atomic.CompareAndSwapInt32(&p.degraded, 0, 1) {
+		return
+	}
+	log.Printf("pool degraded, address: %s, failures: %d, err: %v\n", p.address, p.opt.MaxGetFailures, err)
+	if p.opt.OnDegraded != nil {
+		stats := p.collect()
+		p.spawn("on-degraded", -2, func() { p.opt.OnDegraded(err, stats) })
+	}
+}
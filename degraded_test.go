@@ -0,0 +1,74 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDegraded(t *testing.T) {
+	type alarm struct {
+		err   error
+		stats Stats
+	}
+	alarms := make(chan alarm, 4)
+	faults := NewFaults()
+	opt := DefaultOptions
+	opt.Faults = faults
+	opt.MaxGetFailures = 3
+	opt.OnDegraded = func(err error, stats Stats) {
+		alarms <- alarm{err, stats}
+	}
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.True(t, p.Healthy())
+
+	injected := errors.New("injected")
+	faults.FailGets(injected, time.Hour)
+	for i := 0; i < 2; i++ {
+		_, err = p.Get()
+		require.Equal(t, injected, err)
+	}
+	require.True(t, p.Healthy())
+
+	// the canceled Gets aren't counted
+	faults.FailGets(context.Canceled, time.Hour)
+	_, err = p.Get()
+	require.Error(t, err)
+	require.True(t, p.Healthy())
+
+	faults.FailGets(injected, time.Hour)
+	_, err = p.Get()
+	require.Error(t, err)
+	require.False(t, p.Healthy())
+	require.True(t, p.Stats().Degraded)
+	a := <-alarms
+	require.Equal(t, injected, a.err)
+	require.True(t, a.stats.Degraded)
+
+	// the first Get succeeding recovers the pool
+	faults.Reset()
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.True(t, p.Healthy())
+	require.Len(t, alarms, 0)
+}
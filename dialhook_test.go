@@ -0,0 +1,97 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// tokenCredentials sends a bearer token, like the short-lived ones issued by
+// an identity provider.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func TestBeforeDial(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mu.Lock()
+		tokens = append(tokens, md.Get("authorization")...)
+		mu.Unlock()
+		return handler(ctx, req)
+	})
+
+	var issued int32
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.BeforeDial = func(ctx context.Context, req DialRequest) ([]grpc.DialOption, error) {
+		token := fmt.Sprintf("token-%d", atomic.AddInt32(&issued, 1))
+		return []grpc.DialOption{grpc.WithPerRPCCredentials(tokenCredentials(token))}, nil
+	}
+	p, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	invoke := func() {
+		res := &pb.EchoResponse{}
+		require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+	}
+	invoke()
+
+	// the replacement is dialed with a fresh token
+	pc := p.(*pool).conns[0]
+	p.(*pool).evict(pc, "credentials expired")
+	require.Eventually(t, func() bool { return p.Counters().Evictions == 1 },
+		5*time.Second, 10*time.Millisecond)
+	invoke()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, tokens)
+}
+
+func TestBeforeDialError(t *testing.T) {
+	errExpired := errors.New("refresh token expired")
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.BeforeDial = func(ctx context.Context, req DialRequest) ([]grpc.DialOption, error) {
+		return nil, errExpired
+	}
+	_, err := New(startEchoServer(t), opt)
+	require.ErrorIs(t, err, errExpired)
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SlotDialState is the result of the initial dial of a slot.
+type SlotDialState int
+
+const (
+	// SlotDialed is dialed successfully.
+	SlotDialed SlotDialState = iota
+
+	// SlotFailed failed to dial, New fails.
+	SlotFailed
+
+	// SlotSkipped isn't dialed because a slot before it failed.
+	SlotSkipped
+
+	// SlotLazy is beyond MaxIdle, it's dialed once it's needed.
+	SlotLazy
+)
+
+func (s SlotDialState) String() string {
+	switch s {
+	case SlotDialed:
+		return "dialed"
+	case SlotFailed:
+		return "failed"
+	case SlotSkipped:
+		return "skipped"
+	case SlotLazy:
+		return "lazy"
+	}
+	return fmt.Sprintf("SlotDialState(%d)", int(s))
+}
+
+// SlotDialResult is the result of the initial dial of a slot of the pool.
+type SlotDialResult struct {
+	// Address is the address of the pool.
+	Address string
+
+	Slot  int
+	State SlotDialState
+
+	// Err is the error of the dial if it failed.
+	Err error
+
+	// Duration is how long the dial took.
+	Duration time.Duration
+
+	// SmokeTested tells the connection of the slot is smoke tested, see
+	// Options.SmokeTest, SmokeErr is the error of the smoke test if it failed.
+	SmokeTested bool
+	SmokeErr    error
+}
+
+// InitialDialError is the error resulting if New fails to dial the MaxIdle
+// connections, Report tells the results of all the slots.
+type InitialDialError struct {
+	Report []SlotDialResult
+	Err    error
+}
+
+func (e *InitialDialError) Error() string {
+	return fmt.Sprintf("dial is not able to fill the pool: %s", e.Err)
+}
+
+func (e *InitialDialError) Unwrap() error {
+	return e.Err
+}
+
+// InitialDialReport see Pool interface.
+func (p *pool) InitialDialReport() []SlotDialResult {
+	return append([]SlotDialResult(nil), p.report...)
+}
+
+// dialInitial dials the MaxIdle connections, the results of the slots are kept
+// in the report.
+func (p *pool) dialInitial() error {
+	p.report = make([]SlotDialResult, p.opt.MaxActive)
+	var failed error
+	for i := range p.report {
+		r := &p.report[i]
+		r.Address, r.Slot, r.State = p.address, i, SlotLazy
+		if i >= p.opt.MaxIdle {
+			continue
+		}
+		if failed != nil {
+			r.State = SlotSkipped
+			continue
+		}
+		start := p.clock.Now()
+		// the slots are dialed under the lock, e.g. a connection dropped at once
+		// is re-dialed once it's written into its slot
+		err := p.delayDial()
+		if err == nil {
+			p.Lock()
+			var pc *physicalConn
+			if pc, err = p.dial(p.ctx, i, false); err == nil {
+				p.conns[i] = pc
+			}
+			p.Unlock()
+		}
+		r.Duration = p.clock.Now().Sub(start)
+		if err != nil {
+			r.State, r.Err, failed = SlotFailed, err, err
+			continue
+		}
+		r.State = SlotDialed
+	}
+	p.Lock()
+	p.publishConns()
+	p.Unlock()
+	if failed != nil {
+		return &InitialDialError{Report: p.InitialDialReport(), Err: failed}
+	}
+	return nil
+}
+
+// InitialDialReport see Pool interface. the reports of the endpoints failed
+// when the pool is created are included.
+func (mp *multiPool) InitialDialReport() []SlotDialResult {
+	endpoints, warnings := mp.snapshot()
+	var report []SlotDialResult
+	for _, e := range endpoints {
+		report = append(report, e.pool.InitialDialReport()...)
+	}
+	for _, w := range warnings {
+		var err *InitialDialError
+		if errors.As(w.Err, &err) {
+			report = append(report, err.Report...)
+		}
+	}
+	return report
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestInitialDialReport(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.MaxActive = 3
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	report := p.InitialDialReport()
+	require.Len(t, report, 3)
+	for i, state := range []SlotDialState{SlotDialed, SlotDialed, SlotLazy} {
+		require.Equal(t, i, report[i].Slot)
+		require.Equal(t, state, report[i].State)
+		require.Equal(t, *endpoint, report[i].Address)
+		require.NoError(t, report[i].Err)
+	}
+
+	// the report tells the slot failing New
+	unreachable := errors.New("unreachable")
+	opt.MaxIdle = 4
+	opt.MaxActive = 5
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		if req.SlotIndex == 1 {
+			return nil, unreachable
+		}
+		return DialTest(req.Target)
+	}
+	_, err = New(*endpoint, opt)
+	require.ErrorIs(t, err, unreachable)
+	var dialErr *InitialDialError
+	require.ErrorAs(t, err, &dialErr)
+	require.Len(t, dialErr.Report, 5)
+	for i, state := range []SlotDialState{SlotDialed, SlotFailed, SlotSkipped, SlotSkipped, SlotLazy} {
+		require.Equal(t, state, dialErr.Report[i].State, dialErr.Report[i].Slot)
+	}
+	require.Equal(t, unreachable, dialErr.Report[1].Err)
+}
+
+func TestMultiInitialDialReport(t *testing.T) {
+	a := startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.DialFunc = failingDial("127.0.0.1:50001")
+	mp, err := NewMulti([]string{a, "127.0.0.1:50001"}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	report := mp.InitialDialReport()
+	require.Len(t, report, 2)
+	require.Equal(t, a, report[0].Address)
+	require.Equal(t, SlotDialed, report[0].State)
+	require.Equal(t, "127.0.0.1:50001", report[1].Address)
+	require.Equal(t, SlotFailed, report[1].State)
+	require.Error(t, report[1].Err)
+}
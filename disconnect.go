@@ -0,0 +1,123 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// the causes of the disconnects told by the failed RPCs, see Stats.
+const (
+	causeUnknown int = iota
+	causeKeepalive
+	causeGoAway
+)
+
+// disconnectCause returns the cause of the disconnect err of an RPC tells,
+// causeUnknown if it doesn't tell any.
+func disconnectCause(err error) int {
+	if err == nil || status.Code(err) != codes.Unavailable {
+		return causeUnknown
+	}
+	msg := strings.ToLower(status.Convert(err).Message())
+	switch {
+	case strings.Contains(msg, "keepalive ping failed"):
+		return causeKeepalive
+	case strings.Contains(msg, "goaway"):
+		return causeGoAway
+	}
+	return causeUnknown
+}
+
+// transition records the connectivity state of pc changed from prev to next,
+// the connections leaving ready, except by being closed or by entering the
+// idle mode, i.e. to IDLE while it isn't used, are disconnected.
+func (pc *physicalConn) transition(prev, next connectivity.State) {
+	p := pc.pool
+	if next == connectivity.Ready {
+		atomic.AddInt32(&pc.readies, 1)
+	}
+	if prev != connectivity.Ready || next == connectivity.Ready || next == connectivity.Shutdown {
+		return
+	}
+	if next == connectivity.Idle && atomic.LoadInt32(&pc.ref) == 0 {
+		return
+	}
+	atomic.AddInt32(&p.disconnects, 1)
+	log.Printf("conn disconnected, address: %s, slot: %d, state: %v\n", p.address, pc.slot, next)
+}
+
+// disconnected counts the cause of the disconnect the failed RPC on pc tells,
+// once per transport: the readies of pc when it's counted are kept, the RPCs
+// failed with the same transport are skipped.
+func (pc *physicalConn) disconnected(err error) {
+	cause := disconnectCause(err)
+	if cause == causeUnknown {
+		return
+	}
+	p := pc.pool
+	readies, counted := atomic.LoadInt32(&pc.readies), atomic.LoadInt32(&pc.counted)
+	if readies == counted || !atomic.CompareAndSwapInt32(&pc.counted, counted, readies) {
+		return
+	}
+	switch cause {
+	case causeKeepalive:
+		atomic.AddInt32(&p.keepaliveTimeouts, 1)
+	case causeGoAway:
+		atomic.AddInt32(&p.goAways, 1)
+	}
+}
+
+// disconnectInterceptor tells the causes of the disconnects by the unary RPCs.
+func (pc *physicalConn) disconnectInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		pc.disconnected(err)
+	}
+	return err
+}
+
+// disconnectStreamInterceptor is like disconnectInterceptor for the streams.
+func (pc *physicalConn) disconnectStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		pc.disconnected(err)
+		return nil, err
+	}
+	return &disconnectStream{ClientStream: s, pc: pc}, nil
+}
+
+type disconnectStream struct {
+	grpc.ClientStream
+	pc *physicalConn
+}
+
+func (s *disconnectStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.pc.disconnected(err)
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+func TestDisconnectCause(t *testing.T) {
+	unavailable := func(msg string) error { return status.Error(codes.Unavailable, msg) }
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{nil, causeUnknown},
+		{errors.New("keepalive ping failed"), causeUnknown},
+		{unavailable(`connection error: desc = "keepalive ping failed to receive ACK within timeout"`), causeKeepalive},
+		{unavailable("closing transport due to: EOF, received prior goaway: code: NO_ERROR"), causeGoAway},
+		{unavailable(`connection error: desc = "transport: Error while dialing: connection refused"`), causeUnknown},
+		{status.Error(codes.Internal, "received goaway"), causeUnknown},
+	} {
+		require.Equal(t, c.want, disconnectCause(c.err), c.err)
+	}
+}
+
+func TestDisconnects(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	pb.RegisterEchoServer(s, &echoServer{})
+	go s.Serve(listen)
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	p, err := New(listen.Addr().String(), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	conn, err := p.Get()
+	require.NoError(t, err)
+	s.Stop()
+	require.Eventually(t, func() bool { return p.Stats().Disconnects == 1 }, time.Second, time.Millisecond)
+	conn.Close()
+
+	// the RPCs failed with the same transport count once
+	pc := p.(*pool).conns[0]
+	goAway := status.Error(codes.Unavailable, "closing transport due to: EOF, received prior goaway: code: NO_ERROR")
+	pc.disconnected(goAway)
+	pc.disconnected(goAway)
+	pc.disconnected(status.Error(codes.Unavailable, "keepalive ping failed to receive ACK within timeout"))
+	stats := p.Stats()
+	require.Equal(t, 1, stats.GoAways)
+	require.Equal(t, 0, stats.KeepaliveTimeouts)
+}
+
+func TestDisconnectsIdleMode(t *testing.T) {
+	addr := startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.IdleTimeout = 20 * time.Millisecond
+	p, err := New(addr, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	cc := p.(*pool).conns[0].cc.Load()
+	require.Eventually(t, func() bool { return cc.GetState() == connectivity.Idle }, time.Second, time.Millisecond)
+	require.Zero(t, p.Stats().Disconnects)
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command client is the client of the end-to-end example, it drives a load
+// through a pool to -endpoint, with retries, hedging and health checks, reports
+// the metrics of the pool and drains it. It exits non-zero if more than
+// -max-error-rate of the RPCs fail, so it doubles as an integration test
+// against the example server or any echo server.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/shimingyah/pool"
+	"github.com/shimingyah/pool/example/pb"
+)
+
+var (
+	endpoint     = flag.String("endpoint", "127.0.0.1:50000", "the comma separated addresses to connect to")
+	requests     = flag.Int("requests", 1000, "the number of RPCs")
+	concurrency  = flag.Int("concurrency", 16, "the number of concurrent RPCs")
+	timeout      = flag.Duration("timeout", time.Second, "the timeout of each RPC")
+	hedge        = flag.Duration("hedge", 0, "the delay the RPCs are hedged after, 0 for never")
+	healthCheck  = flag.Duration("health-check", time.Second, "the interval of the health checks, 0 for none")
+	report       = flag.Duration("report", time.Second, "the interval the metrics are reported at")
+	maxErrorRate = flag.Float64("max-error-rate", 0.01, "the fraction of the RPCs allowed to fail")
+)
+
+// retryServiceConfig retries the RPCs failed with Unavailable, e.g. on the
+// failures injected by the example server.
+const retryServiceConfig = `{"methodConfig": [{
+	"name": [{"service": "pb.Echo"}],
+	"retryPolicy": {
+		"maxAttempts": 4,
+		"initialBackoff": "0.01s",
+		"maxBackoff": "0.1s",
+		"backoffMultiplier": 2,
+		"retryableStatusCodes": ["UNAVAILABLE"]
+	}
+}]}`
+
+func main() {
+	flag.Parse()
+
+	opt := pool.DefaultOptions
+	opt.CallTimeout = *timeout
+	opt.HealthCheckInterval = *healthCheck
+	opt.RetryBudget = pool.NewRetryBudget(0.1, 10)
+	opt.BeforeDial = func(ctx context.Context, req pool.DialRequest) ([]grpc.DialOption, error) {
+		return []grpc.DialOption{grpc.WithDefaultServiceConfig(retryServiceConfig)}, nil
+	}
+
+	var p pool.Pool
+	var err error
+	if addresses := strings.Split(*endpoint, ","); len(addresses) > 1 {
+		p, err = pool.NewMulti(addresses, opt)
+	} else {
+		p, err = pool.New(*endpoint, opt)
+	}
+	if err != nil {
+		log.Fatalf("failed to new pool: %v", err)
+	}
+	stop := pool.HandleSignals(p)
+	defer stop()
+
+	ticker := time.NewTicker(*report)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				printMetrics(p, opt.RetryBudget)
+			}
+		}
+	}()
+
+	start := time.Now()
+	failed := run(p)
+	elapsed := time.Since(start)
+	close(done)
+
+	// drain the pool, the checked out conns are given back first
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Drain(ctx); err != nil {
+		log.Printf("failed to drain pool: %v\n", err)
+	}
+	printMetrics(p, opt.RetryBudget)
+
+	rate := float64(failed) / float64(*requests)
+	fmt.Printf("%d rpcs in %v, %d failed, error rate: %.4f\n", *requests, elapsed, failed, rate)
+	if rate > *maxErrorRate {
+		fmt.Printf("error rate exceeds %v\n", *maxErrorRate)
+		os.Exit(1)
+	}
+}
+
+// run issues the RPCs and returns how many of them failed.
+func run(p pool.Pool) int64 {
+	var failed int64
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := say(p, []byte(fmt.Sprintf("rpc-%d", j))); err != nil {
+					atomic.AddInt64(&failed, 1)
+					log.Printf("rpc %d failed: %v\n", j, err)
+				}
+			}
+		}()
+	}
+	for j := 0; j < *requests; j++ {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	return failed
+}
+
+// say echoes message through p, hedged if -hedge is set. the generated client
+// of the example takes a *grpc.ClientConn, so the RPC is invoked directly.
+func say(p pool.Pool, message []byte) error {
+	req := &pb.EchoRequest{Message: message}
+	call := func(ctx context.Context, cc grpc.ClientConnInterface) (*pb.EchoResponse, error) {
+		res := &pb.EchoResponse{}
+		return res, cc.Invoke(ctx, "/pb.Echo/Say", req, res)
+	}
+	var res *pb.EchoResponse
+	var err error
+	if *hedge > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		res, err = pool.Hedge(ctx, p, *hedge, call)
+	} else {
+		res, err = call(context.Background(), p)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(res.Message, message) {
+		return fmt.Errorf("unexpected echo %q of %q", res.Message, message)
+	}
+	return nil
+}
+
+// printMetrics prints the stats and the counters of p.
+func printMetrics(p pool.Pool, budget *pool.RetryBudget) {
+	s, c, b := p.Stats(), p.Counters(), budget.Stats()
+	fmt.Printf("conns: %d, ref: %d, waiting: %d, dialing: %d, disconnects: %d, goaways: %d | "+
+		"gets: %d, get errors: %d, dials: %d, dial errors: %d, evictions: %d | hedges: %d, throttled: %d\n",
+		s.Current, s.Ref, s.Waiting, s.Dialing, s.Disconnects, s.GoAways,
+		c.Gets, c.GetErrors, c.Dials, c.DialErrors, c.Evictions, b.Retried, b.Throttled)
+}
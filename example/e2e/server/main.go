@@ -0,0 +1,119 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command server is the echo server of the end-to-end example, it injects the
+// failures the pool is meant to ride out: errors, latency, GOAWAYs and drains.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+
+	"github.com/shimingyah/pool"
+	"github.com/shimingyah/pool/example/pb"
+)
+
+var (
+	port       = flag.Int("port", 50000, "port number")
+	failRate   = flag.Float64("fail-rate", 0, "the fraction of the RPCs failed with Unavailable")
+	latency    = flag.Duration("latency", 0, "the added latency of every RPC")
+	maxConnAge = flag.Duration("max-conn-age", 0, "the age the connections are sent a GOAWAY at, 0 for never")
+	drainAfter = flag.Duration("drain-after", 0, "reports NOT_SERVING and stops gracefully after it, 0 for never")
+)
+
+// server implements EchoServer with the injected failures.
+type server struct{}
+
+func (s *server) Say(ctx context.Context, req *pb.EchoRequest) (*pb.EchoResponse, error) {
+	if *latency > 0 {
+		select {
+		case <-time.After(*latency):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if rand.Float64() < *failRate {
+		return nil, status.Error(codes.Unavailable, "injected failure")
+	}
+	return &pb.EchoResponse{Message: req.Message}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	listen, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", *port))
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	params := keepalive.ServerParameters{
+		Time:    pool.KeepAliveTime,
+		Timeout: pool.KeepAliveTimeout,
+	}
+	if *maxConnAge > 0 {
+		params.MaxConnectionAge = *maxConnAge
+		params.MaxConnectionAgeGrace = *maxConnAge
+	}
+	s := grpc.NewServer(
+		grpc.InitialWindowSize(pool.InitialWindowSize),
+		grpc.InitialConnWindowSize(pool.InitialConnWindowSize),
+		grpc.MaxSendMsgSize(pool.MaxSendMsgSize),
+		grpc.MaxRecvMsgSize(pool.MaxRecvMsgSize),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			PermitWithoutStream: true,
+		}),
+		grpc.KeepaliveParams(params),
+	)
+	pb.RegisterEchoServer(s, &server{})
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
+
+	// drain like a deploy: fail the health checks first, then stop gracefully
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		if *drainAfter > 0 {
+			select {
+			case <-drain:
+			case <-time.After(*drainAfter):
+			}
+		} else {
+			<-drain
+		}
+		log.Printf("draining server on %s\n", listen.Addr())
+		healthServer.Shutdown()
+		s.GracefulStop()
+	}()
+
+	log.Printf("serving on %s, fail rate: %v, latency: %v, max conn age: %v\n",
+		listen.Addr(), *failRate, *latency, *maxConnAge)
+	if err := s.Serve(listen); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Faults is a fault-injection layer for chaos testing, commanded at runtime to
+// drop connections, delay dials or fail Gets of the pools sharing it. the pools
+// share it by setting the same Faults in their Options. the durations of the
+// faults are measured by the Clock of the first pool sharing it, the pools
+// sharing it are expected to share the Clock too.
+type Faults struct {
+	mu    sync.Mutex
+	pools map[*pool]struct{}
+	clock Clock
+
+	dropRatio float64
+	dropUntil time.Time
+
+	dialDelay      time.Duration
+	dialDelayUntil time.Time
+
+	getError    error
+	getErrUntil time.Time
+}
+
+// NewFaults return a fault-injection layer injecting nothing until commanded.
+func NewFaults() *Faults {
+	return &Faults{pools: make(map[*pool]struct{})}
+}
+
+func (f *Faults) join(p *pool) {
+	f.mu.Lock()
+	if f.clock == nil {
+		f.clock = p.clock
+	}
+	f.pools[p] = struct{}{}
+	f.mu.Unlock()
+}
+
+func (f *Faults) leave(p *pool) {
+	f.mu.Lock()
+	delete(f.pools, p)
+	f.mu.Unlock()
+}
+
+// now returns the time of the clock of f, f.mu is held.
+func (f *Faults) now() time.Time {
+	if f.clock == nil {
+		return time.Now()
+	}
+	return f.clock.Now()
+}
+
+// DropConnections closes ratio of the connections of the pools abruptly, behind
+// the pools' backs, like a middlebox dropping them, and so ratio of the ones the
+// pools dial for the duration d. it returns the number of connections dropped
+// at once.
+func (f *Faults) DropConnections(ratio float64, d time.Duration) int {
+	f.mu.Lock()
+	f.dropRatio, f.dropUntil = ratio, f.now().Add(d)
+	pools := make([]*pool, 0, len(f.pools))
+	for p := range f.pools {
+		pools = append(pools, p)
+	}
+	f.mu.Unlock()
+
+	var dropped int
+	for _, p := range pools {
+		for _, pc := range p.slots() {
+			if p.random() >= ratio {
+				continue
+			}
+			if cc := pc.cc.Load(); cc != nil {
+				cc.Close()
+				dropped++
+			}
+		}
+	}
+	log.Printf("faults dropped connections: %d, ratio: %v, duration: %v\n", dropped, ratio, d)
+	return dropped
+}
+
+// DelayDials delays every dial of the pools by delay for the duration d. the
+// pools wait for the delay without holding their lock, a growth waits once for
+// all of its dials.
+func (f *Faults) DelayDials(delay, d time.Duration) {
+	f.mu.Lock()
+	f.dialDelay, f.dialDelayUntil = delay, f.now().Add(d)
+	f.mu.Unlock()
+}
+
+// FailGets fails every Get of the pools with err for the duration d.
+func (f *Faults) FailGets(err error, d time.Duration) {
+	f.mu.Lock()
+	f.getError, f.getErrUntil = err, f.now().Add(d)
+	f.mu.Unlock()
+}
+
+// Reset stops injecting the drops of connections, the delays of dials and the
+// errors of Gets.
+func (f *Faults) Reset() {
+	f.mu.Lock()
+	f.dropRatio, f.dropUntil = 0, time.Time{}
+	f.dialDelay, f.dialDelayUntil = 0, time.Time{}
+	f.getError, f.getErrUntil = nil, time.Time{}
+	f.mu.Unlock()
+}
+
+// getErr returns the error injected into Get, f may be nil.
+func (f *Faults) getErr() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.now().Before(f.getErrUntil) {
+		return f.getError
+	}
+	return nil
+}
+
+// dropping returns the ratio of the dialed connections to drop, f may be nil.
+func (f *Faults) dropping() float64 {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.now().Before(f.dropUntil) {
+		return f.dropRatio
+	}
+	return 0
+}
+
+// delayDial waits by clock for the delay injected into a dial, until ctx is
+// done. f may be nil.
+func (f *Faults) delayDial(ctx context.Context, clock Clock) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	delay := f.dialDelay
+	if !f.now().Before(f.dialDelayUntil) {
+		delay = 0
+	}
+	f.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	timer := clock.AfterFunc(delay, func() { close(done) })
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestFaults(t *testing.T) {
+	faults := NewFaults()
+	opt := DefaultOptions
+	opt.MaxIdle = 4
+	opt.Faults = faults
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the Gets fail for the duration
+	injected := errors.New("injected")
+	faults.FailGets(injected, time.Hour)
+	_, err = p.Get()
+	require.Equal(t, injected, err)
+	faults.Reset()
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	faults.FailGets(injected, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	// the dials are delayed
+	faults.DelayDials(20*time.Millisecond, time.Hour)
+	start := time.Now()
+	p2, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 4*20*time.Millisecond)
+	faults.Reset()
+
+	// the connections are dropped behind the pools' backs
+	require.Equal(t, 8, faults.DropConnections(1, 0))
+	require.Equal(t, 0, faults.DropConnections(0, 0))
+	require.NoError(t, p2.Close())
+
+	// and so the ones dialed for the duration
+	require.NoError(t, p.Close())
+	faults.DropConnections(1, time.Hour)
+	opt.MaxIdle = 1
+	p3, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p3.Close()
+	dropped := nativePool.liveConns()[0]
+	require.Eventually(t, func() bool { return dropped.state() == ConnClosed }, time.Second, time.Millisecond)
+	faults.Reset()
+	require.Eventually(t, func() bool {
+		pc := nativePool.liveConns()[0]
+		return pc.state() == ConnReady && pc.cc.Load().GetState() != connectivity.Shutdown
+	}, 5*time.Second, time.Millisecond)
+}
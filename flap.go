@@ -0,0 +1,66 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// holdDown returns how long the slot of pc is held down before it's dialed
+// again, pc is being evicted. it's zero unless the connection flaps.
+func (p *pool) holdDown(pc *physicalConn) time.Duration {
+	if p.opt.FlapThreshold <= 0 {
+		return 0
+	}
+	lived := p.clock.Now().Sub(time.Unix(0, pc.track.dialedAt))
+	if lived >= p.opt.FlapThreshold {
+		atomic.StoreInt32(&pc.track.flaps, 0)
+		return 0
+	}
+	atomic.AddInt32(&p.flapped, 1)
+	flaps := atomic.AddInt32(&pc.track.flaps, 1)
+
+	d, limit := p.opt.FlapHoldDown, p.opt.FlapMaxHoldDown
+	if d <= 0 {
+		d = DefaultFlapHoldDown
+	}
+	if limit <= 0 {
+		limit = DefaultFlapMaxHoldDown
+	}
+	for i := int32(1); i < flaps && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	log.Printf("conn flapping, address: %s, slot: %d, lived: %v, flaps: %d, hold down: %v\n",
+		p.address, pc.slot, lived, flaps, d)
+	return d
+}
+
+// sleep waits for d, it returns false if the pool is closed meanwhile.
+func (p *pool) sleep(d time.Duration) bool {
+	done := make(chan struct{})
+	timer := p.clock.AfterFunc(d, func() { close(done) })
+	select {
+	case <-done:
+		return true
+	case <-p.ctx.Done():
+		timer.Stop()
+		return false
+	}
+}
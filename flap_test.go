@@ -0,0 +1,84 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlapHoldDown(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.FlapThreshold = time.Hour
+	opt.FlapHoldDown = time.Second
+	opt.FlapMaxHoldDown = 3 * time.Second
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+	pc := nativePool.slots()[0]
+
+	// doubled on every consecutive flap up to FlapMaxHoldDown
+	require.Equal(t, time.Second, nativePool.holdDown(pc))
+	require.Equal(t, 2*time.Second, nativePool.holdDown(pc))
+	require.Equal(t, 3*time.Second, nativePool.holdDown(pc))
+	require.Equal(t, 3, p.Stats().Flaps)
+
+	// reset once a connection outlives FlapThreshold
+	nativePool.opt.FlapThreshold = time.Nanosecond
+	require.Zero(t, nativePool.holdDown(pc))
+	nativePool.opt.FlapThreshold = time.Hour
+	require.Equal(t, time.Second, nativePool.holdDown(pc))
+}
+
+func TestFlapReplace(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.FlapThreshold = time.Hour
+	opt.FlapHoldDown = 50 * time.Millisecond
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	pc := nativePool.slots()[0]
+	start := time.Now()
+	nativePool.evict(pc, "test")
+	require.Eventually(t, func() bool {
+		return nativePool.slots()[0] != pc
+	}, time.Second, time.Millisecond)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Equal(t, 1, p.Stats().Flaps)
+}
+
+func TestFlapHoldDownClose(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.FlapThreshold = time.Hour
+	opt.FlapHoldDown = time.Hour
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+
+	// the pool is closed during the hold-down
+	nativePool.evict(nativePool.slots()[0], "test")
+	require.Eventually(t, func() bool {
+		return p.Stats().Flaps == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, p.Close())
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// healthCheck checks the pool's connections on every tick of ticker until the
+// pool is closed.
+func (p *pool) healthCheck(ticker Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+			for _, pc := range p.slots() {
+				if pc.idle() || p.served(pc) {
+					continue
+				}
+				if err := p.check(pc); err != nil {
+					p.evict(pc, fmt.Sprintf("health check failed: %v", err))
+				}
+			}
+		}
+	}
+}
+
+// check sends a health check request on pc.
+func (p *pool) check(pc *physicalConn) error {
+	cc := pc.cc.Load()
+	if cc == nil {
+		return nil
+	}
+	timeout := p.opt.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(p.ctx, probeKey{}, true), timeout)
+	defer cancel()
+	if len(p.opt.HealthCheckMetadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, p.opt.HealthCheckMetadata)
+	}
+
+	res, err := grpc_health_v1.NewHealthClient(cc).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: p.opt.HealthCheckService})
+	if err != nil {
+		return err
+	}
+	if res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("status %v", res.Status)
+	}
+	return nil
+}
+
+// probeKey marks the ctx of the health checks, they aren't recorded as served.
+type probeKey struct{}
+
+// served reports whether pc had an RPC answered within the last
+// HealthCheckInterval, it needn't be checked then.
+func (p *pool) served(pc *physicalConn) bool {
+	at := atomic.LoadInt64(&pc.track.servedAt)
+	return at != 0 && p.clock.Now().Sub(time.Unix(0, at)) < p.opt.HealthCheckInterval
+}
+
+// answered records the RPC finished with err on pc if the server answered it,
+// the errors of the transport or the deadlines don't prove the liveness.
+func (pc *physicalConn) answered(err error) {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.Unknown:
+		return
+	}
+	atomic.StoreInt64(&pc.track.servedAt, pc.pool.clock.Now().UnixNano())
+}
+
+// servedInterceptor records the unary RPCs answered, see served.
+func (pc *physicalConn) servedInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if ctx.Value(probeKey{}) == nil {
+		pc.answered(err)
+	}
+	return err
+}
+
+// servedStreamInterceptor records the messages and the ends of the streams
+// received, see served.
+func (pc *physicalConn) servedStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &servedStream{ClientStream: s, pc: pc}, nil
+}
+
+type servedStream struct {
+	grpc.ClientStream
+	pc *physicalConn
+}
+
+func (s *servedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.pc.answered(nil)
+	} else {
+		s.pc.answered(err)
+	}
+	return err
+}
+
+// slots returns the connections in the pool's slots.
+func (p *pool) slots() []*physicalConn {
+	live := p.liveConns()
+	pcs := make([]*physicalConn, 0, len(live))
+	for _, pc := range live {
+		if pc != nil {
+			pcs = append(pcs, pc)
+		}
+	}
+	return pcs
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startHealthServer starts an in-process health server requiring the token.
+func startHealthServer(t *testing.T, token string) (string, *health.Server) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	auth := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get("authorization")) == 0 || md.Get("authorization")[0] != token {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return handler(ctx, req)
+	})
+	s := grpc.NewServer(auth)
+	hs := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go s.Serve(listen)
+	t.Cleanup(s.Stop)
+
+	return listen.Addr().String(), hs
+}
+
+func TestHealthCheck(t *testing.T) {
+	address, hs := startHealthServer(t, "secret")
+	hs.SetServingStatus("echo", grpc_health_v1.HealthCheckResponse_SERVING)
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.HealthCheckInterval = 10 * time.Millisecond
+	opt.HealthCheckService = "echo"
+	opt.HealthCheckMetadata = metadata.Pairs("authorization", "secret")
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	require.NoError(t, nativePool.check(nativePool.conns[0]))
+	require.Contains(t, p.Stats().Options, "HealthCheckMetadata:[authorization]")
+	require.NotContains(t, p.Stats().Options, "secret")
+	time.Sleep(50 * time.Millisecond)
+	require.EqualValues(t, 1, atomic.LoadInt32(&nativePool.liveConns()[0].attempts))
+
+	hs.SetServingStatus("echo", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&nativePool.liveConns()[0].attempts) > 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestHealthCheckMetadata(t *testing.T) {
+	address, hs := startHealthServer(t, "secret")
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	p, err := New(address, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	err = nativePool.check(nativePool.conns[0])
+	require.EqualValues(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+type hedgeResult[T any] struct {
+	value T
+	err   error
+}
+
+// Hedge issues call on a connection of p, if it doesn't succeed within delay the
+// same call is issued again on another connection of p, the one of the first
+// call is shared only if p has no other. the first success is returned and the
+// other call is canceled, so call must be idempotent. If the first call fails
+// before delay, its error is returned without hedging. the hedge is skipped if
+// the RetryBudget of p is exhausted. delay is measured by the Clock of p.
+func Hedge[T any](ctx context.Context, p Pool, delay time.Duration,
+	call func(ctx context.Context, cc grpc.ClientConnInterface) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult[T], 2)
+	var first atomic.Pointer[conn]
+	issue := func(ctx context.Context) {
+		go func() {
+			c, err := p.GetContext(ctx)
+			if err != nil {
+				var zero T
+				results <- hedgeResult[T]{zero, err}
+				return
+			}
+			defer c.Close()
+			if native, ok := c.(*conn); ok {
+				first.CompareAndSwap(nil, native)
+			}
+			value, err := call(ctx, c)
+			results <- hedgeResult[T]{value, err}
+		}()
+	}
+
+	budget := retryBudgetOf(p)
+	budget.request()
+	issue(ctx)
+	fire := make(chan struct{})
+	timer := clockOf(p).AfterFunc(delay, func() { close(fire) })
+	defer timer.Stop()
+
+	pending := 1
+	hedged := false
+	for {
+		select {
+		case <-fire:
+			fire = nil
+			if !hedged && budget.retry() {
+				hedged = true
+				pending++
+				issue(context.WithValue(ctx, avoidKey{}, first.Load()))
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.value, nil
+			}
+			if !hedged || pending == 0 {
+				return r.value, r.err
+			}
+		}
+	}
+}
+
+// avoidKey carries the conn of the first call of Hedge in the ctx of the hedge.
+type avoidKey struct{}
+
+// avoided returns the connection of p the ctx of a hedge avoids, nil if none.
+func (p *pool) avoided(ctx context.Context) *physicalConn {
+	if c, _ := ctx.Value(avoidKey{}).(*conn); c != nil && c.pool == p {
+		return c.pc
+	}
+	return nil
+}
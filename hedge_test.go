@@ -0,0 +1,122 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestHedge(t *testing.T) {
+	var calls int32
+	firstSlow := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return handler(ctx, req)
+	})
+
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	p, err := New(startEchoServer(t, firstSlow), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := Hedge(ctx, p, 10*time.Millisecond, func(ctx context.Context, cc grpc.ClientConnInterface) (*pb.EchoResponse, error) {
+		res := &pb.EchoResponse{}
+		err := cc.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res)
+		return res, err
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, "hi", string(res.Message))
+	require.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestHedgeAnotherConn(t *testing.T) {
+	var calls int32
+	firstSlow := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return handler(ctx, req)
+	})
+
+	// packed, the hedge would share the connection of the first call
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.PackingStrategy = PackingPack
+	p, err := New(startEchoServer(t, firstSlow), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	slots := make(chan int, 2)
+	_, err = Hedge(ctx, p, 10*time.Millisecond, func(ctx context.Context, cc grpc.ClientConnInterface) (*pb.EchoResponse, error) {
+		slots <- cc.(Conn).Info().Slot
+		res := &pb.EchoResponse{}
+		err := cc.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, res)
+		return res, err
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, <-slots, <-slots)
+}
+
+func TestHedgeRetryBudget(t *testing.T) {
+	var calls int32
+	slow := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return handler(ctx, req)
+	})
+
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.RetryBudget = NewRetryBudget(0, 0)
+	p, err := New(startEchoServer(t, slow), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the budget is exhausted, the call isn't hedged
+	_, err = Hedge(ctx, p, time.Millisecond, func(ctx context.Context, cc grpc.ClientConnInterface) (*pb.EchoResponse, error) {
+		res := &pb.EchoResponse{}
+		err := cc.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, res)
+		return res, err
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	require.Equal(t, 1, opt.RetryBudget.Stats().Throttled)
+}
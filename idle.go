@@ -0,0 +1,73 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// keeperInterval is the interval the keeper checks the warm connections.
+const keeperInterval = time.Second
+
+// idleTimeout returns the dial option of IdleTimeout, nil if it isn't set.
+func (p *pool) idleTimeout() grpc.DialOption {
+	switch {
+	case p.opt.IdleTimeout > 0:
+		return grpc.WithIdleTimeout(p.opt.IdleTimeout)
+	case p.opt.IdleTimeout < 0:
+		return grpc.WithIdleTimeout(0)
+	}
+	return nil
+}
+
+// idle reports whether the channel of pc has dropped to IDLE.
+func (pc *physicalConn) idle() bool {
+	if pc.pool.opt.IdleTimeout <= 0 {
+		return false
+	}
+	cc := pc.cc.Load()
+	return cc != nil && cc.GetState() == connectivity.Idle
+}
+
+// rewarm reconnects the channel of pc if it has dropped to IDLE, so the RPC
+// about to be issued doesn't wait for the name resolution too.
+func (pc *physicalConn) rewarm() {
+	if pc.idle() {
+		pc.cc.Load().Connect()
+	}
+}
+
+// keepWarm reconnects the channels of the first IdleKeepWarm slots as soon as
+// they drop to IDLE, until the pool is closed.
+func (p *pool) keepWarm() {
+	ticker := p.clock.NewTicker(keeperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+			for _, pc := range p.slots() {
+				if pc.slot < p.opt.IdleKeepWarm {
+					pc.rewarm()
+				}
+			}
+		}
+	}
+}
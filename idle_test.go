@@ -0,0 +1,58 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.IdleTimeout = 50 * time.Millisecond
+	opt.IdleKeepWarm = 1
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	state := func(slot int) connectivity.State {
+		return nativePool.conns[slot].cc.Load().GetState()
+	}
+	for slot := 0; slot < 2; slot++ {
+		nativePool.conns[slot].cc.Load().Connect()
+	}
+
+	// the slot kept warm is re-warmed by the keeper, the other one stays idle
+	require.Eventually(t, func() bool {
+		return state(1) == connectivity.Idle && state(0) != connectivity.Idle
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// until it's checked out
+	c, err := p.Get()
+	require.NoError(t, err)
+	if c.Info().Slot == 0 {
+		c.Close()
+		c, err = p.Get()
+		require.NoError(t, err)
+	}
+	defer c.Close()
+	require.EqualValues(t, 1, c.Info().Slot)
+	require.NotEqual(t, connectivity.Idle, state(1))
+}
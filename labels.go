@@ -0,0 +1,75 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+)
+
+// the pprof labels of the pool's goroutines, so the profiles of processes with
+// many pools attribute the cost to the pools and backends.
+const (
+	labelTarget = "pool_target"
+	labelSlot   = "pool_slot"
+	labelTask   = "pool_task"
+)
+
+// labels returns the pprof labels of task on slot, slot is -1 for a one-time
+// connection, and less for the tasks of the whole pool.
+func (p *pool) labels(task string, slot int) pprof.LabelSet {
+	return labels(p.address, task, slot)
+}
+
+// labels returns the pprof labels of task on slot of the pool of target, see
+// pool.labels.
+func labels(target, task string, slot int) pprof.LabelSet {
+	if slot < -1 {
+		return pprof.Labels(labelTarget, target, labelTask, task)
+	}
+	return pprof.Labels(labelTarget, target, labelSlot, strconv.Itoa(slot), labelTask, task)
+}
+
+// spawn runs f in a new goroutine labeled by task and slot, see labels.
+func (p *pool) spawn(task string, slot int, f func()) {
+	go pprof.Do(context.Background(), p.labels(task, slot), func(context.Context) { f() })
+}
+
+// spawn runs f in a new goroutine labeled by task and the addresses of mp.
+func (mp *multiPool) spawn(task string, f func()) {
+	labels := pprof.Labels(labelTarget, strings.Join(mp.addresses, ","), labelTask, task)
+	go pprof.Do(context.Background(), labels, func(context.Context) { f() })
+}
+
+// spawnDialed runs f in a new goroutine labeled by task and the slot req dials,
+// for the goroutines of the dialers outliving the dial.
+func spawnDialed(req DialRequest, task string, f func()) {
+	go pprof.Do(context.Background(), labels(req.Target, task, req.SlotIndex), func(context.Context) { f() })
+}
+
+// spawn runs f in a new goroutine labeled by task and p, if it's one of the pools
+// of this package.
+func spawn(p Pool, task string, f func()) {
+	switch p := p.(type) {
+	case *pool:
+		p.spawn(task, -2, f)
+	case *multiPool:
+		p.spawn(task, f)
+	default:
+		go f()
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// lameDuck evicts pc if the metadata signals lame duck, see LameDuckHeader.
+func (pc *physicalConn) lameDuck(mds ...metadata.MD) {
+	for _, md := range mds {
+		for _, v := range md.Get(pc.pool.opt.LameDuckHeader) {
+			if strings.EqualFold(v, "true") {
+				pc.pool.evict(pc, "lame duck signaled")
+				return
+			}
+		}
+	}
+}
+
+// lameDuckInterceptor evicts pc when a unary RPC's header or trailer signals
+// lame duck.
+func (pc *physicalConn) lameDuckInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var header, trailer metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header), grpc.Trailer(&trailer))...)
+	pc.lameDuck(header, trailer)
+	return err
+}
+
+// lameDuckStreamInterceptor is like lameDuckInterceptor for the streams, their
+// header and trailer are checked once they end.
+func (pc *physicalConn) lameDuckStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &lameDuckStream{ClientStream: s, pc: pc}, nil
+}
+
+type lameDuckStream struct {
+	grpc.ClientStream
+	pc *physicalConn
+}
+
+func (s *lameDuckStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		header, _ := s.Header()
+		s.pc.lameDuck(header, s.Trailer())
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// lameDuckServer signals lame duck in the header or the trailer of its RPCs.
+func lameDuckServer(t *testing.T, trailer bool) string {
+	return startEchoServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		_ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md := metadata.Pairs("lame-duck", "true")
+		if trailer {
+			grpc.SetTrailer(ctx, md)
+		} else {
+			grpc.SetHeader(ctx, md)
+		}
+		return handler(ctx, req)
+	}))
+}
+
+func TestLameDuck(t *testing.T) {
+	for _, trailer := range []bool{false, true} {
+		opt := DefaultOptions
+		opt.MaxIdle = 1
+		opt.MaxActive = 1
+		opt.LameDuckHeader = "lame-duck"
+		p, err := New(lameDuckServer(t, trailer), opt)
+		require.NoError(t, err)
+		nativePool := p.(*pool)
+		pc := nativePool.slots()[0]
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var header metadata.MD
+		require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}, grpc.Header(&header)))
+		cancel()
+		// the caller's header is still received
+		if !trailer {
+			require.Equal(t, []string{"true"}, header.Get("lame-duck"))
+		}
+		require.Eventually(t, func() bool {
+			return nativePool.slots()[0] != pc
+		}, time.Second, time.Millisecond)
+		require.NoError(t, p.Close())
+	}
+}
+
+func TestLameDuckIgnored(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	p, err := New(lameDuckServer(t, false), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	pc := p.(*pool).slots()[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.Equal(t, pc, p.(*pool).slots()[0])
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ConnState is the state of a connection of the pool in its lifecycle, it only
+// moves forward: dialing → ready → replacing → down → draining → closed, but
+// replacing moves back to ready if the replacement fails. replacing, down and
+// draining may be skipped.
+type ConnState int32
+
+const (
+	// ConnDialing is being dialed, it isn't handed out yet.
+	ConnDialing ConnState = iota
+
+	// ConnReady is handed out by Get.
+	ConnReady
+
+	// ConnReplacing is evicted, it's still handed out by Get until the
+	// replacement dialed in background takes over its slot.
+	ConnReplacing
+
+	// ConnDown has shut down underneath the pool, e.g. it's closed through Value,
+	// it's skipped by Get until its slot is re-dialed.
+	ConnDown
+
+	// ConnDraining is retired, e.g. evicted or shrunk, it's closed once all of the
+	// conns checked out of it are given back, or EvictLinger passes.
+	ConnDraining
+
+	// ConnClosed is closed.
+	ConnClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnDialing:
+		return "dialing"
+	case ConnReady:
+		return "ready"
+	case ConnReplacing:
+		return "replacing"
+	case ConnDown:
+		return "down"
+	case ConnDraining:
+		return "draining"
+	case ConnClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// connTransitions are the states each state may move to.
+var connTransitions = [...]uint8{
+	ConnDialing:   1<<ConnReady | 1<<ConnClosed,
+	ConnReady:     1<<ConnReplacing | 1<<ConnDown | 1<<ConnDraining | 1<<ConnClosed,
+	ConnReplacing: 1<<ConnReady | 1<<ConnDown | 1<<ConnDraining | 1<<ConnClosed,
+	ConnDown:      1<<ConnDraining | 1<<ConnClosed,
+	ConnDraining:  1 << ConnClosed,
+	ConnClosed:    0,
+}
+
+// ConnStatus is the state of the connection in a slot of the pool, see Stats.
+type ConnStatus struct {
+	ConnInfo
+	State ConnState
+
+	// Ref is the number of conns checked out of it.
+	Ref int
+}
+
+// state returns the state of pc.
+func (pc *physicalConn) state() ConnState {
+	return ConnState(atomic.LoadInt32(&pc.lifecycle))
+}
+
+// retired reports whether pc is retired or closed, it's handed out no more.
+func (pc *physicalConn) retired() bool {
+	return pc.state() >= ConnDraining
+}
+
+// to moves pc to next, it reports the state it's moved from and whether it's
+// moved by this call. pc moved to or past next already, e.g. retired twice or
+// closed before it's retired, isn't moved. the other transitions not allowed
+// are bugs, they panic in the pooldebug builds.
+func (pc *physicalConn) to(next ConnState) (ConnState, bool) {
+	for {
+		prev := pc.state()
+		if connTransitions[prev]&(1<<next) == 0 {
+			if prev < next {
+				debugTransition(pc, prev, next)
+			}
+			return prev, false
+		}
+		if atomic.CompareAndSwapInt32(&pc.lifecycle, int32(prev), int32(next)) {
+			return prev, true
+		}
+	}
+}
+
+// slotStatuses returns the states of the connections in the slots.
+func (p *pool) slotStatuses() []ConnStatus {
+	live := p.liveConns()
+	statuses := make([]ConnStatus, 0, len(live))
+	for _, pc := range live {
+		if pc == nil {
+			continue
+		}
+		statuses = append(statuses, ConnStatus{
+			ConnInfo: pc.info(),
+			State:    pc.state(),
+			Ref:      int(atomic.LoadInt32(&pc.ref)),
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLifecycle(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	pc := nativePool.conns[0]
+	require.Equal(t, []ConnStatus{{ConnInfo: c.Info(), State: ConnReady, Ref: 1}}, p.Stats().Slots)
+
+	// the retired conn drains until it's given back, it isn't handed out
+	nativePool.Lock()
+	nativePool.conns[0] = nil
+	nativePool.publishConns()
+	nativePool.Unlock()
+	pc.retire()
+	pc.retire()
+	require.Equal(t, ConnDraining, pc.state())
+	require.Equal(t, 1, p.Stats().Draining)
+	require.False(t, nativePool.claim(pc))
+	require.NoError(t, c.Close())
+	require.Equal(t, ConnClosed, pc.state())
+	require.Equal(t, 0, p.Stats().Draining)
+	require.Nil(t, pc.cc.Load())
+
+	// the states only move forward
+	prev, ok := pc.to(ConnReady)
+	require.Equal(t, ConnClosed, prev)
+	require.False(t, ok)
+	require.Empty(t, p.Stats().Slots)
+}
+
+func TestConnReplacing(t *testing.T) {
+	faults := NewFaults()
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.DialTimeout = 20 * time.Millisecond
+	opt.Faults = faults
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the evicted conn is handed out until it's replaced, and back to ready if
+	// the replacement fails
+	faults.DelayDials(time.Second, time.Minute)
+	pc := nativePool.conns[0]
+	nativePool.evict(pc, "test")
+	require.Equal(t, ConnReplacing, pc.state())
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.Equal(t, ConnReplacing, p.Stats().Slots[0].State)
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool { return pc.state() == ConnReady }, time.Second, time.Millisecond)
+
+	faults.Reset()
+	nativePool.evict(pc, "test")
+	require.Eventually(t, func() bool { return pc.state() == ConnClosed }, time.Second, time.Millisecond)
+	require.Equal(t, ConnReady, p.Stats().Slots[0].State)
+}
+
+func TestConnStateString(t *testing.T) {
+	require.Equal(t, "draining", ConnDraining.String())
+	require.Equal(t, "ConnState(9)", ConnState(9).String())
+}
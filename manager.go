@@ -0,0 +1,165 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// Manager holds a connection pool per target and identity, the pool is created
+// with the manager's options the first time it is asked for.
+type Manager struct {
+	opt Options
+
+	mu     sync.Mutex
+	pools  map[Key]Pool
+	closed bool
+}
+
+// Key identifies a pool of the manager.
+type Key struct {
+	// Target is the canonical server address of the pool: the host is lowercased,
+	// IPv6 literals are bracketed canonically, and the port is in digits, 443 if
+	// it's omitted, so the spellings of the same target share the pool.
+	Target string
+
+	// Identity tags the credential the pool dials with, it's set to the pool's
+	// Options.Identity. pools of the same target but different identities never
+	// share connections.
+	Identity string
+}
+
+// NewManager return a pool manager, option is used to create every pool.
+func NewManager(option Options) *Manager {
+	return &Manager{
+		opt:   option,
+		pools: make(map[Key]Pool),
+	}
+}
+
+// Get returns the pool of target with empty identity, creates it if not exists.
+func (m *Manager) Get(target string) (Pool, error) {
+	return m.GetIdentity(target, "")
+}
+
+// GetIdentity returns the pool of target and identity, creates it if not exists.
+// the pool is created without the lock held, so a slow target doesn't block the
+// others, the pool created concurrently for the same key is closed.
+func (m *Manager) GetIdentity(target, identity string) (Pool, error) {
+	target, err := canonicalTarget(target, m.opt.strictTarget())
+	if err != nil {
+		return nil, err
+	}
+	key := Key{Target: target, Identity: identity}
+	if p, err := m.lookup(key); p != nil || err != nil {
+		return p, err
+	}
+	opt := m.opt
+	opt.Identity = identity
+	p, err := New(target, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		p.Close()
+		return nil, ErrClosed
+	}
+	if other, ok := m.pools[key]; ok {
+		p.Close()
+		return other, nil
+	}
+	m.pools[key] = p
+	return p, nil
+}
+
+// lookup returns the pool of key, nil if not exists.
+func (m *Manager) lookup(key Key) (Pool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return m.pools[key], nil
+}
+
+// Factory returns a client factory backed by the manager's pools, frameworks
+// that construct clients from a target get pooled connections transparently.
+func (m *Manager) Factory() func(target string) (grpc.ClientConnInterface, error) {
+	return m.FactoryIdentity("")
+}
+
+// FactoryIdentity is like Factory but the pools are of the identity.
+func (m *Manager) FactoryIdentity(identity string) func(target string) (grpc.ClientConnInterface, error) {
+	return func(target string) (grpc.ClientConnInterface, error) {
+		return m.GetIdentity(target, identity)
+	}
+}
+
+// Close closes all of the pools, the manager is no longer usable after it.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	for key, p := range m.pools {
+		if er := p.Close(); er != nil && err == nil {
+			err = er
+		}
+		delete(m.pools, key)
+	}
+	m.closed = true
+	return err
+}
+
+// Drain drains and closes all the pools of the manager concurrently, bounded by
+// ctx, see CloseAll. the manager is closed.
+func (m *Manager) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	pools := make([]Pool, 0, len(m.pools))
+	for key, p := range m.pools {
+		pools = append(pools, p)
+		delete(m.pools, key)
+	}
+	m.closed = true
+	m.mu.Unlock()
+	return CloseAll(ctx, pools...)
+}
+
+// CloseAll drains and closes pools concurrently with the common deadline of
+// ctx, the pools still draining when ctx is done are closed anyway. the errors
+// are joined, each tagged with the address of its pool, the pools closed
+// already are skipped.
+func CloseAll(ctx context.Context, pools ...Pool) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(pools))
+	for i, p := range pools {
+		wg.Add(1)
+		go func(i int, p Pool) {
+			defer wg.Done()
+			if err := p.Drain(ctx); err != nil && err != ErrClosed {
+				errs[i] = EndpointError{Address: p.Stats().Address, Err: err}
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestManagerGet(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	m := NewManager(opt)
+
+	p1, err := m.Get("127.0.0.1:50000")
+	require.NoError(t, err)
+	p2, err := m.Get("127.0.0.1:50000")
+	require.NoError(t, err)
+	p3, err := m.Get("127.0.0.1:50001")
+	require.NoError(t, err)
+	require.EqualValues(t, true, p1 == p2)
+	require.EqualValues(t, true, p1 != p3)
+
+	_, err = m.Get("")
+	require.Error(t, err)
+
+	require.NoError(t, m.Close())
+	_, err = m.Get("127.0.0.1:50000")
+	require.EqualError(t, err, "pool is closed")
+}
+
+func TestManagerCanonicalKey(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	m := NewManager(opt)
+	defer m.Close()
+
+	p1, err := m.Get("HOST:443")
+	require.NoError(t, err)
+	p2, err := m.Get("host")
+	require.NoError(t, err)
+	p3, err := m.Get("[0:0::1]:50000")
+	require.NoError(t, err)
+	p4, err := m.Get("[::1]:50000")
+	require.NoError(t, err)
+	require.True(t, p1 == p2)
+	require.True(t, p3 == p4)
+	require.Equal(t, Key{Target: "host:443"}, p1.Stats().Key)
+
+	p5, err := m.GetIdentity("Host:https", "tenant")
+	require.NoError(t, err)
+	require.True(t, p1 != p5)
+	require.Equal(t, Key{Target: "host:443", Identity: "tenant"}, p5.Stats().Key)
+}
+
+func TestManagerFactory(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	m := NewManager(opt)
+	defer m.Close()
+
+	factory := m.Factory()
+	cc1, err := factory("127.0.0.1:50000")
+	require.NoError(t, err)
+	cc2, err := factory("127.0.0.1:50000")
+	require.NoError(t, err)
+	require.EqualValues(t, true, cc1 == cc2)
+}
+
+func TestManagerIdentity(t *testing.T) {
+	var mu sync.Mutex
+	identities := make(map[string]bool)
+
+	opt := DefaultOptions
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		mu.Lock()
+		identities[req.Options.Identity] = true
+		mu.Unlock()
+		return DialTest(req.Target)
+	}
+	m := NewManager(opt)
+	defer m.Close()
+
+	p1, err := m.GetIdentity("127.0.0.1:50000", "tenant-a")
+	require.NoError(t, err)
+	p2, err := m.GetIdentity("127.0.0.1:50000", "tenant-b")
+	require.NoError(t, err)
+	p3, err := m.GetIdentity("127.0.0.1:50000", "tenant-a")
+	require.NoError(t, err)
+	require.EqualValues(t, true, p1 != p2)
+	require.EqualValues(t, true, p1 == p3)
+	require.EqualValues(t, map[string]bool{"tenant-a": true, "tenant-b": true}, identities)
+}
+
+func TestCloseAll(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	p1, err := New("127.0.0.1:50000", opt)
+	require.NoError(t, err)
+	p2, err := New("127.0.0.1:50001", opt)
+	require.NoError(t, err)
+	p3, err := New("127.0.0.1:50002", opt)
+	require.NoError(t, err)
+	require.NoError(t, p3.Close())
+
+	// the pools are drained with the common deadline
+	c, err := p2.Get()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = CloseAll(ctx, p1, p2, p3)
+	require.Less(t, time.Since(start), time.Second)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	var endpointErr EndpointError
+	require.ErrorAs(t, err, &endpointErr)
+	require.Equal(t, "127.0.0.1:50001", endpointErr.Address)
+	for _, p := range []Pool{p1, p2, p3} {
+		_, err = p.Get()
+		require.Equal(t, ErrClosed, err)
+	}
+	require.NoError(t, c.Close())
+}
+
+func TestManagerDrain(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	m := NewManager(opt)
+	p, err := m.Get("127.0.0.1:50000")
+	require.NoError(t, err)
+
+	require.NoError(t, m.Drain(context.Background()))
+	_, err = p.Get()
+	require.Equal(t, ErrClosed, err)
+	_, err = m.Get("127.0.0.1:50000")
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestManagerSlowTarget(t *testing.T) {
+	dialing, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		if req.Target == "slow:443" {
+			once.Do(func() { close(dialing) })
+			<-release
+		}
+		return DialTest(req.Target)
+	}
+	m := NewManager(opt)
+	defer m.Close()
+	var released sync.Once
+	unblock := func() { released.Do(func() { close(release) }) }
+	defer unblock()
+
+	slow := make(chan Pool)
+	go func() {
+		p, _ := m.Get("slow")
+		slow <- p
+	}()
+	<-dialing
+
+	// the slow target doesn't block the others
+	got := make(chan error)
+	go func() {
+		_, err := m.Get("fast")
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fast target is blocked by the slow one")
+	}
+
+	// the concurrent Gets of the same target share the pool
+	done := make(chan Pool)
+	go func() {
+		p, _ := m.Get("slow")
+		done <- p
+	}()
+	unblock()
+	p1, p2 := <-slow, <-done
+	require.NotNil(t, p1)
+	require.True(t, p1 == p2)
+}
+
+func TestManagerEndpointKeys(t *testing.T) {
+	creds := credentials.NewTLS(&tls.Config{ServerName: "backend"})
+	opt := DefaultOptions
+	opt.EndpointTransportCredentials = map[string]credentials.TransportCredentials{"backend": creds}
+	opt.EndpointCompressors = map[string][]string{"backend": {"gzip"}}
+	m := NewManager(opt)
+	defer m.Close()
+
+	// the keys without the port match the pool of the canonical target
+	p, err := m.Get("backend")
+	require.NoError(t, err)
+	nativePool := p.(*pool)
+	require.Equal(t, Key{Target: "backend:443"}, p.Stats().Key)
+	require.Equal(t, creds, nativePool.opt.transportCredentials(nativePool.address))
+	require.Equal(t, []string{"gzip"}, nativePool.compressors())
+}
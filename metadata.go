@@ -0,0 +1,57 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// withMetadata returns ctx with the pool's Metadata and UtilizationHeader in
+// its outgoing metadata, the keys set by the RPC are kept.
+func (p *pool) withMetadata(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	var kv []string
+	for k, vs := range p.opt.Metadata {
+		if len(md.Get(k)) > 0 {
+			continue
+		}
+		for _, v := range vs {
+			kv = append(kv, k, v)
+		}
+	}
+	if k := p.opt.UtilizationHeader; k != "" && len(md.Get(k)) == 0 {
+		kv = append(kv, k, strconv.FormatFloat(p.utilization(), 'f', 2, 64))
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// metadataInterceptor sends Metadata with the unary RPCs, see withMetadata.
+func (p *pool) metadataInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(p.withMetadata(ctx), method, req, reply, cc, opts...)
+}
+
+// metadataStreamInterceptor sends Metadata with the streams, see withMetadata.
+func (p *pool) metadataStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(p.withMetadata(ctx), desc, cc, method, opts...)
+}
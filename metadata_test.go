@@ -0,0 +1,93 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMetadata(t *testing.T) {
+	incoming := make(chan metadata.MD, 2)
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		incoming <- md
+		return handler(ctx, req)
+	})
+	dialed := make(chan metadata.MD, 1)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.Metadata = metadata.Pairs("client-id", "billing", "build", "v1.2.3")
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		md, _ := metadata.FromOutgoingContext(req.Ctx)
+		dialed <- md
+		return dialDefault(req)
+	}
+	p, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, []string{"billing"}, (<-dialed).Get("client-id"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	md := <-incoming
+	require.Equal(t, []string{"billing"}, md.Get("client-id"))
+	require.Equal(t, []string{"v1.2.3"}, md.Get("build"))
+
+	// the keys set by the RPC are kept
+	ctx = metadata.AppendToOutgoingContext(ctx, "client-id", "batch")
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	md = <-incoming
+	require.Equal(t, []string{"batch"}, md.Get("client-id"))
+	require.Equal(t, []string{"v1.2.3"}, md.Get("build"))
+}
+
+func TestUtilizationHeader(t *testing.T) {
+	incoming := make(chan metadata.MD, 1)
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		incoming <- md
+		return handler(ctx, req)
+	})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 4
+	opt.UtilizationHeader = "x-pool-utilization"
+	p, err := New(startEchoServer(t, server), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := p.Get()
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	require.Equal(t, []string{"0.50"}, (<-incoming).Get("x-pool-utilization"))
+
+	opt.UtilizationHeader = "grpc-utilization"
+	_, err = New(*endpoint, opt)
+	require.ErrorIs(t, err, ErrInvalidOptions)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// mirrored reports whether an RPC of method is sampled to be mirrored, see Mirror.
+func (p *pool) mirrored(method string) bool {
+	if !p.opt.MirrorMethod(method) {
+		return false
+	}
+	fraction := p.opt.MirrorFraction
+	return fraction == 0 || fraction == 1 || p.random() < fraction
+}
+
+// mirrorInterceptor duplicates the sampled unary RPCs onto Mirror, it's the
+// first interceptor so the mirrored RPCs carry only the callers' metadata.
+func (pc *physicalConn) mirrorInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if p := pc.pool; p.mirrored(method) {
+		p.mirror(ctx, pc.slot, method, req)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// mirror sends a copy of req to Mirror in background and discards the response.
+// the call options aren't passed as they may write to the caller's variables.
+func (p *pool) mirror(ctx context.Context, slot int, method string, req interface{}) {
+	// the caller may reuse req once its RPC returns, so it's copied up front.
+	m, ok := message(req)
+	if !ok {
+		return
+	}
+	args := proto.Clone(m)
+	if int(atomic.AddInt32(&p.mirroring, 1)) > p.opt.Mirror.Capacity().TotalStreams {
+		atomic.AddInt32(&p.mirroring, -1)
+		return
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = p.clock.Now().Add(DefaultMirrorTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	p.spawn("mirror", slot, func() {
+		defer atomic.AddInt32(&p.mirroring, -1)
+		defer cancel()
+		// any response decodes into Empty, its fields are kept as unknown ones.
+		_ = p.opt.Mirror.Invoke(ctx, method, args, new(emptypb.Empty))
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMirror(t *testing.T) {
+	type mirrored struct {
+		method  string
+		message string
+		md      metadata.MD
+	}
+	incoming := make(chan mirrored, 4)
+	server := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		incoming <- mirrored{info.FullMethod, string(req.(*pb.EchoRequest).Message), md}
+		return handler(ctx, req)
+	})
+	shadow, err := New(startEchoServer(t, server), DefaultOptions)
+	require.NoError(t, err)
+	defer shadow.Close()
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.Metadata = metadata.Pairs("client-id", "billing")
+	opt.Mirror = shadow
+	opt.MirrorMethod = func(method string) bool { return method == "/pb.Echo/Say" }
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "request-id", "42")
+	req, res := &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{}
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", req, res))
+	require.EqualValues(t, "hi", string(res.Message))
+	// the request reused by the caller doesn't change the mirrored one
+	req.Message = []byte("changed")
+
+	m := <-incoming
+	require.Equal(t, "/pb.Echo/Say", m.method)
+	require.Equal(t, "hi", m.message)
+	require.Equal(t, []string{"42"}, m.md.Get("request-id"))
+	require.Empty(t, m.md.Get("client-id"))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&p.(*pool).mirroring) == 0 }, time.Second, time.Millisecond)
+
+	// the methods not selected aren't mirrored
+	opt.MirrorMethod = func(string) bool { return false }
+	q, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer q.Close()
+	require.NoError(t, q.Invoke(ctx, "/pb.Echo/Say", req, res))
+	select {
+	case m := <-incoming:
+		t.Fatalf("unexpected mirrored rpc: %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMirrorOptions(t *testing.T) {
+	opt := DefaultOptions
+	opt.Mirror = &pool{}
+	_, err := New(*endpoint, opt)
+	require.True(t, errors.Is(err, ErrInvalidOptions))
+
+	opt.MirrorMethod = func(string) bool { return true }
+	opt.MirrorFraction = 1.5
+	_, err = New(*endpoint, opt)
+	require.True(t, errors.Is(err, ErrInvalidOptions))
+}
@@ -0,0 +1,650 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// MultiPool is a pool spreading its connections over multiple endpoints,
+// every endpoint holds its own pool created with the same options.
+type MultiPool interface {
+	Pool
+
+	// Warnings returns the endpoints that failed when the pool is created, they
+	// are left out of the pool.
+	Warnings() []EndpointError
+
+	// GetEndpoint is like GetContext but checks out a connection to the endpoint
+	// of address, for the RPCs that must target a particular instance. a failed
+	// endpoint is dialed again, and joins the pool if it succeeds. the addresses
+	// the pool isn't created with are ErrUnknownEndpoint.
+	GetEndpoint(ctx context.Context, address string) (Conn, error)
+
+	// Block excludes the endpoint of address from the pool for d, or until it's
+	// unblocked when d is zero, e.g. a known-bad instance during an incident. its
+	// connections are drained, and it's dialed again once it's unblocked.
+	Block(address string, d time.Duration) error
+
+	// Unblock lifts the Block of the endpoint of address.
+	Unblock(address string) error
+
+	// Allow restricts the pool to the endpoints of addresses, the others are
+	// excluded like Block. no addresses lifts the restriction.
+	Allow(addresses ...string) error
+}
+
+// ErrUnknownEndpoint is the error resulting if the address isn't an endpoint
+// of the MultiPool.
+var ErrUnknownEndpoint = errors.New("unknown endpoint")
+
+// EndpointError is the error of an endpoint of a MultiPool.
+type EndpointError struct {
+	Address string
+	Err     error
+}
+
+func (e EndpointError) Error() string {
+	return fmt.Sprintf("endpoint %s: %v", e.Address, e.Err)
+}
+
+func (e EndpointError) Unwrap() error {
+	return e.Err
+}
+
+// EndpointState is the state of an endpoint of a MultiPool.
+type EndpointState int
+
+const (
+	// EndpointReady is selected by Get.
+	EndpointReady EndpointState = iota
+
+	// EndpointCircuitOpen has failed CircuitFailures Gets recently, it isn't
+	// selected until CircuitCooldown passes.
+	EndpointCircuitOpen
+
+	// EndpointFailed has failed when the pool is created, it's left out of the pool.
+	EndpointFailed
+
+	// EndpointBlocked is blocked or not allowed, see MultiPool.Block.
+	EndpointBlocked
+)
+
+func (s EndpointState) String() string {
+	switch s {
+	case EndpointReady:
+		return "ready"
+	case EndpointCircuitOpen:
+		return "circuit-open"
+	case EndpointFailed:
+		return "failed"
+	case EndpointBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("EndpointState(%d)", int(s))
+}
+
+// EndpointStats is the state of an endpoint of a MultiPool.
+type EndpointStats struct {
+	Address string
+	State   EndpointState
+
+	// Current is the number of physical connections to the endpoint.
+	Current int
+
+	// Ref is the number of logic connections checked out of the endpoint.
+	Ref int
+
+	// Flaps is the number of flaps of the endpoint, see FlapThreshold.
+	Flaps int
+
+	// BytesSent and BytesReceived are the bytes on the wire to the endpoint, see
+	// TrackUsage.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// endpointPool is an endpoint of multiPool and its pool.
+type endpointPool struct {
+	address string
+	pool    *pool
+
+	// the decayed count of failed Gets.
+	failures decayCounter
+
+	// atomic, the unix nano time until the circuit is open.
+	openUntil int64
+}
+
+func (e *endpointPool) state(now time.Time) EndpointState {
+	if now.UnixNano() < atomic.LoadInt64(&e.openUntil) {
+		return EndpointCircuitOpen
+	}
+	return EndpointReady
+}
+
+// record records the result of a Get by ctx, the circuit is opened once the
+// decayed count of failed Gets reaches CircuitFailures. the failures of a ctx
+// done, or of the endpoint closing, aren't the backend's, they aren't counted.
+func (e *endpointPool) record(ctx context.Context, err error) {
+	opt := e.pool.opt
+	if err == nil || opt.CircuitFailures <= 0 || ctx.Err() != nil ||
+		errors.Is(err, ErrClosed) || errors.Is(err, ErrClosing) || errors.Is(err, context.Canceled) {
+		return
+	}
+	now := e.pool.clock.Now()
+	if !reached(e.failures.add(now, 1, e.pool.errorHalfLife()), opt.CircuitFailures) {
+		return
+	}
+	cooldown := opt.CircuitCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+	e.failures.add(now, -float64(opt.CircuitFailures), e.pool.errorHalfLife())
+	atomic.StoreInt64(&e.openUntil, now.Add(cooldown).UnixNano())
+	log.Printf("endpoint circuit open: %s, cooldown: %v, err: %v\n", e.address, cooldown, err)
+}
+
+type multiPool struct {
+	// atomic, used to select endpoint round robin.
+	index uint32
+
+	// atomic, the BypassMode of the endpoints, see SetBypass.
+	bypass int32
+
+	// collapses the identical calls, nil unless CoalesceMethod is set.
+	coalesce *coalescer
+
+	opt   Options
+	clock Clock
+
+	// mu guards the fields below, the slices are replaced rather than modified
+	// so they can be used after unlocking.
+	mu sync.RWMutex
+
+	// the endpoints dialed successfully.
+	endpoints []*endpointPool
+
+	// the endpoints failed when the pool is created.
+	warnings []EndpointError
+
+	// the addresses the pool is created with.
+	addresses []string
+
+	// the sequence of the Block of the blocked addresses, see Block.
+	blocked  map[string]uint64
+	blockSeq uint64
+
+	// the allowed addresses, nil allows all of them, see Allow.
+	allowed map[string]bool
+
+	// the endpoints excluded and still draining.
+	excluded map[*endpointPool]struct{}
+
+	closed bool
+}
+
+// NewMulti return a connection pool spreading over addresses. It succeeds if
+// at least one of the addresses is dialed and connects within DialTimeout, the
+// failed ones are reported by Warnings, see probe.
+func NewMulti(addresses []string, option Options) (MultiPool, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("invalid address settings")
+	}
+
+	mp := &multiPool{
+		opt:       option,
+		clock:     option.Clock,
+		addresses: append([]string(nil), addresses...),
+		blocked:   make(map[string]uint64),
+		excluded:  make(map[*endpointPool]struct{}),
+	}
+	mp.coalesce = newCoalescer(option.CoalesceMethod, func(f func()) { mp.spawn("coalesce", f) })
+	if mp.clock == nil {
+		mp.clock = realClock{}
+	}
+	for _, address := range addresses {
+		p, err := New(address, option)
+		if err != nil {
+			mp.warnings = append(mp.warnings, EndpointError{Address: address, Err: err})
+			continue
+		}
+		mp.endpoints = append(mp.endpoints, &endpointPool{address: address, pool: p.(*pool)})
+	}
+	mp.probe()
+	if len(mp.endpoints) == 0 {
+		errs := make([]error, 0, len(mp.warnings))
+		for _, w := range mp.warnings {
+			errs = append(errs, w)
+		}
+		return nil, fmt.Errorf("no endpoint is reachable: %w", errors.Join(errs...))
+	}
+	for _, w := range mp.warnings {
+		log.Printf("new multi pool warning: %v\n", w)
+	}
+	return mp, nil
+}
+
+// probe probes the endpoints concurrently, the ones failing are closed and left
+// out with a warning.
+func (mp *multiPool) probe() {
+	errs := make([]error, len(mp.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range mp.endpoints {
+		wg.Add(1)
+		go func(i int, e *endpointPool) {
+			defer wg.Done()
+			errs[i] = e.pool.probe()
+		}(i, e)
+	}
+	wg.Wait()
+	reachable := make([]*endpointPool, 0, len(mp.endpoints))
+	for i, e := range mp.endpoints {
+		if errs[i] != nil {
+			e.pool.Close()
+			mp.warnings = append(mp.warnings, EndpointError{Address: e.address, Err: errs[i]})
+			continue
+		}
+		reachable = append(reachable, e)
+	}
+	mp.endpoints = reachable
+}
+
+// probe connects the first connection of p, the dialers such as grpc.NewClient
+// don't, and waits for it to be ready within DialTimeout, or the DialTimeout
+// constant if it isn't set. it fails as soon as the connection fails, e.g. it's
+// refused.
+func (p *pool) probe() error {
+	timeout := p.opt.DialTimeout
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+
+	slots := p.slots()
+	if len(slots) == 0 {
+		return nil
+	}
+	cc := slots[0].cc.Load()
+	if cc == nil {
+		return nil
+	}
+	cc.Connect()
+	for state := cc.GetState(); state != connectivity.Ready; state = cc.GetState() {
+		if state == connectivity.TransientFailure || state == connectivity.Shutdown {
+			return fmt.Errorf("probe %s: connection is %v", p.address, state)
+		}
+		if !cc.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("probe %s: connection is %v: %w", p.address, state, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// next returns the endpoints in the order to be tried, the ones whose circuit
+// is open are tried last.
+func (mp *multiPool) next() []*endpointPool {
+	endpoints, _ := mp.snapshot()
+	n := len(endpoints)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&mp.index, 1) % uint32(n))
+	now := mp.clock.Now()
+	order := make([]*endpointPool, 0, n)
+	var open []*endpointPool
+	for i := 0; i < n; i++ {
+		e := endpoints[(start+i)%n]
+		if e.state(now) == EndpointCircuitOpen {
+			open = append(open, e)
+			continue
+		}
+		order = append(order, e)
+	}
+	return append(order, open...)
+}
+
+// Get see Pool interface.
+func (mp *multiPool) Get() (Conn, error) {
+	return mp.GetContext(context.Background())
+}
+
+// GetContext see Pool interface. the endpoints are selected round robin, the
+// next endpoint is tried if the selected one fails.
+func (mp *multiPool) GetContext(ctx context.Context) (Conn, error) {
+	conn, _, err := mp.GetDetailed(ctx)
+	return conn, err
+}
+
+// GetDetailed see Pool interface. the info is of the endpoint the connection is
+// checked out of, the Wait covers the endpoints tried before.
+func (mp *multiPool) GetDetailed(ctx context.Context) (Conn, AcquireInfo, error) {
+	start := mp.clock.Now()
+	var hinted *endpointPool
+	if mp.opt.RouteHint != nil {
+		hinted = mp.hinted(ctx)
+	}
+	var info AcquireInfo
+	var err error
+	if hinted != nil {
+		var conn Conn
+		conn, info, err = hinted.pool.GetDetailed(ctx)
+		hinted.record(ctx, err)
+		if err == nil {
+			info.Wait = mp.clock.Now().Sub(start)
+			return conn, info, nil
+		}
+	}
+
+	for _, e := range mp.next() {
+		// the other endpoints would fail by ctx too
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if e == hinted {
+			continue
+		}
+		var conn Conn
+		conn, info, err = e.pool.GetDetailed(ctx)
+		e.record(ctx, err)
+		if err == nil {
+			info.Wait = mp.clock.Now().Sub(start)
+			return conn, info, nil
+		}
+	}
+	if err == nil {
+		err = ErrNoEndpoint
+	}
+	info.Wait = mp.clock.Now().Sub(start)
+	return nil, info, err
+}
+
+// hinted returns the endpoint of RouteHint, nil if there is none or its circuit
+// is open.
+func (mp *multiPool) hinted(ctx context.Context) *endpointPool {
+	address := mp.opt.RouteHint(ctx)
+	if address == "" {
+		return nil
+	}
+	endpoints, _ := mp.snapshot()
+	for _, e := range endpoints {
+		if e.address == address && e.state(mp.clock.Now()) == EndpointReady {
+			return e
+		}
+	}
+	return nil
+}
+
+// GetEndpoint see MultiPool interface.
+func (mp *multiPool) GetEndpoint(ctx context.Context, address string) (Conn, error) {
+	if mp.isExcluded(address) {
+		return nil, ErrBlockedEndpoint
+	}
+	e, err := mp.endpoint(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := e.pool.GetContext(ctx)
+	e.record(ctx, err)
+	return conn, err
+}
+
+// endpoint returns the endpoint of address, a failed one is dialed again.
+func (mp *multiPool) endpoint(address string) (*endpointPool, error) {
+	mp.mu.RLock()
+	for _, e := range mp.endpoints {
+		if e.address == address {
+			mp.mu.RUnlock()
+			return e, nil
+		}
+	}
+	mp.mu.RUnlock()
+	if !mp.failed(address) {
+		return nil, ErrUnknownEndpoint
+	}
+
+	// dial without the lock held, the other endpoints are in use meanwhile
+	p, err := mp.dialEndpoint(address)
+	if err != nil {
+		return nil, EndpointError{Address: address, Err: err}
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.closed {
+		p.Close()
+		return nil, ErrClosed
+	}
+	for _, e := range mp.endpoints {
+		if e.address == address {
+			p.Close()
+			return e, nil
+		}
+	}
+	e := &endpointPool{address: address, pool: p}
+	e.pool.SetBypass(BypassMode(atomic.LoadInt32(&mp.bypass)))
+	warnings := make([]EndpointError, 0, len(mp.warnings))
+	for _, w := range mp.warnings {
+		if w.Address != address {
+			warnings = append(warnings, w)
+		}
+	}
+	mp.endpoints = append(mp.endpoints[:len(mp.endpoints):len(mp.endpoints)], e)
+	mp.warnings = warnings
+	log.Printf("multi pool endpoint recovered: %s\n", address)
+	return e, nil
+}
+
+// dialEndpoint creates the pool of address and probes it like NewMulti, it's
+// closed if the probe fails.
+func (mp *multiPool) dialEndpoint(address string) (*pool, error) {
+	p, err := New(address, mp.opt)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.(*pool).probe(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p.(*pool), nil
+}
+
+// failed reports whether address is an endpoint failed when the pool is created.
+func (mp *multiPool) failed(address string) bool {
+	_, warnings := mp.snapshot()
+	for _, w := range warnings {
+		if w.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns the endpoints and warnings, they must not be modified.
+func (mp *multiPool) snapshot() ([]*endpointPool, []EndpointError) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.endpoints, mp.warnings
+}
+
+// Invoke see grpc.ClientConnInterface.
+func (mp *multiPool) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	return invoke(ctx, mp, mp.opt.CallTimeout, method, args, reply, opts...)
+}
+
+// NewStream see grpc.ClientConnInterface.
+func (mp *multiPool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return newStream(ctx, mp, mp.opt.newStreamRetries(), desc, method, opts...)
+}
+
+// Close see Pool interface.
+func (mp *multiPool) Close() error {
+	mp.mu.Lock()
+	mp.closed = true
+	excluded := make([]*endpointPool, 0, len(mp.excluded))
+	for e := range mp.excluded {
+		excluded = append(excluded, e)
+	}
+	mp.mu.Unlock()
+	endpoints, _ := mp.snapshot()
+	for _, e := range append(endpoints, excluded...) {
+		e.pool.Close()
+	}
+	return nil
+}
+
+// Drain see Pool interface. the endpoints are drained concurrently.
+func (mp *multiPool) Drain(ctx context.Context) error {
+	endpoints, _ := mp.snapshot()
+	var wg sync.WaitGroup
+	errs := make([]error, len(endpoints))
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func(i int, e *endpointPool) {
+			defer wg.Done()
+			errs[i] = e.pool.Drain(ctx)
+		}(i, e)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Options see Pool interface. they are the options of every endpoint.
+func (mp *multiPool) Options() Options {
+	return mp.opt.derive().clone()
+}
+
+// Status see Pool interface.
+func (mp *multiPool) Status() string {
+	endpoints, _ := mp.snapshot()
+	status := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		status = append(status, e.pool.Status())
+	}
+	return strings.Join(status, "; ")
+}
+
+// Healthy see Pool interface. the pool is healthy if any of its endpoints is.
+func (mp *multiPool) Healthy() bool {
+	endpoints, _ := mp.snapshot()
+	for _, e := range endpoints {
+		if e.pool.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Capacity see Pool interface. the capacities are summed over the endpoints.
+func (mp *multiPool) Capacity() StreamCapacity {
+	endpoints, _ := mp.snapshot()
+	var capacity StreamCapacity
+	for _, e := range endpoints {
+		c := e.pool.Capacity()
+		capacity.Connections += c.Connections
+		capacity.TotalStreams += c.TotalStreams
+		if capacity.StreamsPerConn == 0 || c.StreamsPerConn < capacity.StreamsPerConn {
+			capacity.StreamsPerConn = c.StreamsPerConn
+		}
+	}
+	return capacity
+}
+
+// Stats see Pool interface. the counts are summed over the endpoints.
+func (mp *multiPool) Stats() Stats {
+	endpoints, _ := mp.snapshot()
+	var stats Stats
+	var capacity int
+	addresses := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		s := e.pool.Stats()
+		addresses = append(addresses, s.Address)
+		stats.Current += s.Current
+		stats.Ref += s.Ref
+		stats.Expired += s.Expired
+		stats.Draining += s.Draining
+		stats.Waiting += s.Waiting
+		stats.Dialing += s.Dialing
+		stats.Growing += s.Growing
+		stats.Flaps += s.Flaps
+		stats.Disconnects += s.Disconnects
+		stats.KeepaliveTimeouts += s.KeepaliveTimeouts
+		stats.GoAways += s.GoAways
+		stats.BytesSent += s.BytesSent
+		stats.BytesReceived += s.BytesReceived
+		stats.AgedStreams += s.AgedStreams
+		stats.Streams = append(stats.Streams, s.Streams...)
+		stats.RejectProbability = math.Max(stats.RejectProbability, s.RejectProbability)
+		if stats.StreamLimit == 0 || s.StreamLimit < stats.StreamLimit {
+			stats.StreamLimit = s.StreamLimit
+		}
+		capacity += e.pool.opt.MaxActive * e.pool.opt.MaxConcurrentStreams
+		stats.Options = s.Options
+		stats.Fingerprint = s.Fingerprint
+	}
+	stats.Address = strings.Join(addresses, ",")
+	stats.Degraded = !mp.Healthy()
+	if capacity > 0 {
+		stats.Utilization = float64(stats.Ref) / float64(capacity)
+	}
+	stats.Endpoints = mp.endpointStats()
+	return stats
+}
+
+func (mp *multiPool) endpointStats() []EndpointStats {
+	endpoints, warnings := mp.snapshot()
+	now := mp.clock.Now()
+	stats := make([]EndpointStats, 0, len(endpoints)+len(warnings))
+	for _, e := range endpoints {
+		s := e.pool.Stats()
+		stats = append(stats, EndpointStats{
+			Address:       e.address,
+			State:         e.state(now),
+			Current:       s.Current,
+			Ref:           s.Ref,
+			Flaps:         s.Flaps,
+			BytesSent:     s.BytesSent,
+			BytesReceived: s.BytesReceived,
+		})
+	}
+	for _, w := range warnings {
+		if !mp.isExcluded(w.Address) {
+			stats = append(stats, EndpointStats{Address: w.Address, State: EndpointFailed})
+		}
+	}
+	for _, address := range mp.addresses {
+		if mp.isExcluded(address) {
+			stats = append(stats, EndpointStats{Address: address, State: EndpointBlocked})
+		}
+	}
+	return stats
+}
+
+// Warnings see MultiPool interface.
+func (mp *multiPool) Warnings() []EndpointError {
+	_, warnings := mp.snapshot()
+	return append([]EndpointError(nil), warnings...)
+}
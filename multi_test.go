@@ -0,0 +1,356 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// failingDial fails to dial the addresses in bad.
+func failingDial(bad ...string) func(req DialRequest) (*grpc.ClientConn, error) {
+	return func(req DialRequest) (*grpc.ClientConn, error) {
+		for _, address := range bad {
+			if req.Target == address {
+				return nil, errors.New("unreachable")
+			}
+		}
+		return DialTest(req.Target)
+	}
+}
+
+func TestNewMulti(t *testing.T) {
+	a, b := startEchoServer(t), startEchoServer(t)
+	opt := DefaultOptions
+	opt.DialFunc = failingDial("127.0.0.1:50002")
+
+	addresses := []string{a, b, "127.0.0.1:50002"}
+	mp, err := NewMulti(addresses, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+	// the addresses aren't shared with the caller
+	addresses[0] = "127.0.0.1:50003"
+	require.Equal(t, a, mp.(*multiPool).addresses[0])
+
+	warnings := mp.Warnings()
+	require.Len(t, warnings, 1)
+	require.EqualValues(t, "127.0.0.1:50002", warnings[0].Address)
+
+	stats := mp.Stats()
+	require.EqualValues(t, 2*opt.MaxIdle, stats.Current)
+
+	conn1, err := mp.Get()
+	require.NoError(t, err)
+	defer conn1.Close()
+	conn2, err := mp.Get()
+	require.NoError(t, err)
+	defer conn2.Close()
+	require.NotEqual(t, conn1.(*conn).pool.address, conn2.(*conn).pool.address)
+	require.EqualValues(t, 2, mp.Stats().Ref)
+}
+
+func TestNewMultiProbe(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := listen.Addr().String()
+	require.NoError(t, listen.Close())
+
+	// the default dialer is lazy, the endpoint refusing the connection is left out
+	reachable := startEchoServer(t)
+	mp, err := NewMulti([]string{reachable, unreachable}, DefaultOptions)
+	require.NoError(t, err)
+	defer mp.Close()
+	warnings := mp.Warnings()
+	require.Len(t, warnings, 1)
+	require.Equal(t, unreachable, warnings[0].Address)
+	require.Equal(t, EndpointFailed, mp.Stats().Endpoints[1].State)
+	for i := 0; i < 4; i++ {
+		c, info, err := mp.GetDetailed(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, reachable, info.Endpoint)
+		require.NoError(t, c.Close())
+	}
+
+	_, err = NewMulti([]string{unreachable}, DefaultOptions)
+	require.Error(t, err)
+}
+
+func TestNewMultiUnreachable(t *testing.T) {
+	opt := DefaultOptions
+	opt.DialFunc = failingDial("127.0.0.1:50000", "127.0.0.1:50001")
+
+	_, err := NewMulti([]string{"127.0.0.1:50000", "127.0.0.1:50001"}, opt)
+	require.Error(t, err)
+
+	_, err = NewMulti(nil, opt)
+	require.Error(t, err)
+}
+
+func TestMultiEndpointStats(t *testing.T) {
+	a, b := startEchoServer(t), startEchoServer(t)
+	opt := DefaultOptions
+	opt.DialFunc = failingDial("127.0.0.1:50002")
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	opt.HardMaxConnections = 1
+	opt.CircuitFailures = 2
+
+	mp, err := NewMulti([]string{a, b, "127.0.0.1:50002"}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	stats := mp.Stats().Endpoints
+	require.Len(t, stats, 3)
+	require.EqualValues(t, EndpointReady, stats[0].State)
+	require.EqualValues(t, EndpointReady, stats[1].State)
+	require.EqualValues(t, EndpointFailed, stats[2].State)
+	require.EqualValues(t, "127.0.0.1:50002", stats[2].Address)
+
+	// every endpoint is exhausted after two Gets, then the circuits open
+	for i := 0; i < 6; i++ {
+		mp.Get()
+	}
+	stats = mp.Stats().Endpoints
+	require.EqualValues(t, EndpointCircuitOpen, stats[0].State)
+	require.EqualValues(t, EndpointCircuitOpen, stats[1].State)
+	require.EqualValues(t, 1, stats[0].Ref)
+	require.EqualValues(t, 1, stats[0].Current)
+	require.EqualValues(t, "circuit-open", stats[0].State.String())
+}
+
+func TestMultiCircuitCallerErrors(t *testing.T) {
+	a, b := startEchoServer(t), startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	opt.HardMaxConnections = 1
+	opt.Wait = true
+	opt.CircuitFailures = 1
+
+	mp, err := NewMulti([]string{a, b}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+	for i := 0; i < 2; i++ {
+		c, err := mp.Get()
+		require.NoError(t, err)
+		defer c.Close()
+	}
+
+	// the Get waiting until its deadline opens no circuit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = mp.GetContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	for _, e := range mp.Stats().Endpoints {
+		require.EqualValues(t, EndpointReady, e.State, e.Address)
+	}
+}
+
+func TestMultiGetEndpoint(t *testing.T) {
+	a, b := startEchoServer(t), startEchoServer(t)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := listen.Addr().String()
+	require.NoError(t, listen.Close())
+
+	var down int32 = 1
+	opt := DefaultOptions
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		if req.Target != b {
+			return DialTest(req.Target)
+		}
+		switch atomic.LoadInt32(&down) {
+		case 1:
+			return nil, errors.New("unreachable")
+		case 2:
+			return DialTest(refused)
+		}
+		return DialTest(req.Target)
+	}
+
+	mp, err := NewMulti([]string{a, b}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		c, err := mp.GetEndpoint(ctx, a)
+		require.NoError(t, err)
+		require.EqualValues(t, a, c.(*conn).pool.address)
+		require.NoError(t, c.Close())
+	}
+
+	_, err = mp.GetEndpoint(ctx, "127.0.0.1:50002")
+	require.ErrorIs(t, err, ErrUnknownEndpoint)
+
+	// the failed endpoint is dialed again, and joins the pool once it's reachable
+	_, err = mp.GetEndpoint(ctx, b)
+	var endpointErr EndpointError
+	require.ErrorAs(t, err, &endpointErr)
+	require.EqualValues(t, b, endpointErr.Address)
+
+	// dialed but refused, it's probed like NewMulti does
+	atomic.StoreInt32(&down, 2)
+	_, err = mp.GetEndpoint(ctx, b)
+	require.ErrorAs(t, err, &endpointErr)
+	require.Len(t, mp.Warnings(), 1)
+	require.EqualValues(t, EndpointFailed, mp.Stats().Endpoints[1].State)
+
+	atomic.StoreInt32(&down, 0)
+	c, err := mp.GetEndpoint(ctx, b)
+	require.NoError(t, err)
+	require.EqualValues(t, b, c.(*conn).pool.address)
+	require.NoError(t, c.Close())
+	require.Len(t, mp.Warnings(), 0)
+	require.Len(t, mp.Stats().Endpoints, 2)
+	require.EqualValues(t, EndpointReady, mp.Stats().Endpoints[1].State)
+}
+
+func TestMultiRouteHint(t *testing.T) {
+	a, b := startEchoServer(t), startEchoServer(t)
+	var leader atomic.Value
+	leader.Store(b)
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	opt.HardMaxConnections = 1
+	opt.RouteHint = func(context.Context) string {
+		return leader.Load().(string)
+	}
+
+	mp, err := NewMulti([]string{a, b}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	c1, err := mp.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, b, c1.(*conn).pool.address)
+
+	// the leader is exhausted, so the other endpoint is selected
+	c2, err := mp.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, a, c2.(*conn).pool.address)
+	require.NoError(t, c1.Close())
+	require.NoError(t, c2.Close())
+
+	leader.Store(a)
+	c, err := mp.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, a, c.(*conn).pool.address)
+	require.NoError(t, c.Close())
+}
+
+func TestMultiBlock(t *testing.T) {
+	first, other := startEchoServer(t), startEchoServer(t)
+	mp, err := NewMulti([]string{first, other}, DefaultOptions)
+	require.NoError(t, err)
+	defer mp.Close()
+	endpoints := func() map[string]bool {
+		seen := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			c, info, err := mp.GetDetailed(context.Background())
+			require.NoError(t, err)
+			seen[info.Endpoint] = true
+			require.NoError(t, c.Close())
+		}
+		return seen
+	}
+
+	// the checked out conn of the blocked endpoint drains
+	c, err := mp.GetEndpoint(context.Background(), first)
+	require.NoError(t, err)
+	require.NoError(t, mp.Block(first, 0))
+	require.Equal(t, map[string]bool{other: true}, endpoints())
+	_, err = mp.GetEndpoint(context.Background(), first)
+	require.Equal(t, ErrBlockedEndpoint, err)
+	require.Contains(t, mp.Stats().Endpoints, EndpointStats{Address: first, State: EndpointBlocked})
+	_, err = c.ClientConn()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	require.NoError(t, mp.Unblock(first))
+	require.Equal(t, map[string]bool{first: true, other: true}, endpoints())
+
+	// a temporary block
+	require.NoError(t, mp.Block(other, 10*time.Millisecond))
+	require.Equal(t, map[string]bool{first: true}, endpoints())
+	require.Eventually(t, func() bool {
+		return len(endpoints()) == 2
+	}, time.Second, time.Millisecond)
+
+	// the allowlist
+	require.NoError(t, mp.Allow(other))
+	require.Equal(t, map[string]bool{other: true}, endpoints())
+	require.NoError(t, mp.Block(other, 0))
+	_, err = mp.Get()
+	require.Equal(t, ErrNoEndpoint, err)
+	require.NoError(t, mp.Unblock(other))
+	require.NoError(t, mp.Allow())
+	require.Len(t, endpoints(), 2)
+
+	require.Equal(t, ErrUnknownEndpoint, mp.Allow("unknown:1"))
+	require.Equal(t, ErrUnknownEndpoint, mp.Block("unknown:1", 0))
+}
+
+func TestMultiBlockRestore(t *testing.T) {
+	first := startEchoServer(t)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	pb.RegisterEchoServer(s, &echoServer{})
+	go s.Serve(listen)
+	other := listen.Addr().String()
+
+	opt := DefaultOptions
+	opt.DrainGracePeriod = 20 * time.Millisecond
+	mp, err := NewMulti([]string{first, other}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+	nativePool := mp.(*multiPool)
+
+	// the drain of the blocked endpoint is bounded by its DrainGracePeriod
+	c, err := mp.GetEndpoint(context.Background(), other)
+	require.NoError(t, err)
+	require.NoError(t, mp.Block(other, 0))
+	require.Eventually(t, func() bool {
+		nativePool.mu.RLock()
+		defer nativePool.mu.RUnlock()
+		return len(nativePool.excluded) == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, c.Close())
+
+	// the unblocked endpoint is probed before it's restored
+	s.Stop()
+	var endpointErr EndpointError
+	require.ErrorAs(t, mp.Unblock(other), &endpointErr)
+	require.Equal(t, other, endpointErr.Address)
+	require.Len(t, mp.Warnings(), 1)
+	require.Contains(t, mp.Stats().Endpoints, EndpointStats{Address: other, State: EndpointFailed})
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// decayCounter is a counter decaying exponentially over time, so the events
+// long ago weigh less and less.
+type decayCounter struct {
+	mu    sync.Mutex
+	value float64
+	last  time.Time
+}
+
+// add adds n to the counter decayed by halfLife, and returns the new value.
+func (c *decayCounter) add(now time.Time, n float64, halfLife time.Duration) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.value = c.decayed(now, halfLife) + n
+	c.last = now
+	return c.value
+}
+
+// get returns the value of the counter decayed by halfLife.
+func (c *decayCounter) get(now time.Time, halfLife time.Duration) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.decayed(now, halfLife)
+}
+
+// reached reports whether the value of the counter, rounded to the nearest
+// integer, reaches n. the events in a burst decay a little in between, so the
+// exact sum would fall short of n.
+func reached(value float64, n int) bool {
+	return math.Round(value) >= float64(n)
+}
+
+func (c *decayCounter) decayed(now time.Time, halfLife time.Duration) float64 {
+	if c.value == 0 || halfLife <= 0 {
+		return c.value
+	}
+	return c.value * math.Pow(0.5, float64(now.Sub(c.last))/float64(halfLife))
+}
+
+// isConnError reports whether err points at the connection rather than the
+// application, such errors are counted for quarantine.
+func isConnError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// errorHalfLife returns the half life of the pool's error counters.
+func (p *pool) errorHalfLife() time.Duration {
+	if p.opt.ErrorHalfLife > 0 {
+		return p.opt.ErrorHalfLife
+	}
+	return DefaultErrorHalfLife
+}
+
+// unaryInterceptor observes the unary RPCs on pc, for the latency SLA and the
+// error quarantine.
+func (pc *physicalConn) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	clock := pc.pool.clock
+	start := clock.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	pc.observe(ctx, clock.Now().Sub(start), err)
+	return err
+}
+
+// observe records the latency and error of an RPC on pc, pc is evicted when
+// it violates the latency SLA or has too many recent errors. the errors of the
+// RPCs whose ctx is done are the caller's, they aren't counted.
+func (pc *physicalConn) observe(ctx context.Context, d time.Duration, err error) {
+	p := pc.pool
+	if p.opt.SLALatency > 0 {
+		window := p.opt.SLAWindow
+		if window <= 0 {
+			window = DefaultSLAWindow
+		}
+		if pc.track.latency.observe(p.clock.Now(), d, p.opt.SLALatency, window) {
+			p.evict(pc, "latency sla violated")
+		}
+	}
+	if p.opt.QuarantineErrors > 0 && isConnError(err) && ctx.Err() == nil {
+		if reached(pc.track.errors.add(p.clock.Now(), 1, p.errorHalfLife()), p.opt.QuarantineErrors) {
+			p.evict(pc, "too many errors: "+err.Error())
+		}
+	}
+}
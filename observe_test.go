@@ -0,0 +1,95 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDecayCounter(t *testing.T) {
+	var c decayCounter
+	now := time.Now()
+	require.EqualValues(t, 1, c.add(now, 1, time.Second))
+	require.EqualValues(t, 2, c.add(now, 1, time.Second))
+	require.InDelta(t, 1, c.get(now.Add(time.Second), time.Second), 1e-9)
+	require.InDelta(t, 1.5, c.add(now.Add(2*time.Second), 1, time.Second), 1e-9)
+}
+
+func TestQuarantine(t *testing.T) {
+	unavailable := grpc.UnaryInterceptor(func(context.Context, interface{}, *grpc.UnaryServerInfo,
+		grpc.UnaryHandler) (interface{}, error) {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	})
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.QuarantineErrors = 3
+	p, err := New(startEchoServer(t, unavailable), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		err := p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{})
+		require.EqualValues(t, codes.Unavailable, status.Code(err))
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&nativePool.liveConns()[0].attempts))
+
+	err = p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{})
+	require.EqualValues(t, codes.Unavailable, status.Code(err))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&nativePool.liveConns()[0].attempts) > 1
+	}, 3*time.Second, time.Millisecond)
+}
+
+func TestQuarantineCallerErrors(t *testing.T) {
+	slow := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return handler(ctx, req)
+	})
+
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.QuarantineErrors = 1
+	p, err := New(startEchoServer(t, slow), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	// the caller's own deadline isn't counted
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{})
+		cancel()
+		require.EqualValues(t, codes.DeadlineExceeded, status.Code(err))
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.EqualValues(t, 1, atomic.LoadInt32(&nativePool.liveConns()[0].attempts))
+}
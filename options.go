@@ -15,11 +15,23 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"runtime"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 )
 
 const (
@@ -51,13 +63,127 @@ const (
 	// MaxRecvMsgSize set max gRPC receive message size received from server.
 	// If any message size is larger than current value, an error will be reported from gRPC.
 	MaxRecvMsgSize = 4 << 30
+
+	// DefaultSLAWindow is the default duration SLALatency must be exceeded
+	// before the connection is replaced.
+	DefaultSLAWindow = 30 * time.Second
+
+	// DefaultHighUtilization is the default threshold of OnHighUtilization.
+	DefaultHighUtilization = 0.8
+
+	// DefaultHighUtilizationInterval is the default minimum interval of
+	// OnHighUtilization.
+	DefaultHighUtilizationInterval = time.Minute
+
+	// DefaultNewStreamRetries is the default number of retries of NewStream, they're
+	// off.
+	DefaultNewStreamRetries = 0
+
+	// DefaultScaleScheduleInterval is the default interval of ScaleSchedule.
+	DefaultScaleScheduleInterval = time.Minute
+
+	// DefaultFlapHoldDown is the default hold-down of the first flap.
+	DefaultFlapHoldDown = time.Second
+
+	// DefaultFlapMaxHoldDown is the default cap of the flap hold-down.
+	DefaultFlapMaxHoldDown = time.Minute
+
+	// DefaultErrorHalfLife is the default half life of the error counts.
+	DefaultErrorHalfLife = time.Minute
+
+	// DefaultHealthCheckTimeout is the default timeout of a health check request.
+	DefaultHealthCheckTimeout = time.Second
+
+	// DefaultProcsMaxIdle and DefaultProcsMaxActive cap the MaxIdle and
+	// MaxActive derived by ScaleByProcs.
+	DefaultProcsMaxIdle   = 32
+	DefaultProcsMaxActive = 256
+
+	// DefaultProcsConcurrentStreams is the MaxConcurrentStreams derived by
+	// ScaleByProcs, the limit most servers advertise.
+	DefaultProcsConcurrentStreams = 100
+
+	// DefaultDrainGracePeriod is the default grace period of HandleSignals.
+	DefaultDrainGracePeriod = 30 * time.Second
+
+	// DefaultCircuitCooldown is the default duration the circuit of an endpoint stays open.
+	DefaultCircuitCooldown = 5 * time.Second
+
+	// DefaultUsageReportInterval is the default interval of UsageReport.
+	DefaultUsageReportInterval = time.Minute
+
+	// DefaultWatchConcurrentStreams is the MaxConcurrentStreams of WatchMode when
+	// it's zero, the watch streams are mostly idle.
+	DefaultWatchConcurrentStreams = 1000
+
+	// DefaultAdaptiveStreamsBackoff is the default backoff ratio of the stream
+	// limit, see AdaptiveStreamsLatency.
+	DefaultAdaptiveStreamsBackoff = 0.9
+
+	// DefaultMirrorTimeout is the timeout of the mirrored RPCs whose callers set
+	// no deadline, see Mirror.
+	DefaultMirrorTimeout = 5 * time.Second
 )
 
 // Options are params for creating grpc connect pool.
 type Options struct {
 	// Dial is an application supplied function for creating and configuring a connection.
+	// When Dial and DialFunc are both nil, the pool dials like Dial function with the
+	// DialOptions derived from the options, e.g. StatsHandler.
+	//
+	// NOTE: Dial can't receive those DialOptions, so everything the pool installs
+	// on its connections is lost with it: StatsHandler, Metadata, TestOnReturn,
+	// MaxStreamRate, Compressors, BeforeDial and the detection of the disconnects,
+	// among others. Use DialFunc appending DialRequest.DialOptions instead.
 	Dial func(address string) (*grpc.ClientConn, error)
 
+	// DialFunc is like Dial but receives the full DialRequest, it takes precedence
+	// over Dial when both are set.
+	DialFunc func(req DialRequest) (*grpc.ClientConn, error)
+
+	// DialInterface dials the connections of wrappers rather than concrete
+	// *grpc.ClientConn values, e.g. instrumented, in-memory or service mesh SDK
+	// connections, closer is closed once the pool closes the connection. they're
+	// managed through DialTransport, see it. ctx may be canceled once it returns,
+	// see DialRequest.Ctx. Dial and DialFunc take precedence.
+	DialInterface func(ctx context.Context, target string) (cc grpc.ClientConnInterface, closer io.Closer, err error)
+
+	// BeforeDial runs before every dial of the pool, e.g. to fetch the current
+	// credentials the dial uses. it covers the dials of the pool only, not the
+	// re-connects grpc makes within a connection, so a credential fixed at the
+	// dial, e.g. grpc.WithPerRPCCredentials with a fresh token, still expires
+	// during the connection's life. the rotating credentials belong in a
+	// PerRPCCredentials refreshing its token itself, or a tls.Config with
+	// GetClientCertificate. the dial options it returns are appended to
+	// DialOptions of the DialRequest, they're applied by the default dialer and
+	// the DialFuncs honoring DialOptions, not by Dial. the dial fails with its
+	// error.
+	BeforeDial func(ctx context.Context, req DialRequest) ([]grpc.DialOption, error)
+
+	// MaxSendMsgSize overrides the MaxSendMsgSize of the default dialer when it's
+	// positive, it's used when neither Dial nor DialFunc is set.
+	MaxSendMsgSize int
+
+	// MaxRecvMsgSize overrides the MaxRecvMsgSize of the default dialer when it's
+	// positive, it's used when neither Dial nor DialFunc is set.
+	MaxRecvMsgSize int
+
+	// Codec is forced on all of the RPCs of the default dialer, e.g. for payloads
+	// that aren't protobuf. it's used when neither Dial nor DialFunc is set.
+	Codec encoding.Codec
+
+	// TransportCredentials secures the connections of the default dialer, e.g.
+	// credentials.NewTLS, they're plaintext when nil. it's used when neither Dial
+	// nor DialFunc is set.
+	TransportCredentials credentials.TransportCredentials
+
+	// EndpointTransportCredentials overrides TransportCredentials for the addresses
+	// of the endpoints, e.g. insecure.NewCredentials for the backends inside the
+	// mesh and TLS for the ones across the boundary, of a MultiPool or Manager.
+	// the addresses are canonicalized like the targets of Key, "backend" is
+	// "backend:443".
+	EndpointTransportCredentials map[string]credentials.TransportCredentials
+
 	// Maximum number of idle connections in the pool.
 	MaxIdle int
 
@@ -68,25 +194,795 @@ type Options struct {
 	// MaxConcurrentStreams limit on the number of concurrent streams to each single connection
 	MaxConcurrentStreams int
 
+	// TargetConcurrentStreams, MaxConnections and MinConnections express the capacity
+	// of the pool directly, when any of them is set MaxIdle, MaxActive and
+	// MaxConcurrentStreams are derived from them: MaxIdle is MinConnections (at least 1),
+	// MaxActive is MaxConnections and MaxConcurrentStreams is TargetConcurrentStreams
+	// packed onto MaxConnections. The unset ones keep the value of the old field,
+	// MaxIdle capped at MaxConnections.
+	TargetConcurrentStreams int
+
+	// MaxConnections is the maximum number of connections, see TargetConcurrentStreams.
+	MaxConnections int
+
+	// MinConnections is the number of connections kept open, see TargetConcurrentStreams.
+	MinConnections int
+
+	// ScaleByProcs derives the MaxIdle, MaxActive and MaxConcurrentStreams left
+	// zero from runtime.GOMAXPROCS rather than DefaultOptions, so the pools of
+	// small containers aren't over-provisioned and those of big hosts aren't
+	// starved: MaxIdle is GOMAXPROCS, MaxActive is 4 times that, capped by
+	// DefaultProcsMaxIdle and DefaultProcsMaxActive, and MaxConcurrentStreams is
+	// DefaultProcsConcurrentStreams. it's ignored when any of
+	// TargetConcurrentStreams, MaxConnections and MinConnections is set.
+	ScaleByProcs bool
+
+	// ScaleSchedule is consulted every ScaleScheduleInterval, the pool is scaled
+	// to the number of connections it returns by ScaleTo. so the known traffic
+	// spikes, e.g. top-of-hour batch jobs, find the connections dialed already.
+	ScaleSchedule func(now time.Time) int
+
+	// ScaleScheduleInterval is the interval of ScaleSchedule,
+	// DefaultScaleScheduleInterval is used when zero.
+	ScaleScheduleInterval time.Duration
+
+	// ShrinkCooldown is how long the pool keeps the connections it grows by, after
+	// each growth, before it shrinks back once they are idle, so the short periodic
+	// bursts of traffic don't make it grow and shrink over and over. When zero, it
+	// shrinks as soon as they are idle.
+	ShrinkCooldown time.Duration
+
 	// If Reuse is true and the pool is at the MaxActive limit, then Get() reuse
 	// the connection to return, If Reuse is false and the pool is at the MaxActive limit,
 	// create a one-time connection to return.
 	Reuse bool
+
+	// PackingStrategy is how Get selects one of the pool's connections for the
+	// streams, PackingRoundRobin by default.
+	PackingStrategy PackingStrategy
+
+	// ReuseOverflow hands out the one-time connections again while they are open
+	// and have less than MaxConcurrentStreams conns checked out, before dialing
+	// yet another one, If Reuse is false. a one-time connection is closed once
+	// none of its conns is checked out.
+	ReuseOverflow bool
+
+	// HardMaxConnections caps the number of connections the pool holds open at a
+	// given time, including one-time and replaced connections. Growth beyond it
+	// shares the existing connections, a one-time connection beyond it waits or
+	// fails depending on Wait. When zero, there is no cap.
+	HardMaxConnections int
+
+	// If Wait is true and the pool holds HardMaxConnections connections, Get waits
+	// for a connection to be closed, bounded by the ctx of GetContext. If Wait is
+	// false, Get returns ErrExhausted. the same goes for Budget.
+	Wait bool
+
+	// AcquireTimeout bounds how long Get waits for a free connection or the
+	// Budget when Wait is true, in addition to the ctx of GetContext, it returns
+	// ErrAcquireTimeout then. When zero, only the ctx bounds it.
+	AcquireTimeout time.Duration
+
+	// DialTimeout bounds how long a single dial may take, independently of
+	// AcquireTimeout: DialRequest.Ctx is done once it passes, and it's the minimum
+	// connect timeout of the default dialer. When zero, the dials are unbounded.
+	DialTimeout time.Duration
+
+	// SmokeTest calls the server reflection service through a connection once
+	// New dials the pool, to verify gRPC works end to end beyond the TCP and TLS
+	// handshakes. the server not registering reflection passes it, as the RPC
+	// completed. the result is in InitialDialReport, the pool isn't Healthy if it
+	// failed, until a Get succeeds. it's bounded by DialTimeout, or the
+	// DialTimeout constant when zero.
+	SmokeTest bool
+
+	// OnHighUtilization is called in its own goroutine when Get finds the stream
+	// utilization at least HighUtilization, or at least HighWaiters Gets waiting,
+	// at most once every HighUtilizationInterval. so services can alert or scale
+	// before the pool is saturated.
+	OnHighUtilization func(Stats)
+
+	// HighUtilization is the threshold of Stats.Utilization, DefaultHighUtilization
+	// is used when both HighUtilization and HighWaiters are zero.
+	HighUtilization float64
+
+	// HighWaiters is the threshold of Stats.Waiting.
+	HighWaiters int
+
+	// HighUtilizationInterval is the minimum interval of OnHighUtilization,
+	// DefaultHighUtilizationInterval is used when zero.
+	HighUtilizationInterval time.Duration
+
+	// MaxGetFailures is the number of consecutive failed Gets, e.g. dial errors or
+	// exhaustion, before the pool is degraded, see Pool.Healthy. the Gets failing
+	// because the pool is closed or their ctx is canceled aren't counted. When
+	// zero, the pool is never degraded.
+	MaxGetFailures int
+
+	// OnDegraded is called in its own goroutine with the last error when the pool
+	// is degraded.
+	OnDegraded func(err error, stats Stats)
+
+	// Compressors are the names of the registered compressors the RPCs on the
+	// pool's connections are sent with, in order of preference. a connection falls
+	// back to the next one, and eventually to none, once a unary RPC is rejected
+	// because its backend doesn't support the compressor, and the RPC is retried.
+	Compressors []string
+
+	// EndpointCompressors overrides Compressors for the addresses of the endpoints
+	// known to support different compressors. the addresses are canonicalized
+	// like the targets of Key.
+	EndpointCompressors map[string][]string
+
+	// NewStreamRetries is the number of times NewStream of the pool is retried on
+	// another connection if the stream can't be created because the connection
+	// has just died, the connection is evicted if its transport has failed. When
+	// zero, DefaultNewStreamRetries is used, when negative it isn't retried.
+	NewStreamRetries int
+
+	// ThrottleK enables the client-side adaptive throttling when positive, e.g. 2.
+	// the RPCs rejected with ResourceExhausted or Unavailable are tracked against
+	// the accepted ones, decayed by ErrorHalfLife, and Get fails with ErrThrottled
+	// with the probability max(0, (requests - ThrottleK*accepts) / (requests + 1)),
+	// so an overloaded backend isn't flooded with requests bound to be rejected.
+	ThrottleK float64
+
+	// AdaptiveStreamsLatency enables the AIMD concurrency limit of the pool when
+	// positive: the effective MaxConcurrentStreams of the connections starts at
+	// MaxConcurrentStreams, and is multiplied by AdaptiveStreamsBackoff whenever
+	// an RPC is slower than it or the backend is overloaded, with
+	// ResourceExhausted or DeadlineExceeded not caused by the caller's own ctx.
+	// it's increased by one up to MaxConcurrentStreams by the RPCs finishing in
+	// time on a connection having at least half of it in use. the conns checked
+	// out are capped at the effective limit of MaxActive connections, the Gets
+	// beyond it wait for a conn to be given back if Wait is set, or fail with
+	// ErrExhausted. the unary RPCs are timed to the end, the streams until
+	// they're created.
+	AdaptiveStreamsLatency time.Duration
+
+	// AdaptiveStreamsBackoff is the ratio the stream limit is backed off by, in
+	// (0, 1), DefaultAdaptiveStreamsBackoff when zero.
+	AdaptiveStreamsBackoff float64
+
+	// MaxStreamRate caps the streams each connection creates per second, the
+	// unary RPCs included, when positive, so a runaway caller loop can't trip
+	// the server's enforcement and poison the connection for the other callers.
+	// the RPCs beyond the rate wait their turn, or fail with ResourceExhausted
+	// right away if their ctx would expire first. one-time connections aren't
+	// capped.
+	MaxStreamRate float64
+
+	// MaxStreamBurst is the number of streams a connection creates at once
+	// beyond MaxStreamRate, a second of the rate (at least 1) when zero.
+	MaxStreamBurst int
+
+	// CallTimeout bounds the unary calls made through the pool's Invoke, Get wait
+	// included, when their ctx has no deadline, protecting the backends from
+	// unbounded calls. the streams aren't bounded, they are long-lived by nature.
+	// When zero, the calls are bounded by their ctx only.
+	CallTimeout time.Duration
+
+	// RetryBudget caps the retries of NewStreamRetries and the hedges of Hedge at
+	// a ratio of the requests. When nil, they aren't capped.
+	RetryBudget *RetryBudget
+
+	// Budget is shared by the pools with the same Budget, it caps their total
+	// connections like HardMaxConnections, and their total logic connections
+	// checked out. When nil, the pool doesn't share a budget.
+	Budget *Budget
+
+	// Faults injects the failures it's commanded to, for chaos testing the code
+	// handling the pool's failures in staging. When nil, no failure is injected.
+	Faults *Faults
+
+	// Registry is joined by the pool, listing it in the registry's metrics and
+	// debug page, e.g. DefaultRegistry. When nil, the pool isn't registered.
+	Registry *Registry
+
+	// BudgetWeight is the weight of the pool in its Budget, under contention the
+	// budget is shared in proportion to the weights. When zero, it's 1.
+	BudgetWeight int
+
+	// BudgetCritical reserves the weighted share of the pool in its Budget, the
+	// other pools can't use it even while the pool doesn't.
+	BudgetCritical bool
+
+	// CircuitFailures is the decayed count of failed Gets that opens the circuit of
+	// an endpoint of a MultiPool, see ErrorHalfLife, but those whose ctx is done or
+	// of the pool closing. the endpoint isn't selected until CircuitCooldown
+	// passes. When zero, the circuit never opens.
+	CircuitFailures int
+
+	// RouteHint is consulted on every Get of a MultiPool, it returns the address
+	// of the endpoint to prefer, e.g. the current leader discovered out-of-band,
+	// or "" for none. If the hinted endpoint's circuit is open or its Get fails,
+	// the endpoints are selected as usual.
+	RouteHint func(ctx context.Context) string
+
+	// CircuitCooldown is how long the circuit stays open, DefaultCircuitCooldown is
+	// used when zero.
+	CircuitCooldown time.Duration
+
+	// MaxCheckoutDuration is the longest time a connection is expected to be checked
+	// out, a checkout held longer is logged and counted in Status. When zero, there
+	// is no limit on the checkout duration.
+	MaxCheckoutDuration time.Duration
+
+	// If ForceReturn is true, a checkout held longer than MaxCheckoutDuration is given
+	// back to the pool's accounting, the underlying connection is left alive so the
+	// caller can still finish its calls.
+	ForceReturn bool
+
+	// DenyRawConn makes Conn.Value return nil and Conn.ClientConn fail with
+	// ErrRawConnDenied, so no code path escapes the pool's accounting with the
+	// raw *grpc.ClientConn. the conns are used as grpc.ClientConnInterface with
+	// InvokeOn and NewStreamOn instead.
+	DenyRawConn bool
+
+	// Identity tags the credential or identity the connections are dialed with,
+	// e.g. a tenant name. it's not used by the pool itself but passed to DialFunc
+	// in DialRequest.Options, so a dialer can pick the matching credentials.
+	Identity string
+
+	// Metadata is the static metadata identifying the client, e.g. client-id or
+	// build version, sent with every RPC on the pool's connections unless the RPC
+	// sets the same keys. it's also in the outgoing metadata of DialRequest.Ctx,
+	// so a dialer can include it in the connection establishment.
+	Metadata metadata.MD
+
+	// UtilizationHeader is opt-in, when set every RPC on the pool's connections
+	// carries the header of the name with the pool's current Stats.Utilization,
+	// e.g. "0.42", so cooperating servers can prefer shedding the clients that
+	// are overloaded themselves. the names starting with "grpc-" are reserved.
+	UtilizationHeader string
+
+	// Mirror is opt-in, when set a sampled fraction of the unary RPCs selected by
+	// MirrorMethod is duplicated onto Mirror, e.g. the pool of a new backend, and
+	// the responses are discarded, so the backend is shadow tested with the real
+	// traffic. the mirrored RPCs are sent in background with the outgoing metadata
+	// and the deadline of the callers, or DefaultMirrorTimeout, and dropped while
+	// the streams of Mirror are all in flight. Mirror must not be the pool itself.
+	Mirror Pool
+
+	// MirrorMethod selects the methods mirrored, it must be set with Mirror and
+	// should only select the idempotent ones.
+	MirrorMethod func(method string) bool
+
+	// MirrorFraction is the fraction of the selected RPCs mirrored, in [0, 1], all
+	// of them are mirrored when zero.
+	MirrorFraction float64
+
+	// CoalesceMethod is opt-in, the identical unary calls of the methods selected
+	// through the pool's Invoke collapse into one while it's in flight, e.g. the
+	// bursts of config fetches, so the hot keys load the backend once. the calls are
+	// identical if their method, call options, request and outgoing metadata are.
+	// the shared call is bounded by the deadline of the first caller, the call
+	// options writing to the callers' variables, e.g. grpc.Header, are dropped. the
+	// calls with their own grpc.PerRPCCredentials or grpc.OnFinish, or call options
+	// the pool doesn't know, aren't collapsed. it should only select the idempotent
+	// methods.
+	CoalesceMethod func(method string) bool
+
+	// StatsHandler is installed on every connection dialed by the pool, e.g. the
+	// otelgrpc client handler, so telemetry applies uniformly to the pool.
+	StatsHandler stats.Handler
+
+	// SLALatency is the p99 latency of unary RPCs a connection is expected to serve
+	// within. A connection exceeding it for SLAWindow is replaced by a newly dialed
+	// one, routing around degraded paths. When zero, latency is not tracked.
+	SLALatency time.Duration
+
+	// SLAWindow is how long SLALatency must be exceeded before the connection is
+	// replaced, DefaultSLAWindow is used when zero.
+	SLAWindow time.Duration
+
+	// QuarantineErrors is the decayed count of connection errors (Unavailable,
+	// DeadlineExceeded and Internal) of unary RPCs, but those of a ctx canceled or
+	// past its deadline, reaching it the connection is replaced by a newly dialed
+	// one. When zero, errors are not tracked.
+	QuarantineErrors int
+
+	// ErrorHalfLife is the half life of the error counts of QuarantineErrors and
+	// CircuitFailures, an error weighs half as much after it. DefaultErrorHalfLife
+	// is used when zero.
+	ErrorHalfLife time.Duration
+
+	// IdleTimeout is passed to grpc.WithIdleTimeout, a channel without RPCs for it
+	// drops to IDLE and closes its transports. the channels are re-warmed lazily
+	// when checked out, except for IdleKeepWarm of them. the health checks skip
+	// the IDLE channels. When zero, grpc's default is used, when negative the
+	// channels never go idle.
+	IdleTimeout time.Duration
+
+	// IdleKeepWarm is the number of the first slots whose channels are re-warmed
+	// by the keeper as soon as they drop to IDLE, see IdleTimeout.
+	IdleKeepWarm int
+
+	// TestOnBorrow verifies a connection idle for at least TestOnBorrowIdle before
+	// it's handed out by Get, catching e.g. the connections silently dropped by a
+	// NAT timeout at the cheapest point. the connection failing it is replaced,
+	// and Get hands out another one. When nil, the connections aren't verified.
+	TestOnBorrow func(cc *grpc.ClientConn, idleFor time.Duration) error
+
+	// TestOnBorrowIdle is how long a connection has no conns checked out before
+	// it's verified by TestOnBorrow.
+	TestOnBorrowIdle time.Duration
+
+	// TestOnReturn inspects a connection when a Conn is closed back into the
+	// pool, lastErr is the error of the last RPC finished on the connection, nil
+	// if it succeeded. the connection failing it is evicted rather than recycled,
+	// e.g. once it produced a transport error. When nil, it isn't inspected.
+	TestOnReturn func(cc *grpc.ClientConn, lastErr error) error
+
+	// BrokenPolicy is what happens to the connection of a Conn marked broken by
+	// Conn.MarkBroken once it's closed, BrokenReturn by default.
+	BrokenPolicy BrokenPolicy
+
+	// EvictLinger bounds how long an evicted connection which is still checked
+	// out is kept draining, excluded from selection, before it's closed under the
+	// in-flight RPCs. When zero, it's kept until all of its conns are given back.
+	EvictLinger time.Duration
+
+	// MaxStreamAge is the age of a stream beyond which it's logged, and canceled
+	// if CancelAgedStreams is set, catching the leaked server-streaming calls
+	// holding the connections forever. the ages of the active streams are in
+	// Stats.Streams. When zero, the streams aren't watched.
+	MaxStreamAge time.Duration
+
+	// CancelAgedStreams cancels the streams exceeding MaxStreamAge.
+	CancelAgedStreams bool
+
+	// DrainGracePeriod bounds how long the pool drains on a termination signal
+	// before it's closed anyway, see HandleSignals, and how long Close keeps the
+	// connections still checked out when OnDraining is set. DefaultDrainGracePeriod
+	// is used when zero.
+	DrainGracePeriod time.Duration
+
+	// LameDuckHeader is the key of the response header or trailer by which the
+	// servers signal impending shutdown at the application layer, e.g. "lame-duck".
+	// the connection receiving it with the value "true" is evicted, so it drains
+	// before the server goes away. When empty, the signal isn't recognized.
+	LameDuckHeader string
+
+	// WatchMode tunes the pool for watch-style workloads of many long-lived,
+	// mostly idle streams, the defaults assume short unary RPCs. the pool keeps
+	// MaxIdle connections and never grows by streams, MaxConcurrentStreams is
+	// DefaultWatchConcurrentStreams when zero, and the Gets beyond it are served
+	// as if MaxActive is reached, see Reuse. a rotated connection is drained once
+	// its replacement is ready, and kept until all of its conns are given back
+	// regardless of EvictLinger, so the watches are re-established on the
+	// replacement by OnDraining before it's closed.
+	WatchMode bool
+
+	// OnDraining is called before the pool closes a connection still checked out,
+	// when it's evicted or the pool is shut down, so the application can end its
+	// long-lived streams on the connection gracefully by the deadline instead of
+	// having them cut. the deadline is zero when the connection is kept until it's
+	// given back. it's called in its own goroutine, by Close with the deadline
+	// DrainGracePeriod from now, the connection is closed once it's given back or
+	// by the deadline.
+	OnDraining func(info ConnInfo, deadline time.Time)
+
+	// FlapThreshold is the lifetime under which an evicted connection is counted
+	// as a flap, e.g. of a flapping backend or middlebox. the slot of consecutive
+	// flaps is held down before it's dialed again, for FlapHoldDown doubled on
+	// every flap up to FlapMaxHoldDown, preventing churn storms. When zero, the
+	// flaps aren't detected.
+	FlapThreshold time.Duration
+
+	// FlapHoldDown is the hold-down of the first flap, DefaultFlapHoldDown is used
+	// when zero.
+	FlapHoldDown time.Duration
+
+	// FlapMaxHoldDown caps the hold-down, DefaultFlapMaxHoldDown is used when zero.
+	FlapMaxHoldDown time.Duration
+
+	// HealthCheckInterval is the interval the pool checks its connections with the
+	// grpc health checking protocol, an unhealthy connection is replaced by a newly
+	// dialed one. the connections answering RPCs within the last interval aren't
+	// checked, their liveness is proven already. When zero, the connections aren't
+	// checked.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckService is the service name sent in the health check requests.
+	HealthCheckService string
+
+	// HealthCheckTimeout is the timeout of a health check request,
+	// DefaultHealthCheckTimeout is used when zero.
+	HealthCheckTimeout time.Duration
+
+	// HealthCheckMetadata is sent with the health check requests, e.g. the auth
+	// tokens or routing headers required by the health endpoint.
+	HealthCheckMetadata metadata.MD
+
+	// UsageReport is called every UsageReportInterval with the usage of the pool's
+	// connections, counted by a stats.Handler the pool installs, for capacity
+	// planning and per-backend cost attribution. When nil, usage is not counted.
+	UsageReport func(usages []ConnUsage)
+
+	// UsageReportInterval is the interval of UsageReport, DefaultUsageReportInterval
+	// is used when zero.
+	UsageReportInterval time.Duration
+
+	// TrackUsage counts the usage of the pool's connections like UsageReport, and
+	// exposes it in Stats and the metrics.
+	TrackUsage bool
+
+	// StatsInterval is the interval the pool publishes a snapshot of its Stats,
+	// Stats then returns the latest snapshot without reading the counters of the
+	// Get hot path, for the scrapers polling thousands of pools every second.
+	// When zero, Stats reads the counters on every call.
+	StatsInterval time.Duration
+
+	// Clock is the time source of the pool, the real time is used when nil. it's
+	// replaced to simulate the pool, see the pooltest package.
+	Clock Clock
+
+	// Seed seeds the randomized decisions of the pool when non-zero, i.e. the
+	// throttling, the sampling of Mirror and the connections dropped by Faults,
+	// so the tests asserting on them are reproducible across runs. the global
+	// source is used when zero.
+	Seed int64
+
+	// LightweightMode disables the per-connection tracking of SLALatency,
+	// QuarantineErrors, UsageReport and TrackUsage, which are ignored, for the processes
+	// running thousands of pools. a connection then costs connBudget bytes of
+	// the pool, instead of connBudget plus trackingBudget, unless TestOnBorrow,
+	// TestOnReturn, HealthCheckInterval, MaxStreamRate or FlapThreshold is set.
+	LightweightMode bool
 }
 
+// ErrInvalidOptions is the error resulting if the Options of New are invalid,
+// it's wrapped with the option at fault.
+var ErrInvalidOptions = errors.New("invalid options")
+
 // DefaultOptions sets a list of recommended options for good performance.
 // Feel free to modify these to suit your needs.
 var DefaultOptions = Options{
-	Dial:                 Dial,
 	MaxIdle:              8,
 	MaxActive:            64,
 	MaxConcurrentStreams: 64,
 	Reuse:                true,
 }
 
+// derive returns the options with MaxIdle, MaxActive and MaxConcurrentStreams
+// derived from TargetConcurrentStreams, MaxConnections and MinConnections, or
+// those of DefaultOptions if none of them is set, the tracking options cleared
+// in LightweightMode, and the defaults of the enabled features applied.
+func (o Options) derive() Options {
+	if o.ScaleByProcs && o.TargetConcurrentStreams == 0 && o.MaxConnections == 0 && o.MinConnections == 0 {
+		o = o.scaleByProcs(runtime.GOMAXPROCS(0))
+	}
+	watchStreams := o.WatchMode && o.MaxConcurrentStreams == 0 && o.TargetConcurrentStreams == 0
+	if o.MaxIdle == 0 && o.MaxActive == 0 && o.MaxConcurrentStreams == 0 &&
+		o.TargetConcurrentStreams == 0 && o.MaxConnections == 0 && o.MinConnections == 0 {
+		o.MaxIdle = DefaultOptions.MaxIdle
+		o.MaxActive = DefaultOptions.MaxActive
+		o.MaxConcurrentStreams = DefaultOptions.MaxConcurrentStreams
+	}
+	if watchStreams {
+		o.MaxConcurrentStreams = DefaultWatchConcurrentStreams
+	}
+	if o.LightweightMode {
+		o.SLALatency = 0
+		o.QuarantineErrors = 0
+		o.UsageReport = nil
+		o.TrackUsage = false
+	}
+	o = o.defaults()
+	if o.TargetConcurrentStreams == 0 && o.MaxConnections == 0 && o.MinConnections == 0 {
+		return o
+	}
+	if o.MaxConnections > 0 {
+		o.MaxActive = o.MaxConnections
+	}
+	switch {
+	case o.MinConnections > 0:
+		o.MaxIdle = o.MinConnections
+	case o.MaxIdle <= 0:
+		o.MaxIdle = 1
+	case o.MaxActive > 0 && o.MaxIdle > o.MaxActive:
+		o.MaxIdle = o.MaxActive
+	}
+	if o.TargetConcurrentStreams > 0 && o.MaxActive > 0 {
+		o.MaxConcurrentStreams = (o.TargetConcurrentStreams + o.MaxActive - 1) / o.MaxActive
+	}
+	return o
+}
+
+// defaults returns the options with the zero durations and thresholds of the
+// enabled features set to their defaults, the disabled ones are left zero and
+// the negative ones to validate.
+func (o Options) defaults() Options {
+	if o.OnHighUtilization != nil {
+		if o.HighUtilization == 0 && o.HighWaiters == 0 {
+			o.HighUtilization = DefaultHighUtilization
+		}
+		if o.HighUtilizationInterval == 0 {
+			o.HighUtilizationInterval = DefaultHighUtilizationInterval
+		}
+	}
+	if (o.QuarantineErrors > 0 || o.CircuitFailures > 0 || o.ThrottleK > 0) && o.ErrorHalfLife == 0 {
+		o.ErrorHalfLife = DefaultErrorHalfLife
+	}
+	if o.SLALatency > 0 && o.SLAWindow == 0 {
+		o.SLAWindow = DefaultSLAWindow
+	}
+	if (o.HealthCheckInterval > 0 || o.BrokenPolicy == BrokenValidate) && o.HealthCheckTimeout == 0 {
+		o.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+	if o.CircuitFailures > 0 && o.CircuitCooldown == 0 {
+		o.CircuitCooldown = DefaultCircuitCooldown
+	}
+	if o.UsageReport != nil && o.UsageReportInterval == 0 {
+		o.UsageReportInterval = DefaultUsageReportInterval
+	}
+	if o.ScaleSchedule != nil && o.ScaleScheduleInterval == 0 {
+		o.ScaleScheduleInterval = DefaultScaleScheduleInterval
+	}
+	if o.FlapThreshold > 0 {
+		if o.FlapHoldDown == 0 {
+			o.FlapHoldDown = DefaultFlapHoldDown
+		}
+		if o.FlapMaxHoldDown == 0 {
+			o.FlapMaxHoldDown = DefaultFlapMaxHoldDown
+		}
+	}
+	if o.AdaptiveStreamsLatency > 0 && o.AdaptiveStreamsBackoff == 0 {
+		o.AdaptiveStreamsBackoff = DefaultAdaptiveStreamsBackoff
+	}
+	if o.DrainGracePeriod == 0 {
+		o.DrainGracePeriod = DefaultDrainGracePeriod
+	}
+	return o
+}
+
+func (o Options) newStreamRetries() int {
+	switch {
+	case o.NewStreamRetries > 0:
+		return o.NewStreamRetries
+	case o.NewStreamRetries < 0:
+		return 0
+	}
+	return DefaultNewStreamRetries
+}
+
+// DialRequest describes a single dial made by the pool.
+type DialRequest struct {
+	// Ctx bounds the dial only: it's canceled when the pool is closed, and if
+	// DialTimeout is set, once the dial returns or DialTimeout passes, so it
+	// mustn't be retained by the connection dialed. it carries the pprof labels
+	// of the pool's target and slot, and Metadata as the outgoing metadata.
+	Ctx context.Context
+
+	// Target is the server address of the pool.
+	Target string
+
+	// SlotIndex is the index of the pool's connection slot the connection is dialed
+	// for, it's -1 for a one-time connection.
+	SlotIndex int
+
+	// Attempt is the number of times the slot has been dialed since it's grown,
+	// including this one.
+	Attempt int
+
+	// Options are the options of the pool.
+	Options Options
+
+	// DialOptions are derived from Options by the pool, e.g. the StatsHandler.
+	// A custom DialFunc should append them to its own dial options.
+	DialOptions []grpc.DialOption
+}
+
+// AdaptDial adapts a Dial function to the DialFunc signature. DialRequest.DialOptions
+// are dropped, see Options.Dial.
+func AdaptDial(dial func(address string) (*grpc.ClientConn, error)) func(req DialRequest) (*grpc.ClientConn, error) {
+	return func(req DialRequest) (*grpc.ClientConn, error) {
+		return dial(req.Target)
+	}
+}
+
+// beforeDial wraps dial to run BeforeDial first, see Options.BeforeDial.
+func beforeDial(hook func(ctx context.Context, req DialRequest) ([]grpc.DialOption, error),
+	dial func(req DialRequest) (*grpc.ClientConn, error)) func(req DialRequest) (*grpc.ClientConn, error) {
+	return func(req DialRequest) (*grpc.ClientConn, error) {
+		opts, err := hook(req.Ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("before dial: %w", err)
+		}
+		req.DialOptions = append(req.DialOptions[:len(req.DialOptions):len(req.DialOptions)], opts...)
+		return dial(req)
+	}
+}
+
 // Dial return a grpc connection with defined configurations.
 func Dial(address string) (*grpc.ClientConn, error) {
-	return grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()),
+	return grpc.NewClient(address, defaultDialOptions()...)
+}
+
+// dialDefault is used when neither Dial nor DialFunc is set, it's Dial with
+// the DialOptions of req.
+func dialDefault(req DialRequest) (*grpc.ClientConn, error) {
+	opts := append(defaultDialOptions(), req.Options.defaultDialOptions()...)
+	if creds := req.Options.transportCredentials(req.Target); creds != nil {
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	}
+	return grpc.NewClient(req.Target, append(opts, req.DialOptions...)...)
+}
+
+// defaultDialOptions are the configurations of the default dialer overridden
+// by the options.
+func (o Options) defaultDialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if o.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(o.MaxSendMsgSize)))
+	}
+	if o.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(o.MaxRecvMsgSize)))
+	}
+	if o.Codec != nil {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.ForceCodec(o.Codec)))
+	}
+	if o.DialTimeout > 0 {
+		opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: o.DialTimeout,
+		}))
+	}
+	return opts
+}
+
+// scaleByProcs returns the options with the sizes left zero derived from procs,
+// see ScaleByProcs.
+func (o Options) scaleByProcs(procs int) Options {
+	if procs < 1 {
+		procs = 1
+	}
+	if o.MaxActive == 0 {
+		o.MaxActive = 4 * procs
+		if o.MaxActive > DefaultProcsMaxActive {
+			o.MaxActive = DefaultProcsMaxActive
+		}
+		if o.MaxActive < o.MaxIdle {
+			o.MaxActive = o.MaxIdle
+		}
+	}
+	if o.MaxIdle == 0 {
+		o.MaxIdle = procs
+		if o.MaxIdle > DefaultProcsMaxIdle {
+			o.MaxIdle = DefaultProcsMaxIdle
+		}
+		if o.MaxIdle > o.MaxActive && o.MaxActive > 0 {
+			o.MaxIdle = o.MaxActive
+		}
+	}
+	if o.MaxConcurrentStreams == 0 {
+		o.MaxConcurrentStreams = DefaultProcsConcurrentStreams
+	}
+	return o
+}
+
+// validate returns an ErrInvalidOptions describing the first invalid option.
+func (o Options) validate() error {
+	switch {
+	case o.MaxIdle <= 0:
+		return fmt.Errorf("%w: MaxIdle %d must be positive", ErrInvalidOptions, o.MaxIdle)
+	case o.MaxActive <= 0:
+		return fmt.Errorf("%w: MaxActive %d must be positive", ErrInvalidOptions, o.MaxActive)
+	case o.MaxIdle > o.MaxActive:
+		return fmt.Errorf("%w: MaxIdle %d exceeds MaxActive %d", ErrInvalidOptions, o.MaxIdle, o.MaxActive)
+	case o.MaxConcurrentStreams <= 0:
+		return fmt.Errorf("%w: MaxConcurrentStreams %d must be positive", ErrInvalidOptions,
+			o.MaxConcurrentStreams)
+	case o.HardMaxConnections < 0 || o.HardMaxConnections > 0 && o.HardMaxConnections < o.MaxIdle:
+		return fmt.Errorf("%w: HardMaxConnections %d must be zero or at least MaxIdle %d", ErrInvalidOptions,
+			o.HardMaxConnections, o.MaxIdle)
+	case o.AdaptiveStreamsBackoff < 0 || o.AdaptiveStreamsBackoff >= 1:
+		return fmt.Errorf("%w: AdaptiveStreamsBackoff %v must be in (0, 1)", ErrInvalidOptions,
+			o.AdaptiveStreamsBackoff)
+	case o.MaxStreamRate < 0 || o.MaxStreamBurst < 0:
+		return fmt.Errorf("%w: MaxStreamRate %v and MaxStreamBurst %d must not be negative", ErrInvalidOptions,
+			o.MaxStreamRate, o.MaxStreamBurst)
+	case strings.HasPrefix(strings.ToLower(o.UtilizationHeader), "grpc-"):
+		return fmt.Errorf("%w: UtilizationHeader %q is reserved", ErrInvalidOptions, o.UtilizationHeader)
+	case o.Mirror != nil && o.MirrorMethod == nil:
+		return fmt.Errorf("%w: MirrorMethod must be set with Mirror", ErrInvalidOptions)
+	case o.MirrorFraction < 0 || o.MirrorFraction > 1:
+		return fmt.Errorf("%w: MirrorFraction %v must be in [0, 1]", ErrInvalidOptions, o.MirrorFraction)
+	case !o.validCompressors():
+		return fmt.Errorf("%w: the compressors aren't all registered", ErrInvalidOptions)
+	}
+	// IdleTimeout is the only duration whose negative value means anything
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ScaleScheduleInterval", o.ScaleScheduleInterval},
+		{"ShrinkCooldown", o.ShrinkCooldown},
+		{"AcquireTimeout", o.AcquireTimeout},
+		{"DialTimeout", o.DialTimeout},
+		{"HighUtilizationInterval", o.HighUtilizationInterval},
+		{"AdaptiveStreamsLatency", o.AdaptiveStreamsLatency},
+		{"CallTimeout", o.CallTimeout},
+		{"CircuitCooldown", o.CircuitCooldown},
+		{"MaxCheckoutDuration", o.MaxCheckoutDuration},
+		{"SLALatency", o.SLALatency},
+		{"SLAWindow", o.SLAWindow},
+		{"ErrorHalfLife", o.ErrorHalfLife},
+		{"TestOnBorrowIdle", o.TestOnBorrowIdle},
+		{"EvictLinger", o.EvictLinger},
+		{"MaxStreamAge", o.MaxStreamAge},
+		{"DrainGracePeriod", o.DrainGracePeriod},
+		{"FlapThreshold", o.FlapThreshold},
+		{"FlapHoldDown", o.FlapHoldDown},
+		{"FlapMaxHoldDown", o.FlapMaxHoldDown},
+		{"HealthCheckInterval", o.HealthCheckInterval},
+		{"HealthCheckTimeout", o.HealthCheckTimeout},
+		{"UsageReportInterval", o.UsageReportInterval},
+		{"StatsInterval", o.StatsInterval},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("%w: %s %v must not be negative", ErrInvalidOptions, d.name, d.value)
+		}
+	}
+	if _, err := normalizeKeys("EndpointTransportCredentials", o.EndpointTransportCredentials,
+		o.strictTarget()); err != nil {
+		return err
+	}
+	_, err := normalizeKeys("EndpointCompressors", o.EndpointCompressors, o.strictTarget())
+	return err
+}
+
+// strictTarget reports whether the targets are validated strictly, i.e. the
+// default dialer is used, see normalizeTarget.
+func (o Options) strictTarget() bool {
+	return o.Dial == nil && o.DialFunc == nil && o.DialInterface == nil
+}
+
+// clone returns a copy of o whose maps, slices and metadata aren't shared with o.
+// the keys of the endpoint maps are normalized, the malformed ones are kept as
+// they are, validate rejects them.
+func (o Options) clone() Options {
+	if creds, err := normalizeKeys("", o.EndpointTransportCredentials, false); err == nil {
+		o.EndpointTransportCredentials = creds
+	} else {
+		o.EndpointTransportCredentials = maps.Clone(o.EndpointTransportCredentials)
+	}
+	o.Compressors = append([]string(nil), o.Compressors...)
+	compressors, err := normalizeKeys("", o.EndpointCompressors, false)
+	if err != nil {
+		compressors = maps.Clone(o.EndpointCompressors)
+	}
+	for address, names := range compressors {
+		compressors[address] = append([]string(nil), names...)
+	}
+	o.EndpointCompressors = compressors
+	if o.Metadata != nil {
+		o.Metadata = o.Metadata.Copy()
+	}
+	if o.HealthCheckMetadata != nil {
+		o.HealthCheckMetadata = o.HealthCheckMetadata.Copy()
+	}
+	return o
+}
+
+// transportCredentials returns the transport credentials of the address, nil
+// if neither TransportCredentials nor EndpointTransportCredentials is set. the
+// address is canonicalized like the keys of EndpointTransportCredentials.
+func (o Options) transportCredentials(address string) credentials.TransportCredentials {
+	if canonical, err := canonicalTarget(address, false); err == nil {
+		address = canonical
+	}
+	if creds, ok := o.EndpointTransportCredentials[address]; ok {
+		return creds
+	}
+	return o.TransportCredentials
+}
+
+// defaultDialOptions are the defined configurations of Dial.
+func defaultDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithInitialWindowSize(InitialWindowSize),
 		grpc.WithInitialConnWindowSize(InitialConnWindowSize),
 		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(MaxSendMsgSize)),
@@ -95,7 +991,8 @@ func Dial(address string) (*grpc.ClientConn, error) {
 			Time:                KeepAliveTime,
 			Timeout:             KeepAliveTimeout,
 			PermitWithoutStream: true,
-		}))
+		}),
+	}
 }
 
 // DialTest return a simple grpc connection with defined configurations.
@@ -0,0 +1,62 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"sync/atomic"
+)
+
+// checkoutOverflow checks out a one-time connection still open with less than
+// MaxConcurrentStreams conns checked out, nil if there is none.
+func (p *pool) checkoutOverflow() *conn {
+	p.overflowMu.Lock()
+	defer p.overflowMu.Unlock()
+
+	for _, pc := range p.overflow {
+		if pc.cc.Load() != nil && atomic.LoadInt32(&pc.ref) < p.streamLimit() {
+			return p.checkout(pc, true)
+		}
+	}
+	return nil
+}
+
+// checkoutNewOverflow checks out the newly dialed one-time connection pc, and
+// keeps it for checkoutOverflow.
+func (p *pool) checkoutNewOverflow(pc *physicalConn) *conn {
+	p.overflowMu.Lock()
+	defer p.overflowMu.Unlock()
+
+	p.overflow = append(p.overflow, pc)
+	return p.checkout(pc, true)
+}
+
+// closeOverflow gives back c of a one-time connection, the connection is closed
+// once it isn't checked out anymore.
+func (p *pool) closeOverflow(c *conn) error {
+	p.overflowMu.Lock()
+	c.release()
+	if atomic.LoadInt32(&c.pc.ref) > 0 {
+		p.overflowMu.Unlock()
+		return nil
+	}
+	for i, pc := range p.overflow {
+		if pc == c.pc {
+			p.overflow = append(p.overflow[:i], p.overflow[i+1:]...)
+			break
+		}
+	}
+	p.overflowMu.Unlock()
+	return c.pc.reset()
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamInterval returns the interval between the streams of a connection and
+// the lead a burst may take on it, see MaxStreamRate.
+func (p *pool) streamInterval() (interval, lead int64) {
+	interval = int64(float64(time.Second) / p.opt.MaxStreamRate)
+	burst := p.opt.MaxStreamBurst
+	if burst <= 0 {
+		burst = int(p.opt.MaxStreamRate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return interval, int64(burst) * interval
+}
+
+// pace waits for the turn of a stream on pc, see MaxStreamRate. the turns are
+// scheduled like the generic cell rate algorithm: each stream moves the next
+// turn of the slot on by interval, it waits until the turn is within lead.
+func (pc *physicalConn) pace(ctx context.Context) error {
+	p := pc.pool
+	interval, lead := p.streamInterval()
+	var wait time.Duration
+	for {
+		due := atomic.LoadInt64(&pc.track.paced)
+		now := p.clock.Now().UnixNano()
+		next := due
+		if next < now {
+			next = now
+		}
+		next += interval
+		wait = time.Duration(next - now - lead)
+		if deadline, ok := ctx.Deadline(); ok && wait > 0 && time.Unix(0, now).Add(wait).After(deadline) {
+			return status.Errorf(codes.ResourceExhausted, "pool: stream rate %v/s of %s exceeded",
+				p.opt.MaxStreamRate, p.address)
+		}
+		if atomic.CompareAndSwapInt64(&pc.track.paced, due, next) {
+			break
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	timer := p.clock.AfterFunc(wait, func() { close(done) })
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// paceInterceptor paces the unary RPCs of pc, see MaxStreamRate.
+func (pc *physicalConn) paceInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := pc.pace(ctx); err != nil {
+		return err
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// paceStreamInterceptor is like paceInterceptor for the streams.
+func (pc *physicalConn) paceStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if err := pc.pace(ctx); err != nil {
+		return nil, err
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
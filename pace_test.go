@@ -0,0 +1,72 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaxStreamRate(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxStreamRate = 20
+	opt.MaxStreamBurst = 2
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	invoke := func(ctx context.Context) error {
+		return p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, &pb.EchoResponse{})
+	}
+
+	// the burst goes at once, the rest is paced at 50ms
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		require.NoError(t, invoke(ctx))
+	}
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// the RPC whose deadline comes before its turn fails right away
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	require.Equal(t, codes.ResourceExhausted, status.Code(invoke(short)))
+
+	// the streams wait their turn too
+	start = time.Now()
+	cs, err := p.NewStream(ctx, &grpc.StreamDesc{StreamName: "Say"}, "/pb.Echo/Say")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	require.NoError(t, cs.SendMsg(&pb.EchoRequest{Message: []byte("hi")}))
+	require.NoError(t, cs.CloseSend())
+	require.NoError(t, cs.RecvMsg(&pb.EchoResponse{}))
+}
+
+func TestMaxStreamRateOptions(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxStreamRate = -1
+	_, err := New(startEchoServer(t), opt)
+	require.ErrorIs(t, err, ErrInvalidOptions)
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import "sync/atomic"
+
+// PackingStrategy is how the streams are packed on the pool's connections.
+type PackingStrategy int
+
+const (
+	// PackingRoundRobin selects the connections round robin.
+	PackingRoundRobin PackingStrategy = iota
+
+	// PackingSpread selects the connection with the fewest conns checked out, it
+	// minimizes the streams per connection for latency isolation.
+	PackingSpread
+
+	// PackingPack fills the connections in slot order up to MaxConcurrentStreams
+	// before using the next, it minimizes the sockets in use. the connections are
+	// selected round robin once all of them are full.
+	PackingPack
+)
+
+func (s PackingStrategy) String() string {
+	switch s {
+	case PackingRoundRobin:
+		return "round-robin"
+	case PackingSpread:
+		return "spread"
+	case PackingPack:
+		return "pack"
+	}
+	return "unknown"
+}
+
+// spread returns the connection of conns with the fewest conns checked out, the
+// ties are broken round robin.
+func (p *pool) spread(conns []*physicalConn) *physicalConn {
+	next := atomic.AddUint32(&p.index, 1)
+	var picked *physicalConn
+	var least int32
+	for i := uint32(0); i < uint32(len(conns)); i++ {
+		pc := conns[(next+i)%uint32(len(conns))]
+		if !p.selectable(pc) {
+			continue
+		}
+		if ref := atomic.LoadInt32(&pc.ref); picked == nil || ref < least {
+			picked, least = pc, ref
+		}
+	}
+	return picked
+}
+
+// pack returns the first connection of conns in slot order that isn't full, nil
+// if all of them are.
+func (p *pool) pack(conns []*physicalConn) *physicalConn {
+	for _, pc := range conns {
+		if p.selectable(pc) && atomic.LoadInt32(&pc.ref) < p.streamLimit() {
+			return pc
+		}
+	}
+	return nil
+}
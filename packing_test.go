@@ -0,0 +1,49 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackingStrategy(t *testing.T) {
+	slots := func(strategy PackingStrategy) []int {
+		opt := DefaultOptions
+		opt.MaxIdle = 3
+		opt.MaxActive = 3
+		opt.MaxConcurrentStreams = 2
+		opt.PackingStrategy = strategy
+		p, err := New(*endpoint, opt)
+		require.NoError(t, err)
+		defer p.Close()
+
+		var slots []int
+		for i := 0; i < 6; i++ {
+			c, err := p.Get()
+			require.NoError(t, err)
+			defer c.Close()
+			slots = append(slots, c.Info().Slot)
+		}
+		return slots
+	}
+
+	require.Equal(t, []int{0, 0, 1, 1, 2, 2}, slots(PackingPack))
+	spread := slots(PackingSpread)
+	require.ElementsMatch(t, []int{0, 1, 2}, spread[:3])
+	require.ElementsMatch(t, []int{0, 1, 2}, spread[3:])
+	require.Equal(t, "spread", PackingSpread.String())
+}
@@ -15,35 +15,133 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"runtime/pprof"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 // ErrClosed is the error resulting if the pool is closed via pool.Close().
 var ErrClosed = errors.New("pool is closed")
 
+// ErrClosing is the error resulting if the pool is being closed or drained.
+var ErrClosing = errors.New("pool is closing")
+
+// ErrExhausted is the error resulting if the pool holds HardMaxConnections
+// connections or its Budget is used up, and a new one is needed.
+var ErrExhausted = errors.New("pool is exhausted")
+
+// ErrAcquireTimeout is the error resulting if Get waits longer than
+// AcquireTimeout, it's a context.DeadlineExceeded.
+var ErrAcquireTimeout = fmt.Errorf("pool acquire timed out: %w", context.DeadlineExceeded)
+
+// ErrThrottled is the error resulting if Get is rejected locally because the
+// backend is overloaded, see ThrottleK.
+var ErrThrottled = errors.New("pool is throttled")
+
+// ErrNoReadyConn is the error resulting if all of the connections of the pool died
+// and are being re-dialed.
+var ErrNoReadyConn = errors.New("no connection of pool is ready")
+
+// the states of pool.
+const (
+	stateOpen int32 = iota
+	stateClosing
+	stateClosed
+)
+
 // Pool interface describes a pool implementation.
 // An ideal pool is threadsafe and easy to use.
 type Pool interface {
 	// Get returns a new connection from the pool. Closing the connections puts
 	// it back to the Pool. Closing it when the pool is destroyed or full will
-	// be counted as an error. we guarantee the conn.Value() isn't nil when conn isn't nil.
+	// be counted as an error. we guarantee the conn.Value() isn't nil when conn isn't nil,
+	// unless DenyRawConn is set.
 	Get() (Conn, error)
 
+	// GetContext is like Get, ctx bounds the time waiting for a connection,
+	// see Options.Wait.
+	GetContext(ctx context.Context) (Conn, error)
+
+	// GetDetailed is like GetContext but also describes how the connection is
+	// checked out, for request-level logging and latency attribution. the info
+	// is returned on error too, with the Wait before the failure.
+	GetDetailed(ctx context.Context) (Conn, AcquireInfo, error)
+
 	// Close closes the pool and all its connections. After Close() the pool is
-	// no longer usable. You can't make concurrent calls Close and Get method.
-	// It will be cause panic.
+	// no longer usable. Get racing with Close returns ErrClosing or ErrClosed,
+	// it never returns a connection that is torn down by Close. see OnDraining
+	// for the connections still checked out.
 	Close() error
 
+	// ScaleTo dials connections up to n ahead of a known traffic spike, bounded by
+	// MaxIdle and MaxActive, they are kept until ScaleTo is called again with a
+	// smaller n. the pool shrinks back to n, not MaxIdle, when they are idle.
+	ScaleTo(ctx context.Context, n int) error
+
+	// Drain stops handing out connections, Get returns ErrClosing meanwhile, and
+	// waits for all checked out connections to be given back, then closes the pool.
+	// If ctx is done first, the pool is closed anyway and ctx.Err() is returned.
+	Drain(ctx context.Context) error
+
 	// Status returns the current status of the pool.
 	Status() string
+
+	// Stats returns a snapshot of the state of the pool.
+	Stats() Stats
+
+	// Counters returns the cumulative counters of the pool, e.g. the Gets and the
+	// dials and how many of them failed.
+	Counters() Counters
+
+	// Capacity returns the streams the pool serves at most without sharing the
+	// connections beyond their limit, derived from the options.
+	Capacity() StreamCapacity
+
+	// Options returns a copy of the options in effect, the defaults of the enabled
+	// features applied, so wrapping libraries can introspect the configuration.
+	// modifying it doesn't change the pool.
+	Options() Options
+
+	// InitialDialReport returns the results of the initial dial of every slot
+	// when the pool is created, so applications can log the connectivity at boot.
+	// New returns them in an InitialDialError if it fails.
+	InitialDialReport() []SlotDialResult
+
+	// SetBypass switches at runtime how the Gets bypass the pool's connections,
+	// e.g. to a single shared connection or a connection dialed for every Get.
+	// the pool's connections are kept meanwhile, BypassOff switches back to them.
+	SetBypass(mode BypassMode)
+
+	// Healthy reports whether the pool isn't degraded, it's degraded once
+	// MaxGetFailures consecutive Gets fail or the SmokeTest fails, until a Get
+	// succeeds.
+	Healthy() bool
+
+	// ClientConnInterface lets the pool be used directly to construct generated
+	// clients, e.g. the clients registered on a grpc-gateway mux. every call checks
+	// out a connection from the pool and gives it back when the call finishes.
+	grpc.ClientConnInterface
 }
 
 type pool struct {
+	// atomic, the generation of the last connection dialed. it's first to be
+	// 64-bit aligned.
+	generation uint64
+
+	// atomic, the bytes sent and received on all of the connections ever dialed,
+	// counted when the usage is tracked.
+	bytesSent     int64
+	bytesReceived int64
+
 	// atomic, used to get connection random
 	index uint32
 
@@ -57,14 +155,128 @@ type pool struct {
 	// pool options
 	opt Options
 
-	// all of created physical connections
-	conns []*conn
+	// summary and fingerprint of opt, see Stats.
+	summary     string
+	fingerprint string
+
+	// dialFunc is opt.DialFunc, or opt.Dial adapted to it, or the default dialer.
+	dialFunc func(req DialRequest) (*grpc.ClientConn, error)
+
+	// holds a token for every open connection when HardMaxConnections is set.
+	sockets chan struct{}
+
+	// the one-time connections open, kept when ReuseOverflow is set.
+	overflow   []*physicalConn
+	overflowMu sync.Mutex
+
+	// Clock of the options, or the real one.
+	clock Clock
+
+	// the source seeded by Seed, nil when Seed isn't set.
+	rand *seededRand
+
+	// the pool's share of Budget, nil when Budget isn't set.
+	share *budgetShare
+
+	// ctx is canceled when Close is called.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// dials is passed to every dial, it's canceled once the pool is closing, by
+	// Drain or Close.
+	dials       context.Context
+	cancelDials context.CancelFunc
+
+	// all of created physical connections, guarded by the lock.
+	conns []*physicalConn
+
+	// the immutable copy of the first current conns, swapped in whenever they
+	// change, so the Get fast path selects from it without the lock.
+	live atomic.Pointer[[]*physicalConn]
 
 	// the server address is to create connection.
 	address string
 
-	// closed set true when Close is called.
-	closed int32
+	// the canonical address and identity, see Stats.Key.
+	key Key
+
+	// atomic, the state of pool: open, closing or closed.
+	state int32
+
+	// drained is closed when all of connections are given back during draining.
+	drained     chan struct{}
+	drainedOnce sync.Once
+
+	// atomic, the number of connections the pool shrinks to, MaxIdle unless it's
+	// scaled by ScaleTo.
+	floor int32
+
+	// atomic, the unix nano time the pool last grows, and 1 while a shrink is
+	// delayed, see ShrinkCooldown.
+	grownAt       int64
+	shrinkPending int32
+
+	// atomic, the number of Gets waiting for a connection or the Budget.
+	waiting int32
+
+	// atomic, the number of dials in flight, and of the Gets waiting for the
+	// pool to grow, see Stats.
+	dialing int32
+	growing int32
+
+	// atomic, the unix nano time OnHighUtilization is last called.
+	highUtilizationAt int64
+
+	// atomic, the number of retired connections still checked out.
+	draining int32
+
+	// atomic, the number of checkouts held longer than MaxCheckoutDuration.
+	expired int32
+
+	// atomic, the number of flaps, see FlapThreshold.
+	flapped int32
+
+	// atomic, the number of disconnects, and of those the keepalive timeouts and
+	// GOAWAYs told by the failed RPCs, see Stats.
+	disconnects       int32
+	keepaliveTimeouts int32
+	goAways           int32
+
+	// atomic, the number of consecutive failed Gets, and 1 while the pool is
+	// degraded, see MaxGetFailures.
+	getFailures int32
+	degraded    int32
+
+	// the decayed counts of the adaptive throttling, see ThrottleK.
+	throttle throttle
+
+	// the effective MaxConcurrentStreams, see AdaptiveStreamsLatency.
+	limiter streamLimit
+
+	// the cumulative counters, see Counters.
+	counters counters
+
+	// collapses the identical calls, nil unless CoalesceMethod is set.
+	coalesce *coalescer
+
+	// atomic, the number of mirrored RPCs in flight, see Mirror.
+	mirroring int32
+
+	// atomic, the BypassMode, and the connection of BypassShared guarded by
+	// bypassMu, see SetBypass.
+	bypass   int32
+	shared   *physicalConn
+	bypassMu sync.Mutex
+
+	// the active streams, and the number of them exceeding MaxStreamAge, atomic.
+	watch           streamWatch
+	agedStreamCount int32
+
+	// the results of the initial dial, see InitialDialReport.
+	report []SlotDialResult
+
+	// the latest Stats published when StatsInterval is set.
+	published atomic.Pointer[Stats]
 
 	// control the atomic var current's concurrent read write.
 	sync.RWMutex
@@ -72,42 +284,388 @@ type pool struct {
 
 // New return a connection pool.
 func New(address string, option Options) (Pool, error) {
-	if address == "" {
-		return nil, errors.New("invalid address settings")
-	}
-	if option.Dial == nil {
-		return nil, errors.New("invalid dial settings")
-	}
-	if option.MaxIdle <= 0 || option.MaxActive <= 0 || option.MaxIdle > option.MaxActive {
-		return nil, errors.New("invalid maximum settings")
+	option = option.derive()
+	address, err := normalizeTarget(address, option.strictTarget())
+	if err != nil {
+		return nil, err
 	}
-	if option.MaxConcurrentStreams <= 0 {
-		return nil, errors.New("invalid maximun settings")
+	canonical, _ := canonicalTarget(address, false)
+	if err := option.validate(); err != nil {
+		return nil, err
 	}
+	option = option.clone()
 
 	p := &pool{
-		index:   0,
-		current: int32(option.MaxIdle),
-		ref:     0,
-		opt:     option,
-		conns:   make([]*conn, option.MaxActive),
-		address: address,
-		closed:  0,
+		index:    0,
+		current:  int32(option.MaxIdle),
+		floor:    int32(option.MaxIdle),
+		ref:      0,
+		opt:      option,
+		dialFunc: option.DialFunc,
+		conns:    make([]*physicalConn, option.MaxActive),
+		address:  address,
+		key:      Key{Target: canonical, Identity: option.Identity},
+		state:    stateOpen,
+		drained:  make(chan struct{}),
+		limiter:  newStreamLimit(option.MaxConcurrentStreams),
+	}
+	p.coalesce = newCoalescer(option.CoalesceMethod, func(f func()) { p.spawn("coalesce", -2, f) })
+	if option.Seed != 0 {
+		p.rand = newSeededRand(option.Seed)
+	}
+	if p.dialFunc == nil && option.Dial != nil {
+		p.dialFunc = AdaptDial(option.Dial)
+	}
+	if p.dialFunc == nil && option.DialInterface != nil {
+		p.dialFunc = AdaptDialInterface(option.DialInterface)
+	}
+	if p.dialFunc == nil {
+		p.dialFunc = dialDefault
 	}
+	if option.BeforeDial != nil {
+		p.dialFunc = beforeDial(option.BeforeDial, p.dialFunc)
+	}
+	if option.HardMaxConnections > 0 {
+		p.sockets = make(chan struct{}, option.HardMaxConnections)
+	}
+	p.clock = option.Clock
+	if p.clock == nil {
+		p.clock = realClock{}
+	}
+	if option.Budget != nil {
+		p.share = option.Budget.join(option.BudgetWeight, option.BudgetCritical, p.clock)
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.dials, p.cancelDials = context.WithCancel(p.ctx)
+	p.summary = summarize(option)
+	p.fingerprint = fingerprint(p.summary)
 
-	for i := 0; i < p.opt.MaxIdle; i++ {
-		c, err := p.opt.Dial(address)
-		if err != nil {
-			p.Close()
-			return nil, fmt.Errorf("dial is not able to fill the pool: %s", err)
-		}
-		p.conns[i] = p.wrapConn(c, false)
+	if err := p.dialInitial(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if p.opt.SmokeTest {
+		p.smokeTest()
+	}
+	if p.opt.UsageReport != nil {
+		p.spawn("usage-report", -2, p.reportUsage)
+	}
+	if p.opt.HealthCheckInterval > 0 {
+		// the ticker starts with the pool rather than the goroutine, so the checks
+		// are due at HealthCheckInterval of the Clock whenever it's scheduled
+		ticker := p.clock.NewTicker(p.opt.HealthCheckInterval)
+		p.spawn("health-check", -2, func() { p.healthCheck(ticker) })
+	}
+	if p.opt.IdleTimeout > 0 && p.opt.IdleKeepWarm > 0 {
+		p.spawn("keep-warm", -2, p.keepWarm)
+	}
+	if p.opt.ScaleSchedule != nil {
+		p.spawn("scale-schedule", -2, p.scaleBySchedule)
+	}
+	if p.opt.MaxStreamAge > 0 {
+		p.spawn("stream-age", -2, p.watchStreams)
+	}
+	if p.opt.StatsInterval > 0 {
+		p.publish()
+		p.spawn("stats", -2, p.publishStats)
+	}
+	if p.opt.Registry != nil {
+		p.opt.Registry.join(p)
+	}
+	if p.opt.Faults != nil {
+		p.opt.Faults.join(p)
 	}
 	log.Printf("new pool success: %v\n", p.Status())
 
 	return p, nil
 }
 
+// dial creates a connection for the slot, slot is -1 for a one-time connection.
+// If the pool holds HardMaxConnections connections, dial waits for one of them
+// to be closed when wait is true, otherwise returns ErrExhausted.
+func (p *pool) dial(ctx context.Context, slot int, wait bool) (*physicalConn, error) {
+	if err := p.acquireSocket(ctx, wait); err != nil {
+		return nil, err
+	}
+	p.counters.dials.Add(1)
+	atomic.AddInt32(&p.dialing, 1)
+	defer atomic.AddInt32(&p.dialing, -1)
+	// the slot's history is carried over from the connection in it
+	var prev *physicalConn
+	attempt := 1
+	if slot >= 0 {
+		if prev = p.conns[slot]; prev != nil {
+			attempt = int(atomic.AddInt32(&prev.attempts, 1))
+		}
+	}
+	pc := &physicalConn{pool: p, slot: slot, generation: atomic.AddUint64(&p.generation, 1),
+		attempts: int32(attempt)}
+	if p.tracking() {
+		now := p.clock.Now().UnixNano()
+		pc.track = &connTracking{dialedAt: now, usedAt: now}
+		if prev != nil && prev.track != nil {
+			pc.track.flaps = atomic.LoadInt32(&prev.track.flaps)
+		}
+	}
+	dialCtx := p.dials
+	if p.opt.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(dialCtx, p.opt.DialTimeout)
+		defer cancel()
+	}
+	// the slots are dialed under the lock, their delays are waited before it
+	if slot < 0 {
+		if err := p.opt.Faults.delayDial(dialCtx, p.clock); err != nil {
+			p.counters.dialErrors.Add(1)
+			p.releaseSocket()
+			return nil, err
+		}
+	}
+	if len(p.opt.Metadata) > 0 {
+		dialCtx = metadata.NewOutgoingContext(dialCtx, p.opt.Metadata)
+	}
+	cc, err := p.dialAbandonable(dialCtx, DialRequest{
+		Target:      p.address,
+		SlotIndex:   slot,
+		Attempt:     attempt,
+		Options:     p.opt,
+		DialOptions: p.dialOptions(pc),
+	})
+	if err != nil {
+		p.counters.dialErrors.Add(1)
+		p.releaseSocket()
+		return nil, err
+	}
+	pc.cc.Store(cc)
+	pc.to(ConnReady)
+	if slot >= 0 {
+		p.spawn("watch", slot, func() { pc.watch(cc) })
+		if ratio := p.opt.Faults.dropping(); ratio > 0 && p.random() < ratio {
+			cc.Close()
+		}
+	}
+	return pc, nil
+}
+
+// delayDial waits for the delay Faults injects into a dial of a slot, bounded
+// by DialTimeout and the close of p. it's called before the lock of p is held,
+// the delay failing is counted as a failed dial.
+func (p *pool) delayDial() error {
+	if p.opt.Faults == nil {
+		return nil
+	}
+	ctx := p.dials
+	if p.opt.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opt.DialTimeout)
+		defer cancel()
+	}
+	if err := p.opt.Faults.delayDial(ctx, p.clock); err != nil {
+		p.counters.dials.Add(1)
+		p.counters.dialErrors.Add(1)
+		return err
+	}
+	return nil
+}
+
+// dialAbandonable calls the dialFunc in its own goroutine with ctx, it returns
+// ErrClosed once the pool is closing even though the dialFunc doesn't honor ctx,
+// the connection dialed late is closed then. so is the one dialed as the pool
+// closes, it's never written into the closed pool.
+func (p *pool) dialAbandonable(ctx context.Context, req DialRequest) (*grpc.ClientConn, error) {
+	type dialed struct {
+		cc  *grpc.ClientConn
+		err error
+	}
+	done, abandoned := make(chan dialed), make(chan struct{})
+	// the goroutines started by the dial inherit the labels
+	go pprof.Do(ctx, p.labels("dial", req.SlotIndex), func(ctx context.Context) {
+		req.Ctx = ctx
+		cc, err := p.dialFunc(req)
+		select {
+		case done <- dialed{cc, err}:
+		case <-abandoned:
+			if cc != nil {
+				cc.Close()
+			}
+		}
+	})
+	select {
+	case d := <-done:
+		if d.err == nil && p.dials.Err() != nil {
+			d.cc.Close()
+			return nil, ErrClosed
+		}
+		return d.cc, d.err
+	case <-p.dials.Done():
+		close(abandoned)
+		return nil, ErrClosed
+	}
+}
+
+func (p *pool) acquireSocket(ctx context.Context, wait bool) error {
+	if p.sockets == nil {
+		return p.acquireBudget(ctx, budgetConnections, wait)
+	}
+	select {
+	case p.sockets <- struct{}{}:
+	default:
+		if !wait {
+			return ErrExhausted
+		}
+		atomic.AddInt32(&p.waiting, 1)
+		defer atomic.AddInt32(&p.waiting, -1)
+		select {
+		case p.sockets <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return ErrClosed
+		}
+	}
+	if err := p.acquireBudget(ctx, budgetConnections, wait); err != nil {
+		<-p.sockets
+		return err
+	}
+	return nil
+}
+
+// acquireBudget takes a connection or a stream from the pool's Budget if any.
+func (p *pool) acquireBudget(ctx context.Context, r int, wait bool) error {
+	if p.share == nil {
+		return nil
+	}
+	return p.share.acquire(ctx, p.ctx.Done(), r, wait, &p.waiting)
+}
+
+func (p *pool) releaseBudget(r int) {
+	if p.share != nil {
+		p.share.release(r)
+	}
+}
+
+func (p *pool) releaseSocket() {
+	if p.sockets != nil {
+		<-p.sockets
+	}
+	p.releaseBudget(budgetConnections)
+}
+
+// tracking reports whether the pool tracks the state of its connections.
+func (p *pool) tracking() bool {
+	return p.opt.SLALatency > 0 || p.opt.QuarantineErrors > 0 || p.trackingUsage() ||
+		p.opt.TestOnBorrow != nil || p.opt.TestOnReturn != nil || p.opt.HealthCheckInterval > 0 ||
+		p.opt.MaxStreamRate > 0 || p.opt.FlapThreshold > 0
+}
+
+// dialOptions returns the dial options derived from the pool's options.
+func (p *pool) dialOptions(pc *physicalConn) []grpc.DialOption {
+	var opts []grpc.DialOption
+	if p.opt.Mirror != nil {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.mirrorInterceptor))
+	}
+	if pc.slot >= 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.disconnectInterceptor),
+			grpc.WithChainStreamInterceptor(pc.disconnectStreamInterceptor))
+	}
+	if p.opt.MaxStreamRate > 0 && pc.slot >= 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.paceInterceptor),
+			grpc.WithChainStreamInterceptor(pc.paceStreamInterceptor))
+	}
+	if len(p.opt.Metadata) > 0 || p.opt.UtilizationHeader != "" {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(p.metadataInterceptor),
+			grpc.WithChainStreamInterceptor(p.metadataStreamInterceptor))
+	}
+	if p.opt.StatsHandler != nil {
+		opts = append(opts, grpc.WithStatsHandler(p.opt.StatsHandler))
+	}
+	if opt := p.idleTimeout(); opt != nil {
+		opts = append(opts, opt)
+	}
+	if p.trackingUsage() {
+		opts = append(opts, grpc.WithStatsHandler(usageHandler{pc}))
+	}
+	if (p.opt.SLALatency > 0 || p.opt.QuarantineErrors > 0) && pc.slot >= 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.unaryInterceptor))
+	}
+	if p.opt.LameDuckHeader != "" && pc.slot >= 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.lameDuckInterceptor),
+			grpc.WithChainStreamInterceptor(pc.lameDuckStreamInterceptor))
+	}
+	if p.opt.HealthCheckInterval > 0 && pc.slot >= 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.servedInterceptor),
+			grpc.WithChainStreamInterceptor(pc.servedStreamInterceptor))
+	}
+	if p.opt.TestOnReturn != nil && pc.slot >= 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.returnInterceptor),
+			grpc.WithChainStreamInterceptor(pc.returnStreamInterceptor))
+	}
+	if p.opt.MaxStreamAge > 0 {
+		opts = append(opts, grpc.WithChainStreamInterceptor(pc.streamAgeInterceptor))
+	}
+	if p.opt.AdaptiveStreamsLatency > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.adaptiveInterceptor),
+			grpc.WithChainStreamInterceptor(pc.adaptiveStreamInterceptor))
+	}
+	if p.opt.ThrottleK > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(p.throttleInterceptor),
+			grpc.WithChainStreamInterceptor(p.throttleStreamInterceptor))
+	}
+	if len(p.compressors()) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(pc.compressionInterceptor),
+			grpc.WithChainStreamInterceptor(pc.compressionStreamInterceptor))
+	}
+	return opts
+}
+
+// evict replaces pc by a newly dialed connection in background, pc is retired.
+// pc is ready again if the dial fails, or re-dialed if it's down meanwhile.
+func (p *pool) evict(pc *physicalConn, reason string) {
+	if pc.slot < 0 {
+		return
+	}
+	if _, ok := pc.to(ConnReplacing); !ok {
+		return
+	}
+	log.Printf("evict conn: %s, address: %s, slot: %d\n", reason, p.address, pc.slot)
+	p.spawn("replace", pc.slot, func() {
+		if p.replace(pc) {
+			return
+		}
+		if prev, _ := pc.to(ConnReady); prev == ConnDown {
+			p.redial(pc)
+		}
+	})
+}
+
+// replace dials a new connection into the slot of pc and retires pc, it reports
+// false if the dial failed.
+func (p *pool) replace(pc *physicalConn) bool {
+	if d := p.holdDown(pc); d > 0 && !p.sleep(d) {
+		return true
+	}
+	if err := p.delayDial(); err != nil {
+		log.Printf("replace conn failed, address: %s, slot: %d, err: %v\n", p.address, pc.slot, err)
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stateErr() != nil || p.conns[pc.slot] != pc {
+		return true
+	}
+	npc, err := p.dial(p.ctx, pc.slot, false)
+	if err != nil {
+		log.Printf("replace conn failed, address: %s, slot: %d, err: %v\n", p.address, pc.slot, err)
+		return false
+	}
+	p.conns[pc.slot] = npc
+	p.publishConns()
+	p.rotate(pc, npc)
+	p.counters.evictions.Add(1)
+	return true
+}
+
 func (p *pool) incrRef() int32 {
 	newRef := atomic.AddInt32(&p.ref, 1)
 	if newRef == math.MaxInt32 {
@@ -118,19 +676,75 @@ func (p *pool) incrRef() int32 {
 
 func (p *pool) decrRef() {
 	newRef := atomic.AddInt32(&p.ref, -1)
-	if newRef < 0 && atomic.LoadInt32(&p.closed) == 0 {
+	if newRef < 0 {
 		panic(fmt.Sprintf("negative ref: %d", newRef))
 	}
-	if newRef == 0 && atomic.LoadInt32(&p.current) > int32(p.opt.MaxIdle) {
-		p.Lock()
-		if atomic.LoadInt32(&p.ref) == 0 {
-			log.Printf("shrink pool: %d ---> %d, decrement: %d, maxActive: %d\n",
-				p.current, p.opt.MaxIdle, p.current-int32(p.opt.MaxIdle), p.opt.MaxActive)
-			atomic.StoreInt32(&p.current, int32(p.opt.MaxIdle))
-			p.deleteFrom(p.opt.MaxIdle)
+	p.limiter.release()
+	state := atomic.LoadInt32(&p.state)
+	if newRef == 0 && state == stateClosing {
+		p.drainedOnce.Do(func() { close(p.drained) })
+	}
+	if newRef == 0 && atomic.LoadInt32(&p.current) > atomic.LoadInt32(&p.floor) {
+		p.shrinkIdle()
+	}
+}
+
+// shrinkIdle shrinks the pool if no conns are checked out, it's delayed until
+// ShrinkCooldown passes since the last growth.
+func (p *pool) shrinkIdle() {
+	if cooldown := p.opt.ShrinkCooldown; cooldown > 0 {
+		grownAt := time.Unix(0, atomic.LoadInt64(&p.grownAt))
+		if d := grownAt.Add(cooldown).Sub(p.clock.Now()); d > 0 {
+			if atomic.CompareAndSwapInt32(&p.shrinkPending, 0, 1) {
+				p.clock.AfterFunc(d, func() {
+					atomic.StoreInt32(&p.shrinkPending, 0)
+					p.shrinkIdle()
+				})
+			}
+			return
 		}
-		p.Unlock()
 	}
+	p.Lock()
+	if atomic.LoadInt32(&p.ref) == 0 && p.stateErr() == nil {
+		p.shrink()
+	}
+	p.Unlock()
+}
+
+// shrink resets the connections beyond the floor, it must be called with lock
+// held and no conns checked out.
+func (p *pool) shrink() {
+	current, floor := atomic.LoadInt32(&p.current), atomic.LoadInt32(&p.floor)
+	if current <= floor {
+		return
+	}
+	log.Printf("shrink pool: %d ---> %d, decrement: %d, maxActive: %d\n",
+		current, floor, current-floor, p.opt.MaxActive)
+	atomic.StoreInt32(&p.current, floor)
+	// retired rather than reset, the Gets selecting from the live conns may be
+	// checking them out
+	for i := int(floor); i < p.opt.MaxActive; i++ {
+		if pc := p.conns[i]; pc != nil {
+			p.conns[i] = nil
+			pc.retire()
+		}
+	}
+	p.publishConns()
+}
+
+// publishConns swaps in the live conns, it must be called with lock held after
+// the conns or current change.
+func (p *pool) publishConns() {
+	live := append([]*physicalConn(nil), p.conns[:atomic.LoadInt32(&p.current)]...)
+	p.live.Store(&live)
+}
+
+// liveConns returns the live conns, see publishConns.
+func (p *pool) liveConns() []*physicalConn {
+	if live := p.live.Load(); live != nil {
+		return *live
+	}
+	return nil
 }
 
 func (p *pool) reset(index int) {
@@ -150,35 +764,116 @@ func (p *pool) deleteFrom(begin int) {
 
 // Get see Pool interface.
 func (p *pool) Get() (Conn, error) {
-	// the first selected from the created connections
+	return p.GetContext(context.Background())
+}
+
+// GetContext see Pool interface.
+func (p *pool) GetContext(ctx context.Context) (Conn, error) {
+	return p.acquire(ctx, nil)
+}
+
+// acquire checks out a connection, info is filled in unless it's nil.
+func (p *pool) acquire(ctx context.Context, info *AcquireInfo) (Conn, error) {
+	start := p.clock.Now()
+	c, err := p.tryAcquire(ctx, info)
+	p.counters.counted(start, p.clock.Now(), err)
+	if p.opt.MaxGetFailures > 0 || p.opt.SmokeTest {
+		p.countGet(err)
+	}
+	return c, err
+}
+
+func (p *pool) tryAcquire(ctx context.Context, info *AcquireInfo) (_ Conn, err error) {
+	if p.opt.AcquireTimeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opt.AcquireTimeout)
+		defer cancel()
+		defer func() {
+			if err == context.DeadlineExceeded && parent.Err() == nil {
+				err = ErrAcquireTimeout
+			}
+		}()
+	}
+	if err := p.opt.Faults.getErr(); err != nil {
+		return nil, err
+	}
+	if p.opt.ThrottleK > 0 && p.throttled() {
+		return nil, ErrThrottled
+	}
+	if p.opt.OnHighUtilization != nil {
+		p.checkUtilization()
+	}
+	if err := p.acquireBudget(ctx, budgetStreams, p.opt.Wait); err != nil {
+		return nil, err
+	}
+	c, err := p.get(ctx, info)
+	if err != nil {
+		p.releaseBudget(budgetStreams)
+	}
+	return c, err
+}
+
+// get checks out a connection regardless of the Budget.
+func (p *pool) get(ctx context.Context, info *AcquireInfo) (Conn, error) {
+	// the first selected from the created connections, without the lock
 	nextRef := p.incrRef()
-	p.RLock()
-	current := atomic.LoadInt32(&p.current)
-	p.RUnlock()
-	if current == 0 {
-		return nil, ErrClosed
+	if err := p.stateErr(); err != nil {
+		p.decrRef()
+		return nil, err
 	}
-	if nextRef <= current*int32(p.opt.MaxConcurrentStreams) {
-		next := atomic.AddUint32(&p.index, 1) % uint32(current)
-		return p.conns[next], nil
+	if mode := BypassMode(atomic.LoadInt32(&p.bypass)); mode != BypassOff {
+		return p.getBypassed(ctx, mode, info)
+	}
+	nextRef, err := p.admit(ctx, nextRef)
+	if err != nil {
+		return nil, err
+	}
+	current := int32(len(p.liveConns()))
+	if nextRef <= current*p.streamLimit() {
+		return p.picked(ctx, p.pick(ctx), info)
 	}
 
-	// the number connection of pool is reach to max active
-	if current == int32(p.opt.MaxActive) {
+	// the number connection of pool is reach to max active, or it doesn't grow
+	// by streams in WatchMode
+	if current == int32(p.opt.MaxActive) || p.opt.WatchMode {
 		// the second if reuse is true, select from pool's connections
 		if p.opt.Reuse {
-			next := atomic.AddUint32(&p.index, 1) % uint32(current)
-			return p.conns[next], nil
+			return p.picked(ctx, p.pick(ctx), info)
+		}
+		// the third create one-time connection, or reuse one if ReuseOverflow
+		if p.opt.ReuseOverflow {
+			if c := p.checkoutOverflow(); c != nil {
+				return c, nil
+			}
+		}
+		pc, err := p.dial(ctx, -1, p.opt.Wait)
+		if err != nil {
+			p.decrRef()
+			return nil, err
+		}
+		info.dialed()
+		if p.opt.ReuseOverflow {
+			return p.checkoutNewOverflow(pc), nil
 		}
-		// the third create one-time connection
-		c, err := p.opt.Dial(p.address)
-		return p.wrapConn(c, true), err
+		return p.checkout(pc, true), nil
 	}
 
 	// the fourth create new connections given back to pool
+	atomic.AddInt32(&p.growing, 1)
+	defer atomic.AddInt32(&p.growing, -1)
+	if err := p.delayDial(); err != nil {
+		p.decrRef()
+		return nil, err
+	}
 	p.Lock()
+	if err := p.stateErr(); err != nil {
+		p.Unlock()
+		p.decrRef()
+		return nil, err
+	}
 	current = atomic.LoadInt32(&p.current)
-	if current < int32(p.opt.MaxActive) && nextRef > current*int32(p.opt.MaxConcurrentStreams) {
+	if current < int32(p.opt.MaxActive) && nextRef > current*p.streamLimit() {
 		// 2 times the incremental or the remain incremental
 		increment := current
 		if current+increment > int32(p.opt.MaxActive) {
@@ -187,41 +882,232 @@ func (p *pool) Get() (Conn, error) {
 		var i int32
 		var err error
 		for i = 0; i < increment; i++ {
-			c, er := p.opt.Dial(p.address)
+			pc, er := p.dial(ctx, int(current+i), false)
+			if er == ErrExhausted {
+				// the existing connections are shared beyond HardMaxConnections
+				break
+			}
 			if er != nil {
 				err = er
 				break
 			}
 			p.reset(int(current + i))
-			p.conns[current+i] = p.wrapConn(c, false)
+			p.conns[current+i] = pc
+		}
+		if i > 0 {
+			info.dialed()
+			atomic.StoreInt64(&p.grownAt, p.clock.Now().UnixNano())
 		}
 		current += i
 		log.Printf("grow pool: %d ---> %d, increment: %d, maxActive: %d\n",
 			p.current, current, increment, p.opt.MaxActive)
 		atomic.StoreInt32(&p.current, current)
+		p.publishConns()
 		if err != nil {
 			p.Unlock()
+			p.decrRef()
 			return nil, err
 		}
 	}
 	p.Unlock()
-	next := atomic.AddUint32(&p.index, 1) % uint32(current)
-	return p.conns[next], nil
+	return p.picked(ctx, p.pick(ctx), info)
+}
+
+// pick checks out one of the live conns by PackingStrategy, the nil slots left
+// behind by reset are skipped. the conns retired meanwhile are given back and
+// another one is picked, nil is returned once the pool is closing. the conn
+// avoided by ctx is picked only if no other one is selectable, see Hedge.
+func (p *pool) pick(ctx context.Context) *conn {
+	avoid := p.avoided(ctx)
+	for attempt := 0; attempt <= p.opt.MaxActive; attempt++ {
+		conns := p.liveConns()
+		pc := p.choose(conns)
+		if pc == nil {
+			return nil
+		}
+		if pc == avoid {
+			if other := p.roundRobin(conns, avoid); other != nil {
+				pc = other
+			}
+		}
+		if p.claim(pc) {
+			return p.checkoutClaimed(pc, false)
+		}
+		if p.stateErr() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// choose returns one of conns by PackingStrategy, round robin by default. the
+// dead ones being re-dialed are skipped, it's nil if all of them are.
+func (p *pool) choose(conns []*physicalConn) *physicalConn {
+	switch p.opt.PackingStrategy {
+	case PackingSpread:
+		if pc := p.spread(conns); pc != nil {
+			return pc
+		}
+	case PackingPack:
+		if pc := p.pack(conns); pc != nil {
+			return pc
+		}
+	}
+	return p.roundRobin(conns, nil)
+}
+
+// roundRobin returns the next selectable one of conns round robin but skip, nil
+// if there is none.
+func (p *pool) roundRobin(conns []*physicalConn, skip *physicalConn) *physicalConn {
+	next := atomic.AddUint32(&p.index, 1)
+	for i := uint32(0); i < uint32(len(conns)); i++ {
+		slot := int((next + i) % uint32(len(conns)))
+		pc := conns[slot]
+		debugSlot(p, slot, pc)
+		if pc != skip && p.selectable(pc) {
+			return pc
+		}
+	}
+	return nil
+}
+
+// claim takes a reference of pc chosen from the live conns, it fails if pc has
+// been retired or the pool is closing since, the reference is given back then.
+// a retire racing with it either sees the reference, or is seen by it.
+func (p *pool) claim(pc *physicalConn) bool {
+	atomic.AddInt32(&pc.ref, 1)
+	if !pc.retired() && p.stateErr() == nil {
+		return true
+	}
+	if atomic.AddInt32(&pc.ref, -1) == 0 && pc.retired() {
+		pc.reset()
+	}
+	return false
+}
+
+// picked returns the result of pick, the reference is given back if nothing
+// is picked because all of the slots are being re-dialed or the pool is closing.
+func (p *pool) picked(ctx context.Context, c *conn, info *AcquireInfo) (Conn, error) {
+	if c == nil {
+		return nil, p.pickErr()
+	}
+	if p.opt.TestOnBorrow != nil {
+		return p.borrow(ctx, c, info)
+	}
+	return c, nil
+}
+
+// pickErr gives back the reference of the Get nothing is picked for, and
+// returns its error.
+func (p *pool) pickErr() error {
+	p.decrRef()
+	if err := p.stateErr(); err != nil {
+		return err
+	}
+	return ErrNoReadyConn
+}
+
+// stateErr returns the error of Get in current state of the pool.
+func (p *pool) stateErr() error {
+	switch atomic.LoadInt32(&p.state) {
+	case stateClosing:
+		return ErrClosing
+	case stateClosed:
+		return ErrClosed
+	}
+	return nil
+}
+
+// Drain see Pool interface.
+func (p *pool) Drain(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&p.state, stateOpen, stateClosing) {
+		return p.stateErr()
+	}
+	p.cancelDials()
+	// wait for the Gets in progress, their connections are counted in ref.
+	p.Lock()
+	p.Unlock()
+
+	var err error
+	if atomic.LoadInt32(&p.ref) > 0 {
+		deadline, _ := ctx.Deadline()
+		for _, pc := range p.slots() {
+			if atomic.LoadInt32(&pc.ref) > 0 {
+				p.notifyDraining(pc, deadline)
+			}
+		}
+		select {
+		case <-p.drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	p.close(false)
+	return err
 }
 
 // Close see Pool interface.
 func (p *pool) Close() error {
-	atomic.StoreInt32(&p.closed, 1)
+	return p.close(p.opt.OnDraining != nil)
+}
+
+// close closes the pool. if notify is true, the connections still checked out
+// are kept until they're given back or DrainGracePeriod passes, OnDraining is
+// called for them.
+func (p *pool) close(notify bool) error {
+	if atomic.LoadInt32(&p.state) == stateClosed {
+		return nil
+	}
+	atomic.StoreInt32(&p.state, stateClosing)
+	p.cancel()
+
+	// the ref isn't cleared, it drops to zero as the checked out conns are given
+	// back, their underlying connections are reset here exactly once.
+	p.Lock()
+	var draining []*physicalConn
+	if notify {
+		for i, pc := range p.conns {
+			if pc != nil && atomic.LoadInt32(&pc.ref) > 0 {
+				draining = append(draining, pc)
+				p.conns[i] = nil
+			}
+		}
+	}
 	atomic.StoreUint32(&p.index, 0)
 	atomic.StoreInt32(&p.current, 0)
-	atomic.StoreInt32(&p.ref, 0)
 	p.deleteFrom(0)
+	p.publishConns()
+	atomic.StoreInt32(&p.state, stateClosed)
+	p.Unlock()
+	for _, pc := range draining {
+		pc.drain(drainGracePeriodOf(p))
+	}
+	p.dropShared()
+	if p.share != nil {
+		p.share.leave()
+	}
+	if p.opt.StatsInterval > 0 {
+		p.publish()
+	}
+	if p.opt.Registry != nil {
+		p.opt.Registry.leave(p)
+	}
+	if p.opt.Faults != nil {
+		p.opt.Faults.leave(p)
+	}
+
 	log.Printf("close pool success: %v\n", p.Status())
 	return nil
 }
 
+// Options see Pool interface.
+func (p *pool) Options() Options {
+	return p.opt.clone()
+}
+
 // Status see Pool interface.
 func (p *pool) Status() string {
-	return fmt.Sprintf("address:%s, index:%d, current:%d, ref:%d. option:%v",
-		p.address, p.index, p.current, p.ref, p.opt)
+	return fmt.Sprintf("address:%s, index:%d, current:%d, ref:%d, expired:%d. fingerprint:%s, option:%s",
+		p.address, atomic.LoadUint32(&p.index), atomic.LoadInt32(&p.current),
+		atomic.LoadInt32(&p.ref), atomic.LoadInt32(&p.expired), p.fingerprint, p.summary)
 }
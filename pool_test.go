@@ -17,13 +17,20 @@ package pool
 import (
 	"context"
 	"flag"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/shimingyah/pool/example/pb"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
 )
 
 var endpoint = flag.String("endpoint", "127.0.0.1:50000", "grpc server endpoint")
@@ -55,9 +62,11 @@ func TestNew2(t *testing.T) {
 	_, err := New("", opt)
 	require.Error(t, err)
 
+	// the default dialer is used without Dial and DialFunc
 	opt.Dial = nil
-	_, err = New("127.0.0.1:8080", opt)
-	require.Error(t, err)
+	p, err := New("127.0.0.1:8080", opt)
+	require.NoError(t, err)
+	p.Close()
 
 	opt = DefaultOptions
 	opt.MaxConcurrentStreams = 0
@@ -81,6 +90,150 @@ func TestNew2(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestZeroOptions(t *testing.T) {
+	// the zero Options falls back to the sizes of DefaultOptions
+	p, err := New(*endpoint, Options{})
+	require.NoError(t, err)
+	require.Equal(t, DefaultOptions.MaxIdle, p.Stats().Current)
+	opt := p.Options()
+	require.Equal(t, DefaultOptions.MaxIdle, opt.MaxIdle)
+	require.Equal(t, DefaultOptions.MaxActive, opt.MaxActive)
+	require.Equal(t, DefaultOptions.MaxConcurrentStreams, opt.MaxConcurrentStreams)
+	require.NoError(t, p.Close())
+
+	// every field zeroed, negative or tiny works or fails validation naming it,
+	// never panics. the negative durations fail but IdleTimeout's
+	zeroInvalid := map[string]bool{"MaxIdle": true, "MaxActive": true, "MaxConcurrentStreams": true}
+	negativeInvalid := map[string]bool{"MaxIdle": true, "MaxActive": true, "MaxConcurrentStreams": true,
+		"HardMaxConnections": true, "AdaptiveStreamsBackoff": true, "MaxStreamRate": true, "MaxStreamBurst": true,
+		"MirrorFraction": true}
+	duration := reflect.TypeOf(time.Duration(0))
+	v := reflect.ValueOf(DefaultOptions)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		type value struct {
+			v       reflect.Value
+			invalid bool
+		}
+		values := []value{{reflect.Zero(field.Type), zeroInvalid[field.Name]}}
+		negative := negativeInvalid[field.Name] || field.Type == duration && field.Name != "IdleTimeout"
+		switch field.Type.Kind() {
+		case reflect.Int:
+			values = append(values, value{reflect.ValueOf(-1).Convert(field.Type), negative})
+		case reflect.Int64:
+			// the durations of 1ns too
+			values = append(values, value{reflect.ValueOf(-1).Convert(field.Type), negative},
+				value{reflect.ValueOf(1).Convert(field.Type), false})
+		case reflect.Float64:
+			values = append(values, value{reflect.ValueOf(-1.0).Convert(field.Type), negative})
+		}
+		for _, value := range values {
+			opt := DefaultOptions
+			reflect.ValueOf(&opt).Elem().Field(i).Set(value.v)
+			require.NotPanics(t, func() {
+				p, err := New(*endpoint, opt)
+				if value.invalid {
+					require.ErrorIs(t, err, ErrInvalidOptions, field.Name)
+					require.ErrorContains(t, err, field.Name)
+					return
+				}
+				require.NoError(t, err, field.Name)
+				defer p.Close()
+				c, err := p.Get()
+				require.NoError(t, err, field.Name)
+				p.Stats()
+				require.NoError(t, c.Close())
+			}, "%s: %v", field.Name, value.v)
+		}
+	}
+
+	for _, c := range []struct {
+		opt  Options
+		want string
+	}{
+		{Options{MaxIdle: 1}, "MaxActive 0 must be positive"},
+		{Options{MaxActive: 1}, "MaxIdle 0 must be positive"},
+		{Options{MaxConcurrentStreams: 1}, "MaxIdle 0 must be positive"},
+		{Options{MaxIdle: 2, MaxActive: 1, MaxConcurrentStreams: 1}, "MaxIdle 2 exceeds MaxActive 1"},
+		{Options{MaxIdle: 1, MaxActive: 1, MaxConcurrentStreams: 1, HardMaxConnections: -1},
+			"HardMaxConnections -1 must be zero or at least MaxIdle 1"},
+	} {
+		_, err := New(*endpoint, c.opt)
+		require.ErrorIs(t, err, ErrInvalidOptions)
+		require.EqualError(t, err, "invalid options: "+c.want)
+	}
+}
+
+func TestScaleByProcs(t *testing.T) {
+	for _, c := range []struct {
+		procs, maxIdle, maxActive int
+		wantIdle, wantActive      int
+	}{
+		{procs: 1, wantIdle: 1, wantActive: 4},
+		{procs: 8, wantIdle: 8, wantActive: 32},
+		{procs: 128, wantIdle: DefaultProcsMaxIdle, wantActive: DefaultProcsMaxActive},
+		{procs: 8, maxActive: 2, wantIdle: 2, wantActive: 2},
+		{procs: 8, maxIdle: 40, wantIdle: 40, wantActive: 40},
+	} {
+		opt := Options{ScaleByProcs: true, MaxIdle: c.maxIdle, MaxActive: c.maxActive}.scaleByProcs(c.procs)
+		require.Equal(t, c.wantIdle, opt.MaxIdle, c.procs)
+		require.Equal(t, c.wantActive, opt.MaxActive, c.procs)
+		require.Equal(t, DefaultProcsConcurrentStreams, opt.MaxConcurrentStreams)
+	}
+
+	opt := Options{ScaleByProcs: true, MaxConcurrentStreams: 10}
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, 10, nativePool.opt.MaxConcurrentStreams)
+	require.LessOrEqual(t, nativePool.opt.MaxIdle, runtime.GOMAXPROCS(0))
+
+	// the capacity set directly wins
+	opt = Options{ScaleByProcs: true, MaxConnections: 2, TargetConcurrentStreams: 10}
+	_, nativePool, _, err = newPool(&opt)
+	require.NoError(t, err)
+	defer nativePool.Close()
+	require.Equal(t, 2, nativePool.opt.MaxActive)
+}
+
+func TestDeriveOptions(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.TargetConcurrentStreams = 100
+	opt.MaxConnections = 8
+	opt.MinConnections = 2
+
+	_, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer nativePool.Close()
+
+	require.EqualValues(t, 2, nativePool.opt.MaxIdle)
+	require.EqualValues(t, 8, nativePool.opt.MaxActive)
+	require.EqualValues(t, 13, nativePool.opt.MaxConcurrentStreams)
+	require.EqualValues(t, 2, nativePool.current)
+
+	// the old fields are kept when the new ones are unset
+	opt = DefaultOptions
+	opt.MaxConnections = 16
+	opt = opt.derive()
+	require.EqualValues(t, DefaultOptions.MaxIdle, opt.MaxIdle)
+	require.EqualValues(t, 16, opt.MaxActive)
+	require.EqualValues(t, DefaultOptions.MaxConcurrentStreams, opt.MaxConcurrentStreams)
+
+	// MaxIdle is capped at MaxConnections, and defaulted to 1
+	opt = DefaultOptions
+	opt.MaxConnections = 4
+	require.EqualValues(t, 4, opt.derive().MaxIdle)
+	opt.MaxIdle = 0
+	require.EqualValues(t, 1, opt.derive().MaxIdle)
+
+	opt = DefaultOptions
+	opt.MinConnections = 10
+	opt.MaxConnections = 4
+	_, err = New("127.0.0.1:8080", opt)
+	require.Error(t, err)
+}
+
 func TestClose(t *testing.T) {
 	p, nativePool, opt, err := newPool(nil)
 	require.NoError(t, err)
@@ -122,6 +275,278 @@ func TestBasicGet(t *testing.T) {
 	require.EqualValues(t, 0, nativePool.ref)
 }
 
+func TestClientConn(t *testing.T) {
+	p, _, _, err := newPool(nil)
+	require.NoError(t, err)
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	cc, err := conn.ClientConn()
+	require.NoError(t, err)
+	require.EqualValues(t, true, cc == conn.Value())
+
+	p.Close()
+	cc, err = conn.ClientConn()
+	require.ErrorIs(t, err, ErrConnReset)
+	require.EqualValues(t, true, cc == nil)
+}
+
+func TestStats(t *testing.T) {
+	p, _, opt, err := newPool(nil)
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stats := p.Stats()
+	require.EqualValues(t, *endpoint, stats.Address)
+	require.EqualValues(t, opt.MaxIdle, stats.Current)
+	require.EqualValues(t, 1, stats.Ref)
+	require.Contains(t, stats.Options, "MaxIdle:8")
+	require.Contains(t, stats.Options, "Dial:set")
+	require.Contains(t, p.Status(), stats.Fingerprint)
+
+	p2, _, _, err := newPool(nil)
+	require.NoError(t, err)
+	defer p2.Close()
+	require.EqualValues(t, stats.Fingerprint, p2.Stats().Fingerprint)
+
+	opt.MaxIdle = 4
+	p3, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p3.Close()
+	require.NotEqual(t, stats.Fingerprint, p3.Stats().Fingerprint)
+}
+
+func TestCapacity(t *testing.T) {
+	p, _, _, err := newPool(nil)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, StreamCapacity{Connections: 64, StreamsPerConn: 64, TotalStreams: 64 * 64}, p.Capacity())
+
+	opt := DefaultOptions
+	opt.HardMaxConnections = 10
+	hard, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer hard.Close()
+	require.Equal(t, StreamCapacity{Connections: 10, StreamsPerConn: 64, TotalStreams: 640}, hard.Capacity())
+
+	mp, err := NewMulti([]string{startEchoServer(t), startEchoServer(t)}, DefaultOptions)
+	require.NoError(t, err)
+	defer mp.Close()
+	require.Equal(t, StreamCapacity{Connections: 128, StreamsPerConn: 64, TotalStreams: 2 * 64 * 64}, mp.Capacity())
+}
+
+func TestPublishedStats(t *testing.T) {
+	opt := DefaultOptions
+	opt.StatsInterval = 10 * time.Millisecond
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	require.EqualValues(t, opt.MaxIdle, p.Stats().Current)
+
+	// the checkout shows up in the next snapshot
+	conn, err := p.Get()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return p.Stats().Ref == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, conn.Close())
+
+	// the snapshot isn't modified through the stats returned
+	stats := p.Stats()
+	require.NotEmpty(t, stats.Slots)
+	stats.Slots[0].State = ConnClosed
+	require.Equal(t, ConnReady, p.Stats().Slots[0].State)
+
+	// the last snapshot is published by Close
+	require.NoError(t, p.Close())
+	require.EqualValues(t, 0, p.Stats().Current)
+}
+
+func TestGetLockFree(t *testing.T) {
+	p, nativePool, _, err := newPool(nil)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the Gets select from the live conns while e.g. a replace holds the lock
+	nativePool.Lock()
+	got := make(chan error, 1)
+	go func() {
+		c, err := p.Get()
+		if err == nil {
+			err = c.Close()
+		}
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get is blocked by the lock")
+	}
+	nativePool.Unlock()
+
+	// the conns retired since they're published aren't handed out
+	pc := nativePool.conns[0]
+	nativePool.evict(pc, "test")
+	require.Eventually(t, func() bool { return nativePool.liveConns()[0] != pc }, time.Second, time.Millisecond)
+	for i := 0; i < DefaultOptions.MaxIdle; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		require.NotEqual(t, pc.generation, c.Info().Generation)
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestTryAcquireStream(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 3
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.True(t, c.TryAcquireStream())
+	require.True(t, c.TryAcquireStream())
+	require.False(t, c.TryAcquireStream())
+	require.EqualValues(t, 3, p.Stats().Ref)
+
+	c.ReleaseStream()
+	require.EqualValues(t, 2, p.Stats().Ref)
+	require.True(t, c.TryAcquireStream())
+
+	// Close gives back the streams left
+	require.NoError(t, c.Close())
+	require.EqualValues(t, 0, p.Stats().Ref)
+	require.EqualValues(t, 0, nativePool.conns[0].ref)
+	if !debugBuild {
+		require.False(t, c.TryAcquireStream())
+	}
+	c.ReleaseStream()
+	require.EqualValues(t, 0, p.Stats().Ref)
+
+	// the evicted connection is drained by the stream
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.True(t, c.TryAcquireStream())
+	pc := nativePool.conns[0]
+	nativePool.evict(pc, "test")
+	require.Eventually(t, func() bool { return nativePool.liveConns()[0] != pc }, time.Second, time.Millisecond)
+	require.False(t, c.TryAcquireStream())
+	c.ReleaseStream()
+	require.EqualValues(t, 1, atomic.LoadInt32(&pc.ref))
+	require.NotNil(t, pc.cc.Load())
+	require.NoError(t, c.Close())
+	require.Nil(t, pc.cc.Load())
+}
+
+func TestOptions(t *testing.T) {
+	opt := Options{
+		Metadata:            metadata.Pairs("client", "test"),
+		Compressors:         []string{"gzip"},
+		EndpointCompressors: map[string][]string{*endpoint: {"gzip"}},
+		FlapThreshold:       time.Second,
+	}
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the defaults are applied
+	got := p.Options()
+	require.Equal(t, DefaultOptions.MaxIdle, got.MaxIdle)
+	require.Equal(t, DefaultOptions.MaxActive, got.MaxActive)
+	require.Equal(t, DefaultOptions.MaxConcurrentStreams, got.MaxConcurrentStreams)
+	require.Equal(t, []string{"test"}, got.Metadata.Get("client"))
+	require.Equal(t, DefaultFlapHoldDown, got.FlapHoldDown)
+	require.Equal(t, DefaultFlapMaxHoldDown, got.FlapMaxHoldDown)
+	require.Equal(t, DefaultDrainGracePeriod, got.DrainGracePeriod)
+	// but not those of the disabled features
+	require.Zero(t, got.SLAWindow)
+	require.Zero(t, got.CircuitCooldown)
+
+	// modifying the copy doesn't change the pool
+	got.MaxIdle = 1
+	got.Metadata.Set("client", "other")
+	got.Compressors[0] = "other"
+	got.EndpointCompressors[*endpoint][0] = "other"
+	got = p.Options()
+	require.Equal(t, DefaultOptions.MaxIdle, got.MaxIdle)
+	require.Equal(t, []string{"test"}, got.Metadata.Get("client"))
+	require.Equal(t, []string{"gzip"}, got.Compressors)
+	require.Equal(t, []string{"gzip"}, got.EndpointCompressors[*endpoint])
+
+	mp, err := NewMulti([]string{startEchoServer(t)}, opt)
+	require.NoError(t, err)
+	defer mp.Close()
+	require.Equal(t, DefaultOptions.MaxActive, mp.Options().MaxActive)
+}
+
+func TestCloseAbandonsDials(t *testing.T) {
+	for _, drain := range []bool{false, true} {
+		hang := make(chan struct{})
+		late := make(chan *grpc.ClientConn, 1)
+		opt := DefaultOptions
+		opt.MaxIdle = 1
+		opt.MaxActive = 2
+		opt.MaxConcurrentStreams = 1
+		opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+			cc, err := DialTest(req.Target)
+			if req.SlotIndex > 0 {
+				// the growth hangs, ignoring the ctx
+				<-hang
+				late <- cc
+			}
+			return cc, err
+		}
+		p, err := New(*endpoint, opt)
+		require.NoError(t, err)
+		c, err := p.Get()
+		require.NoError(t, err)
+
+		got := make(chan error, 1)
+		go func() {
+			_, err := p.Get()
+			got <- err
+		}()
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&p.(*pool).dialing) == 1
+		}, time.Second, time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			if drain {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				p.Drain(ctx)
+			} else {
+				p.Close()
+			}
+			close(closed)
+		}()
+		require.ErrorIs(t, <-got, ErrClosed)
+		require.NoError(t, c.Close())
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the hung dial blocks closing the pool")
+		}
+
+		// the connection dialed late is closed
+		close(hang)
+		cc := <-late
+		require.Eventually(t, func() bool {
+			return cc.GetState() == connectivity.Shutdown
+		}, time.Second, time.Millisecond)
+		require.Nil(t, p.(*pool).conns[1])
+	}
+}
+
 func TestGetAfterClose(t *testing.T) {
 	p, _, _, err := newPool(nil)
 	require.NoError(t, err)
@@ -238,8 +663,701 @@ func TestConcurrentGet(t *testing.T) {
 	require.EqualValues(t, true, nativePool.conns[opt.MaxIdle] == nil)
 }
 
+func TestMaxCheckoutDuration(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxCheckoutDuration = 10 * time.Millisecond
+	opt.ForceReturn = true
+
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&nativePool.ref))
+
+	time.Sleep(50 * time.Millisecond)
+	require.EqualValues(t, 1, atomic.LoadInt32(&nativePool.expired))
+	require.EqualValues(t, 0, atomic.LoadInt32(&nativePool.ref))
+	require.EqualValues(t, true, conn.Value() != nil)
+
+	// closing a force returned conn doesn't decrease the reference again
+	conn.Close()
+	require.EqualValues(t, 0, atomic.LoadInt32(&nativePool.ref))
+}
+
+func TestDialFunc(t *testing.T) {
+	var mu sync.Mutex
+	var reqs []DialRequest
+
+	opt := DefaultOptions
+	opt.Dial = nil
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		return DialTest(req.Target)
+	}
+	opt.MaxIdle = 2
+	opt.MaxActive = 2
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+
+	conn1, err := p.Get()
+	require.NoError(t, err)
+	conn2, err := p.Get()
+	require.NoError(t, err)
+	conn3, err := p.Get()
+	require.NoError(t, err)
+	conn1.Close()
+	conn2.Close()
+	conn3.Close()
+
+	require.Len(t, reqs, 3)
+	require.EqualValues(t, 0, reqs[0].SlotIndex)
+	require.EqualValues(t, 1, reqs[1].SlotIndex)
+	require.EqualValues(t, -1, reqs[2].SlotIndex)
+	require.EqualValues(t, 1, reqs[0].Attempt)
+	require.EqualValues(t, *endpoint, reqs[0].Target)
+	require.NoError(t, reqs[0].Ctx.Err())
+
+	p.Close()
+	require.Error(t, reqs[0].Ctx.Err())
+}
+
+func TestDrain(t *testing.T) {
+	p, nativePool, _, err := newPool(nil)
+	require.NoError(t, err)
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- p.Drain(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&nativePool.state) == stateClosing
+	}, time.Second, time.Millisecond)
+
+	_, err = p.Get()
+	require.EqualError(t, err, "pool is closing")
+	require.EqualValues(t, true, conn.Value() != nil)
+
+	conn.Close()
+	require.NoError(t, <-done)
+	_, err = p.Get()
+	require.EqualError(t, err, "pool is closed")
+}
+
+func TestDrainTimeout(t *testing.T) {
+	p, nativePool, _, err := newPool(nil)
+	require.NoError(t, err)
+
+	_, err = p.Get()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Drain(ctx), context.DeadlineExceeded)
+	require.EqualValues(t, stateClosed, nativePool.state)
+}
+
+func TestGetRacingClose(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 8
+	opt.MaxConcurrentStreams = 1
+
+	for n := 0; n < 20; n++ {
+		p, _, _, err := newPool(&opt)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		wg.Add(50)
+		for i := 0; i < 50; i++ {
+			go func() {
+				defer wg.Done()
+				conn, err := p.Get()
+				if err != nil {
+					require.Contains(t, []error{ErrClosing, ErrClosed}, err)
+					return
+				}
+				conn.Close()
+			}()
+		}
+		p.Close()
+		wg.Wait()
+	}
+}
+
+func TestConcurrentConnAndPoolClose(t *testing.T) {
+	if debugBuild {
+		t.Skip("closes conns twice")
+	}
+	for n := 0; n < 10; n++ {
+		var mu sync.Mutex
+		var dialed []*grpc.ClientConn
+
+		opt := DefaultOptions
+		opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+			cc, err := DialTest(req.Target)
+			mu.Lock()
+			dialed = append(dialed, cc)
+			mu.Unlock()
+			return cc, err
+		}
+		opt.MaxIdle = 2
+		opt.MaxActive = 4
+		opt.MaxConcurrentStreams = 2
+		opt.Reuse = n%2 == 0
+
+		p, nativePool, _, err := newPool(&opt)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		wg.Add(100)
+		for i := 0; i < 100; i++ {
+			go func() {
+				defer wg.Done()
+				conn, err := p.Get()
+				if err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+				conn.Close()
+				conn.Close()
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		p.Close()
+		wg.Wait()
+
+		require.EqualValues(t, 0, atomic.LoadInt32(&nativePool.ref))
+		mu.Lock()
+		for _, cc := range dialed {
+			require.EqualValues(t, connectivity.Shutdown, cc.GetState())
+		}
+		mu.Unlock()
+	}
+}
+
+func TestHardMaxConnections(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	opt.HardMaxConnections = 2
+
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn1, err := p.Get()
+	require.NoError(t, err)
+	defer conn1.Close()
+
+	conn2, err := p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, true, conn2.(*conn).once)
+
+	_, err = p.Get()
+	require.EqualError(t, err, "pool is exhausted")
+
+	// the one-time connection is closed, so there is room for another
+	conn2.Close()
+	conn3, err := p.Get()
+	require.NoError(t, err)
+	conn3.Close()
+}
+
+func TestHardMaxConnectionsWait(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	opt.HardMaxConnections = 2
+	opt.Wait = true
+
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn1, err := p.Get()
+	require.NoError(t, err)
+	defer conn1.Close()
+	conn2, err := p.Get()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn2.Close()
+	}()
+	conn3, err := p.Get()
+	require.NoError(t, err)
+	conn3.Close()
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 1
+	opt.Reuse = false
+	opt.HardMaxConnections = 1
+	opt.Wait = true
+	opt.AcquireTimeout = 10 * time.Millisecond
+
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = p.Get()
+	require.Equal(t, ErrAcquireTimeout, err)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the shorter deadline of the caller is kept
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDialTimeout(t *testing.T) {
+	faults := NewFaults()
+	faults.DelayDials(time.Hour, time.Hour)
+	opt := DefaultOptions
+	opt.Faults = faults
+	opt.DialTimeout = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err := New(*endpoint, opt)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+}
+
 var size = 4 * 1024 * 1024
 
+func TestLightweightMode(t *testing.T) {
+	require.EqualValues(t, true, unsafe.Sizeof(physicalConn{}) <= connBudget)
+	require.EqualValues(t, true, unsafe.Sizeof(connTracking{}) <= trackingBudget)
+
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 2
+	opt.SLALatency = time.Millisecond
+	opt.QuarantineErrors = 3
+	opt.UsageReport = func([]ConnUsage) {}
+
+	_, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	require.NotNil(t, nativePool.conns[0].track)
+	nativePool.Close()
+
+	opt.LightweightMode = true
+	_, nativePool, _, err = newPool(&opt)
+	require.NoError(t, err)
+	defer nativePool.Close()
+	require.Nil(t, nativePool.conns[0].track)
+	require.Nil(t, nativePool.conns[1].track)
+	require.EqualValues(t, 0, nativePool.opt.SLALatency)
+	require.EqualValues(t, 0, nativePool.opt.QuarantineErrors)
+	require.Nil(t, nativePool.opt.UsageReport)
+
+	// the tracking is kept for the options needing it
+	opt.TestOnBorrow = func(*grpc.ClientConn, time.Duration) error { return nil }
+	_, nativePool, _, err = newPool(&opt)
+	require.NoError(t, err)
+	defer nativePool.Close()
+	require.NotNil(t, nativePool.conns[0].track)
+}
+
+func TestEvictLinger(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the evicted connection drains until it's given back
+	c, err := p.Get()
+	require.NoError(t, err)
+	nativePool.evict(c.(*conn).pc, "test")
+	require.Eventually(t, func() bool {
+		return p.Stats().Draining == 1
+	}, time.Second, time.Millisecond)
+	_, err = c.ClientConn()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.EqualValues(t, 0, p.Stats().Draining)
+
+	// or until EvictLinger passes
+	opt.EvictLinger = 10 * time.Millisecond
+	p, nativePool, _, err = newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+	c, err = p.Get()
+	require.NoError(t, err)
+	nativePool.evict(c.(*conn).pc, "test")
+	require.Eventually(t, func() bool {
+		_, err := c.ClientConn()
+		return err == ErrConnReset && p.Stats().Draining == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, c.Close())
+}
+
+func TestConnInfo(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	info := c.Info()
+	require.EqualValues(t, ConnInfo{Generation: 1, Slot: 0}, info)
+	nativePool.evict(c.(*conn).pc, "test")
+	require.NoError(t, c.Close())
+
+	require.Eventually(t, func() bool {
+		c, err := p.Get()
+		require.NoError(t, err)
+		defer c.Close()
+		return c.Info().Generation > info.Generation
+	}, time.Second, time.Millisecond)
+}
+
+func TestReuseOverflow(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 2
+	opt.Reuse = false
+	opt.ReuseOverflow = true
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	var conns []Conn
+	for i := 0; i < 5; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		conns = append(conns, c)
+	}
+	pc := conns[2].(*conn).pc
+	require.EqualValues(t, -1, pc.slot)
+	require.EqualValues(t, true, pc == conns[3].(*conn).pc)
+	require.EqualValues(t, true, pc != conns[4].(*conn).pc)
+	require.Len(t, nativePool.overflow, 2)
+
+	require.NoError(t, conns[2].Close())
+	require.NotNil(t, pc.cc.Load())
+	require.NoError(t, conns[3].Close())
+	require.Nil(t, pc.cc.Load())
+	require.Len(t, nativePool.overflow, 1)
+	for _, c := range []Conn{conns[0], conns[1], conns[4]} {
+		require.NoError(t, c.Close())
+	}
+	require.Len(t, nativePool.overflow, 0)
+}
+
+func TestOnHighUtilization(t *testing.T) {
+	called := make(chan Stats, 4)
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.MaxConcurrentStreams = 4
+	opt.OnHighUtilization = func(stats Stats) { called <- stats }
+	opt.HighUtilization = 0.5
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	var conns []Conn
+	for i := 0; i < 4; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		conns = append(conns, c)
+	}
+	// fired by the 3rd Get, seeing 2 of 4 streams checked out, and rate-limited
+	stats := <-called
+	require.EqualValues(t, true, stats.Utilization >= 0.5)
+	require.EqualValues(t, 1, p.Stats().Utilization)
+	select {
+	case <-called:
+		t.Fatal("OnHighUtilization isn't rate-limited")
+	case <-time.After(10 * time.Millisecond):
+	}
+	for _, c := range conns {
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestScaleTo(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 2
+	opt.MaxActive = 8
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+	ctx := context.Background()
+
+	require.NoError(t, p.ScaleTo(ctx, 4))
+	require.EqualValues(t, 4, p.Stats().Current)
+
+	// the pool shrinks back to the scaled number, not MaxIdle
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.EqualValues(t, 4, p.Stats().Current)
+
+	require.NoError(t, p.ScaleTo(ctx, 100))
+	require.EqualValues(t, 8, p.Stats().Current)
+	require.NoError(t, p.ScaleTo(ctx, 0))
+	require.EqualValues(t, 2, p.Stats().Current)
+	require.Nil(t, nativePool.conns[2])
+
+	opt.ScaleSchedule = func(time.Time) int { return 3 }
+	opt.ScaleScheduleInterval = 10 * time.Millisecond
+	p, _, _, err = newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Eventually(t, func() bool {
+		return p.Stats().Current == 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestPprofLabels(t *testing.T) {
+	var mu sync.Mutex
+	var labels []string
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		target, _ := pprof.Label(req.Ctx, labelTarget)
+		slot, _ := pprof.Label(req.Ctx, labelSlot)
+		mu.Lock()
+		labels = append(labels, target+"/"+slot)
+		mu.Unlock()
+		return DialTest(req.Target)
+	}
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.EqualValues(t, []string{*endpoint + "/0", *endpoint + "/1"}, labels)
+}
+
+func TestOnDraining(t *testing.T) {
+	type drained struct {
+		info     ConnInfo
+		deadline time.Time
+	}
+	notified := make(chan drained, 8)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.EvictLinger = time.Hour
+	opt.OnDraining = func(info ConnInfo, deadline time.Time) {
+		notified <- drained{info, deadline}
+	}
+
+	// evicted with EvictLinger
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	c, err := p.Get()
+	require.NoError(t, err)
+	nativePool.evict(c.(*conn).pc, "test")
+	d := <-notified
+	require.Equal(t, c.Info(), d.info)
+	require.WithinDuration(t, time.Now().Add(time.Hour), d.deadline, time.Minute)
+	require.NoError(t, c.Close())
+
+	// shut down by Close
+	c, err = p.Get()
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	d = <-notified
+	require.Equal(t, c.Info(), d.info)
+	require.WithinDuration(t, time.Now().Add(DefaultDrainGracePeriod), d.deadline, time.Minute)
+	pc := c.(*conn).pc
+	require.NotNil(t, pc.cc.Load())
+	c.Close()
+	require.Nil(t, pc.cc.Load())
+
+	// drained by the deadline of Drain
+	p, _, _, err = newPool(&opt)
+	require.NoError(t, err)
+	c, err = p.Get()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	got := make(chan drained, 1)
+	go func() {
+		d := <-notified
+		c.Close()
+		got <- d
+	}()
+	require.NoError(t, p.Drain(ctx))
+	deadline, _ := ctx.Deadline()
+	require.Equal(t, deadline, (<-got).deadline)
+	require.Empty(t, notified)
+}
+
+func TestWatchMode(t *testing.T) {
+	type draining struct {
+		deadline time.Time
+		ready    bool
+	}
+	var nativePool *pool
+	drained := make(chan draining, 1)
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.MaxActive = 8
+	opt.MaxConcurrentStreams = 2
+	opt.WatchMode = true
+	opt.EvictLinger = time.Millisecond
+	opt.OnDraining = func(info ConnInfo, deadline time.Time) {
+		cc := nativePool.liveConns()[info.Slot].cc.Load()
+		drained <- draining{deadline, cc.GetState() == connectivity.Ready}
+	}
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool = p.(*pool)
+	require.Equal(t, StreamCapacity{Connections: 2, StreamsPerConn: 2, TotalStreams: 4}, p.Capacity())
+
+	// the streams are packed on MaxIdle connections, and reused beyond them
+	var conns []Conn
+	for i := 0; i < 10; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, c.Info().Slot, 0)
+		conns = append(conns, c)
+	}
+	require.Equal(t, 2, p.Stats().Current)
+
+	// the rotated connection is drained once its replacement is ready, and kept
+	// until its conns are given back
+	pc := conns[0].(*conn).pc
+	nativePool.evict(pc, "test")
+	got := <-drained
+	require.True(t, got.deadline.IsZero())
+	require.True(t, got.ready)
+	time.Sleep(10 * time.Millisecond)
+	_, err = conns[0].ClientConn()
+	require.NoError(t, err)
+	for _, c := range conns {
+		require.NoError(t, c.Close())
+	}
+	require.Nil(t, pc.cc.Load())
+
+	// MaxConcurrentStreams defaults to DefaultWatchConcurrentStreams
+	require.Equal(t, DefaultWatchConcurrentStreams, Options{WatchMode: true}.derive().MaxConcurrentStreams)
+}
+
+func TestShrinkCooldown(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.MaxIdle = 1
+	opt.MaxActive = 4
+	opt.MaxConcurrentStreams = 1
+	opt.ShrinkCooldown = 200 * time.Millisecond
+	p, _, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	burst := func() {
+		conns := make([]Conn, 2)
+		for i := range conns {
+			conns[i], err = p.Get()
+			require.NoError(t, err)
+		}
+		for _, c := range conns {
+			require.NoError(t, c.Close())
+		}
+	}
+	burst()
+	require.EqualValues(t, 2, p.Stats().Current)
+
+	// the connections grown by are kept through the cooldown, the bursts within
+	// it don't grow the pool again
+	time.Sleep(50 * time.Millisecond)
+	burst()
+	require.EqualValues(t, 2, p.Stats().Current)
+	require.EqualValues(t, 2, p.Counters().Dials)
+
+	require.Eventually(t, func() bool {
+		return p.Stats().Current == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestStatsDialing(t *testing.T) {
+	var blocking int32
+	release := make(chan struct{})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 2
+	opt.MaxConcurrentStreams = 1
+	opt.DialFunc = func(req DialRequest) (*grpc.ClientConn, error) {
+		if atomic.LoadInt32(&blocking) == 1 {
+			<-release
+		}
+		return DialTest(req.Target)
+	}
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	c, err := p.Get()
+	require.NoError(t, err)
+	defer c.Close()
+	atomic.StoreInt32(&blocking, 1)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := p.Get()
+			if err == nil {
+				err = c.Close()
+			}
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		s := p.Stats()
+		return s.Dialing == 1 && s.Growing == 2
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	s := p.Stats()
+	require.Equal(t, 0, s.Dialing)
+	require.Equal(t, 0, s.Growing)
+	require.Equal(t, 2, s.Current)
+}
+
 func BenchmarkPoolRPC(b *testing.B) {
 	opt := DefaultOptions
 	p, err := New(*endpoint, opt)
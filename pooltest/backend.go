@@ -0,0 +1,108 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pooltest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/shimingyah/pool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ErrDown is the error of dialing a Backend while it's down.
+var ErrDown = errors.New("pooltest: backend is down")
+
+// Backend is a scripted server, the connections dialed by Dial never reach the
+// network, their unary RPCs are answered by the script at the time of Clock.
+type Backend struct {
+	Clock *Clock
+
+	// Up reports whether the backend is up at now, it's always up when nil. the
+	// dials and RPCs fail while it's down, the RPCs with codes.Unavailable.
+	Up func(now time.Time) bool
+
+	// Latency returns the latency of an RPC at now, Clock is advanced by it.
+	// zero when nil.
+	Latency func(now time.Time) time.Duration
+
+	dials    int64
+	rpcs     int64
+	failures int64
+}
+
+// BackendStats counts what a Backend has served.
+type BackendStats struct {
+	Dials    int
+	RPCs     int
+	Failures int
+}
+
+// Flapping returns an Up which is up for period from start, then down for
+// period, and so on.
+func Flapping(start time.Time, period time.Duration) func(now time.Time) bool {
+	return func(now time.Time) bool {
+		return now.Sub(start)/period%2 == 0
+	}
+}
+
+// Dial is the pool.DialFunc of the backend.
+func (b *Backend) Dial(req pool.DialRequest) (*grpc.ClientConn, error) {
+	atomic.AddInt64(&b.dials, 1)
+	if !b.up() {
+		return nil, ErrDown
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	opts = append(opts, req.DialOptions...)
+	opts = append(opts, grpc.WithChainUnaryInterceptor(b.intercept))
+	return grpc.NewClient("passthrough:///"+req.Target, opts...)
+}
+
+// Stats returns what the backend has served.
+func (b *Backend) Stats() BackendStats {
+	return BackendStats{
+		Dials:    int(atomic.LoadInt64(&b.dials)),
+		RPCs:     int(atomic.LoadInt64(&b.rpcs)),
+		Failures: int(atomic.LoadInt64(&b.failures)),
+	}
+}
+
+func (b *Backend) up() bool {
+	return b.Up == nil || b.Up(b.Clock.Now())
+}
+
+// intercept answers the unary RPCs instead of the server, the health checks
+// are SERVING while the backend is up.
+func (b *Backend) intercept(_ context.Context, _ string, _, reply interface{},
+	_ *grpc.ClientConn, _ grpc.UnaryInvoker, _ ...grpc.CallOption) error {
+	atomic.AddInt64(&b.rpcs, 1)
+	if b.Latency != nil {
+		b.Clock.Advance(b.Latency(b.Clock.Now()))
+	}
+	if !b.up() {
+		atomic.AddInt64(&b.failures, 1)
+		return status.Error(codes.Unavailable, ErrDown.Error())
+	}
+	if res, ok := reply.(*grpc_health_v1.HealthCheckResponse); ok {
+		res.Status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	return nil
+}
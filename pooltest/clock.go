@@ -0,0 +1,131 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pooltest simulates pools deterministically, a Clock driven by the
+// test and a scripted Backend replace the real time and server, so scenarios
+// such as a backend flapping every 30s run in no time against the options of
+// a pool, and their Stats can be asserted.
+package pooltest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shimingyah/pool"
+)
+
+// Clock is a pool.Clock which only moves when it's advanced. the functions of
+// AfterFunc are called by Advance synchronously, the tickers drop the ticks
+// not received like the real ones.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	clock  *Clock
+	when   time.Time
+	period time.Duration
+	f      func()
+	c      chan time.Time
+}
+
+// NewClock return a clock starting at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now see pool.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc see pool.Clock.
+func (c *Clock) AfterFunc(d time.Duration, f func()) pool.Timer {
+	return c.add(&timer{clock: c, when: c.Now().Add(d), f: f})
+}
+
+// NewTicker see pool.Clock.
+func (c *Clock) NewTicker(d time.Duration) pool.Ticker {
+	return ticker{c.add(&timer{clock: c, when: c.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+func (c *Clock) add(t *timer) *timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, the timers and tickers due meanwhile
+// fire in order, the functions of AfterFunc are called before Advance returns.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.now = t.when
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			select {
+			case t.c <- c.now:
+			default:
+			}
+			continue
+		}
+		c.timers = c.timers[1:]
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// remove removes t, and reports whether it was pending.
+func (c *Clock) remove(t *timer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, o := range c.timers {
+		if o == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *timer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+type ticker struct {
+	*timer
+}
+
+func (t ticker) Stop() {
+	t.timer.Stop()
+}
+
+func (t ticker) C() <-chan time.Time {
+	return t.c
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pooltest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool"
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	var fired []int
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := clock.AfterFunc(time.Second, func() { fired = append(fired, 0) })
+	require.EqualValues(t, true, stopped.Stop())
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	clock.Advance(1500 * time.Millisecond)
+	require.EqualValues(t, []int{1}, fired)
+	require.EqualValues(t, time.Unix(1, 0), <-ticker.C())
+	clock.Advance(time.Second)
+	require.EqualValues(t, []int{1, 2}, fired)
+	require.EqualValues(t, time.Unix(2, 0), <-ticker.C())
+	require.EqualValues(t, time.Unix(2, 500000000), clock.Now())
+}
+
+func TestFlappingBackend(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	backend := &Backend{
+		Clock: clock,
+		Up:    Flapping(clock.Now(), 30*time.Second),
+	}
+	opt := pool.DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.DialFunc = backend.Dial
+	opt.Clock = clock
+	opt.QuarantineErrors = 3
+	p, err := pool.New("backend", opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// an RPC every second for 2 minutes, the backend is down half of the time
+	for i := 0; i < 120; i++ {
+		p.Invoke(context.Background(), "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{})
+		clock.Advance(time.Second)
+	}
+	stats := backend.Stats()
+	require.EqualValues(t, 120, stats.RPCs)
+	require.EqualValues(t, 60, stats.Failures)
+	// the connection is quarantined while the backend is down, and replaced
+	require.Eventually(t, func() bool {
+		return backend.Stats().Dials > 1
+	}, time.Second, time.Millisecond)
+	require.EqualValues(t, 1, p.Stats().Current)
+	require.EqualValues(t, 0, p.Stats().Ref)
+}
+
+func TestHealthCheckServed(t *testing.T) {
+	var down int32
+	clock := NewClock(time.Unix(0, 0))
+	backend := &Backend{
+		Clock: clock,
+		Up:    func(time.Time) bool { return atomic.LoadInt32(&down) == 0 },
+	}
+	opt := pool.DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 1
+	opt.DialFunc = backend.Dial
+	opt.Clock = clock
+	opt.HealthCheckInterval = 10 * time.Second
+	p, err := pool.New("backend", opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the connection answering RPCs within HealthCheckInterval isn't checked
+	for i := 0; i < 4; i++ {
+		require.NoError(t, p.Invoke(context.Background(), "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+		clock.Advance(5 * time.Second)
+	}
+
+	// it's checked once idle, the check fails as the backend is down. the ticks
+	// are handled in order, so the checks skipped above would have been made
+	atomic.StoreInt32(&down, 1)
+	clock.Advance(10 * time.Second)
+	require.Eventually(t, func() bool {
+		return backend.Stats().Failures == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 5, backend.Stats().RPCs)
+}
+
+func TestFaultsClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	backend := &Backend{Clock: clock}
+	faults := pool.NewFaults()
+	opt := pool.DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxActive = 2
+	opt.DialFunc = backend.Dial
+	opt.Clock = clock
+	opt.Faults = faults
+	p, err := pool.New("backend", opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the durations of the faults are measured by the pool's clock
+	injected := errors.New("injected")
+	faults.FailGets(injected, time.Minute)
+	_, err = p.Get()
+	require.Equal(t, injected, err)
+	clock.Advance(time.Minute)
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	// and so the delays of the dials
+	faults.DelayDials(time.Hour, 24*time.Hour)
+	done := make(chan error, 1)
+	go func() { done <- p.ScaleTo(context.Background(), 2) }()
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Hour)
+		select {
+		case err := <-done:
+			return err == nil
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, 2, p.Stats().Current)
+}
+
+func TestHedgeClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	backend := &Backend{Clock: clock}
+	opt := pool.DefaultOptions
+	opt.MaxIdle = 2
+	opt.DialFunc = backend.Dial
+	opt.Clock = clock
+	p, err := pool.New("backend", opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the hedge goes out once the delay passes on the pool's clock
+	var calls int32
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Hedge(context.Background(), p, time.Hour, func(ctx context.Context, _ grpc.ClientConnInterface) (int32, error) {
+			if n := atomic.AddInt32(&calls, 1); n > 1 {
+				return n, nil
+			}
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Hour)
+		select {
+		case err := <-done:
+			return err == nil
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	require.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestBudgetClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	backend := &Backend{Clock: clock}
+	budget := pool.NewBudget(0, 1)
+	opt := pool.DefaultOptions
+	opt.MaxIdle = 1
+	opt.DialFunc = backend.Dial
+	opt.Clock = clock
+	opt.Budget = budget
+	opt.Wait = true
+	p, err := pool.New("backend", opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the waits for the budget are measured by the pool's clock
+	c, err := p.Get()
+	require.NoError(t, err)
+	got := make(chan error, 1)
+	go func() {
+		c, err := p.Get()
+		if err == nil {
+			err = c.Close()
+		}
+		got <- err
+	}()
+	require.Eventually(t, func() bool {
+		return budget.Stats().Normal.Waiting == 1
+	}, 5*time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	require.NoError(t, c.Close())
+	require.NoError(t, <-got)
+	require.Equal(t, time.Minute, budget.Stats().Normal.WaitP50)
+}
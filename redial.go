@@ -0,0 +1,80 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// redialBackoff is the first delay between the failed re-dials of a slot whose
+// connection died, it's doubled up to BackoffMaxDelay.
+const redialBackoff = 100 * time.Millisecond
+
+// watch waits for cc of the slot's pc to shut down underneath the pool, e.g. it's
+// closed through Value, then the slot is re-dialed. it returns once the pool
+// closes, or pc is reset or retired by the pool. the state transitions are
+// recorded meanwhile, see transition.
+func (pc *physicalConn) watch(cc *grpc.ClientConn) {
+	p := pc.pool
+	state := cc.GetState()
+	pc.transition(connectivity.Idle, state)
+	for state != connectivity.Shutdown {
+		if !cc.WaitForStateChange(p.ctx, state) {
+			return
+		}
+		next := cc.GetState()
+		pc.transition(state, next)
+		state = next
+	}
+	if pc.cc.Load() != cc || p.stateErr() != nil {
+		return
+	}
+	prev, ok := pc.to(ConnDown)
+	if !ok {
+		return
+	}
+	log.Printf("conn shut down, address: %s, slot: %d\n", p.address, pc.slot)
+	// the replacement of an evicted one re-dials it if it fails
+	if prev == ConnReady {
+		p.redial(pc)
+	}
+}
+
+// redial replaces the dead pc in its slot, it's skipped by the selection
+// meanwhile. the failed dials are retried until the pool closes.
+func (p *pool) redial(pc *physicalConn) {
+	for d := redialBackoff; !p.replace(pc); {
+		if !p.sleep(d) {
+			return
+		}
+		if d *= 2; d > BackoffMaxDelay {
+			d = BackoffMaxDelay
+		}
+	}
+}
+
+// selectable reports whether pc is ready or being replaced, i.e. open and not
+// dead waiting for its re-dial nor retired.
+func (p *pool) selectable(pc *physicalConn) bool {
+	if pc == nil {
+		return false
+	}
+	state := pc.state()
+	return state == ConnReady || state == ConnReplacing
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedial(t *testing.T) {
+	faults := NewFaults()
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.MaxActive = 2
+	opt.Faults = faults
+	p, nativePool, _, err := newPool(&opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the slot is skipped while the connection shut down behind the pool's back
+	// is re-dialed
+	faults.DelayDials(200*time.Millisecond, time.Minute)
+	dead := nativePool.conns[0]
+	dead.cc.Load().Close()
+	require.Eventually(t, func() bool { return dead.state() == ConnDown }, time.Second, time.Millisecond)
+	for i := 0; i < 10; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		require.Equal(t, 1, c.Info().Slot)
+		require.NoError(t, c.Close())
+	}
+
+	// nothing is handed out while all of them are
+	other := nativePool.conns[1]
+	other.cc.Load().Close()
+	require.Eventually(t, func() bool { return other.state() == ConnDown }, time.Second, time.Millisecond)
+	_, err = p.Get()
+	require.Equal(t, ErrNoReadyConn, err)
+	require.Equal(t, 0, p.Stats().Ref)
+
+	faults.Reset()
+	require.Eventually(t, func() bool {
+		return dead.state() == ConnClosed && dead.cc.Load() == nil &&
+			other.state() == ConnClosed && other.cc.Load() == nil
+	}, 5*time.Second, time.Millisecond)
+	redialed := nativePool.liveConns()[0]
+	require.NotEqual(t, dead, redialed)
+	require.NotNil(t, redialed.cc.Load())
+	require.Nil(t, dead.cc.Load())
+	slots := map[int]bool{}
+	for i := 0; i < 10; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		slots[c.Info().Slot] = true
+		require.NoError(t, c.Close())
+	}
+	require.Equal(t, map[int]bool{0: true, 1: true}, slots)
+
+	// the connections reset by the pool aren't re-dialed
+	dials := p.Counters().Dials
+	require.NoError(t, p.Close())
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, ConnClosed, redialed.state())
+	require.Equal(t, dials, p.Counters().Dials)
+	require.Nil(t, nativePool.conns[0])
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// DefaultRegistry is the process-wide registry, the pools join it by setting
+// it as their Options.Registry.
+var DefaultRegistry = NewRegistry()
+
+// Registry lists the pools of the process that join it, providing one metrics
+// exporter and one debug page for all of them. a pool joins when it's created
+// and leaves when it's closed.
+type Registry struct {
+	mu    sync.Mutex
+	seq   uint64
+	pools map[*pool]uint64
+}
+
+// NewRegistry return an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{pools: make(map[*pool]uint64)}
+}
+
+func (r *Registry) join(p *pool) {
+	r.mu.Lock()
+	r.seq++
+	r.pools[p] = r.seq
+	r.mu.Unlock()
+}
+
+func (r *Registry) leave(p *pool) {
+	r.mu.Lock()
+	delete(r.pools, p)
+	r.mu.Unlock()
+}
+
+// RegisteredPool is a pool of a Registry and its stats. Replica tells apart
+// the pools of the same target and identity, it's the ordinal of the pool
+// among them by the order they joined.
+type RegisteredPool struct {
+	Target   string
+	Identity string
+	Replica  int
+	Stats    Stats
+}
+
+// Pools returns the pools of the registry ordered by target, identity and the
+// order they joined. the endpoints of a MultiPool are listed as pools of their
+// own.
+func (r *Registry) Pools() []RegisteredPool {
+	type joined struct {
+		p   *pool
+		seq uint64
+	}
+	r.mu.Lock()
+	pools := make([]joined, 0, len(r.pools))
+	for p, seq := range r.pools {
+		pools = append(pools, joined{p, seq})
+	}
+	r.mu.Unlock()
+
+	sort.Slice(pools, func(i, j int) bool {
+		a, b := pools[i].p, pools[j].p
+		if a.address != b.address {
+			return a.address < b.address
+		}
+		if a.opt.Identity != b.opt.Identity {
+			return a.opt.Identity < b.opt.Identity
+		}
+		return pools[i].seq < pools[j].seq
+	})
+	registered := make([]RegisteredPool, 0, len(pools))
+	for i, j := range pools {
+		rp := RegisteredPool{
+			Target:   j.p.address,
+			Identity: j.p.opt.Identity,
+			Stats:    j.p.Stats(),
+		}
+		if i > 0 && registered[i-1].Target == rp.Target && registered[i-1].Identity == rp.Identity {
+			rp.Replica = registered[i-1].Replica + 1
+		}
+		registered = append(registered, rp)
+	}
+	return registered
+}
+
+// WriteMetrics writes the stats of every pool in the prometheus text format,
+// labeled by target, identity and replica, so the pools of the same target and
+// identity don't write duplicate series.
+func (r *Registry) WriteMetrics(w io.Writer) error {
+	pools := r.Pools()
+	metrics := []struct {
+		name, typ, help string
+		value           func(Stats) float64
+	}{
+		{"pool_connections", "gauge", "The number of physical connections of the pool.",
+			func(s Stats) float64 { return float64(s.Current) }},
+		{"pool_checked_out", "gauge", "The number of logic connections checked out of the pool.",
+			func(s Stats) float64 { return float64(s.Ref) }},
+		{"pool_utilization", "gauge", "The stream utilization of the pool.",
+			func(s Stats) float64 { return s.Utilization }},
+		{"pool_waiting", "gauge", "The number of Gets waiting for a connection or the budget.",
+			func(s Stats) float64 { return float64(s.Waiting) }},
+		{"pool_draining", "gauge", "The number of evicted connections still checked out.",
+			func(s Stats) float64 { return float64(s.Draining) }},
+		{"pool_expired_total", "counter", "The number of checkouts held longer than MaxCheckoutDuration.",
+			func(s Stats) float64 { return float64(s.Expired) }},
+		{"pool_flaps_total", "counter", "The number of connections evicted within FlapThreshold of being dialed.",
+			func(s Stats) float64 { return float64(s.Flaps) }},
+		{"pool_sent_bytes_total", "counter", "The bytes sent on the wire, counted when TrackUsage is set.",
+			func(s Stats) float64 { return float64(s.BytesSent) }},
+		{"pool_received_bytes_total", "counter", "The bytes received on the wire, counted when TrackUsage is set.",
+			func(s Stats) float64 { return float64(s.BytesReceived) }},
+		{"pool_degraded", "gauge", "1 if the pool is degraded by consecutive failed Gets.",
+			func(s Stats) float64 {
+				if s.Degraded {
+					return 1
+				}
+				return 0
+			}},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ); err != nil {
+			return err
+		}
+		for _, p := range pools {
+			if _, err := fmt.Fprintf(w, "%s{target=%q,identity=%q,replica=\"%d\"} %v\n",
+				m.name, p.Target, p.Identity, p.Replica, m.value(p.Stats)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MetricsHandler serves WriteMetrics, e.g. on /metrics.
+func (r *Registry) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteMetrics(w)
+	})
+}
+
+// DebugHandler serves a page listing every pool with its target and key stats,
+// e.g. on /debug/pools.
+func (r *Registry) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TARGET\tIDENTITY\tREPLICA\tCURRENT\tREF\tUTILIZATION\tWAITING\tDRAINING\tEXPIRED\tFLAPS\tFINGERPRINT")
+		for _, p := range r.Pools() {
+			s := p.Stats
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%.2f\t%d\t%d\t%d\t%d\t%s\n", p.Target, p.Identity,
+				p.Replica, s.Current, s.Ref, s.Utilization, s.Waiting, s.Draining, s.Expired, s.Flaps, s.Fingerprint)
+		}
+		tw.Flush()
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.Registry = r
+	p1, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p1.Close()
+	opt.Identity = "tenant"
+	p2, err := New(*endpoint, opt)
+	require.NoError(t, err)
+
+	pools := r.Pools()
+	require.Len(t, pools, 2)
+	require.Equal(t, "", pools[0].Identity)
+	require.Equal(t, "tenant", pools[1].Identity)
+	require.Equal(t, 2, pools[1].Stats.Current)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteMetrics(&buf))
+	require.Contains(t, buf.String(), "# TYPE pool_connections gauge\n")
+	require.Contains(t, buf.String(), `pool_connections{target="`+*endpoint+`",identity="tenant",replica="0"} 2`)
+
+	rec := httptest.NewRecorder()
+	r.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pools", nil))
+	require.Contains(t, rec.Body.String(), "tenant")
+	require.Contains(t, rec.Body.String(), p1.Stats().Fingerprint)
+
+	rec = httptest.NewRecorder()
+	r.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Contains(t, rec.Body.String(), "pool_flaps_total")
+
+	// the pools of the same target and identity are told apart
+	opt.Identity = ""
+	p3, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	pools = r.Pools()
+	require.Len(t, pools, 3)
+	require.Equal(t, []int{0, 1, 0}, []int{pools[0].Replica, pools[1].Replica, pools[2].Replica})
+	buf.Reset()
+	require.NoError(t, r.WriteMetrics(&buf))
+	require.Contains(t, buf.String(), `pool_connections{target="`+*endpoint+`",identity="",replica="1"} 2`)
+	require.NoError(t, p3.Close())
+
+	require.NoError(t, p2.Close())
+	require.Len(t, r.Pools(), 1)
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import "sync/atomic"
+
+// retryTokenUnit is the fixed-point unit of the tokens of a RetryBudget.
+const retryTokenUnit = 1000
+
+// RetryBudget is a token bucket capping the pool-level retries, those of
+// NewStreamRetries and the hedges of Hedge, at a ratio of the requests, so
+// they can't amplify the load on a struggling backend. every request earns
+// ratio of a token up to burst tokens, every retry or hedge spends one. the
+// pools share it by setting the same RetryBudget in their Options.
+type RetryBudget struct {
+	// atomic, in retryTokenUnit.
+	tokens int64
+
+	earn, max int64
+
+	// atomic, the number of retries allowed and throttled.
+	retried   int64
+	throttled int64
+}
+
+// RetryBudgetStats is a snapshot of the usage of a RetryBudget.
+type RetryBudgetStats struct {
+	// Tokens is the number of retries the budget allows now.
+	Tokens float64
+
+	// Retried is the number of retries and hedges allowed.
+	Retried int
+
+	// Throttled is the number of retries and hedges denied.
+	Throttled int
+}
+
+// NewRetryBudget return a retry budget allowing ratio of the requests to be
+// retried, e.g. 0.1, with bursts of up to burst retries. it starts full. the
+// negative ratio and burst are taken as zero, the budget denies every retry.
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	if ratio < 0 {
+		ratio = 0
+	}
+	if burst < 0 {
+		burst = 0
+	}
+	full := int64(burst) * retryTokenUnit
+	return &RetryBudget{
+		tokens: full,
+		earn:   int64(ratio * retryTokenUnit),
+		max:    full,
+	}
+}
+
+// Stats returns the usage of the budget.
+func (b *RetryBudget) Stats() RetryBudgetStats {
+	return RetryBudgetStats{
+		Tokens:    float64(atomic.LoadInt64(&b.tokens)) / retryTokenUnit,
+		Retried:   int(atomic.LoadInt64(&b.retried)),
+		Throttled: int(atomic.LoadInt64(&b.throttled)),
+	}
+}
+
+// request earns the tokens of a request, b may be nil.
+func (b *RetryBudget) request() {
+	if b == nil {
+		return
+	}
+	for {
+		tokens := atomic.LoadInt64(&b.tokens)
+		if tokens >= b.max {
+			return
+		}
+		next := tokens + b.earn
+		if next > b.max {
+			next = b.max
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, tokens, next) {
+			return
+		}
+	}
+}
+
+// retry spends a token, it reports false if there is none. a nil budget allows
+// every retry.
+func (b *RetryBudget) retry() bool {
+	if b == nil {
+		return true
+	}
+	for {
+		tokens := atomic.LoadInt64(&b.tokens)
+		if tokens < retryTokenUnit {
+			atomic.AddInt64(&b.throttled, 1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, tokens, tokens-retryTokenUnit) {
+			atomic.AddInt64(&b.retried, 1)
+			return true
+		}
+	}
+}
+
+// retryBudgeted is implemented by the pools of this package.
+type retryBudgeted interface {
+	retryBudget() *RetryBudget
+}
+
+// retryBudgetOf returns the RetryBudget of p, nil if it has none.
+func retryBudgetOf(p Pool) *RetryBudget {
+	if rb, ok := p.(retryBudgeted); ok {
+		return rb.retryBudget()
+	}
+	return nil
+}
+
+func (p *pool) retryBudget() *RetryBudget {
+	return p.opt.RetryBudget
+}
+
+func (mp *multiPool) retryBudget() *RetryBudget {
+	return mp.opt.RetryBudget
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := NewRetryBudget(0.5, 2)
+
+	// it starts full
+	require.True(t, b.retry())
+	require.True(t, b.retry())
+	require.False(t, b.retry())
+
+	// every request earns ratio of a token
+	b.request()
+	require.False(t, b.retry())
+	b.request()
+	require.True(t, b.retry())
+
+	// up to burst tokens
+	for i := 0; i < 10; i++ {
+		b.request()
+	}
+	require.Equal(t, RetryBudgetStats{Tokens: 2, Retried: 3, Throttled: 2}, b.Stats())
+
+	// the negative ratio and burst allow none
+	b = NewRetryBudget(-1, -1)
+	b.request()
+	require.False(t, b.retry())
+	require.Equal(t, RetryBudgetStats{Throttled: 1}, b.Stats())
+
+	// a nil budget allows every retry
+	var nilBudget *RetryBudget
+	nilBudget.request()
+	require.True(t, nilBudget.retry())
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// ScaleTo see Pool interface.
+func (p *pool) ScaleTo(ctx context.Context, n int) error {
+	if n < p.opt.MaxIdle {
+		n = p.opt.MaxIdle
+	}
+	if n > p.opt.MaxActive {
+		n = p.opt.MaxActive
+	}
+
+	if n > int(atomic.LoadInt32(&p.current)) {
+		if err := p.delayDial(); err != nil {
+			return err
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	if err := p.stateErr(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&p.floor, int32(n))
+	current := atomic.LoadInt32(&p.current)
+	if current >= int32(n) {
+		// the connections in use are reset once they are idle, see decrRef
+		if atomic.LoadInt32(&p.ref) == 0 {
+			p.shrink()
+		}
+		return nil
+	}
+
+	var err error
+	from := current
+	for ; current < int32(n); current++ {
+		pc, er := p.dial(ctx, int(current), false)
+		if er != nil {
+			err = er
+			break
+		}
+		p.reset(int(current))
+		p.conns[current] = pc
+	}
+	log.Printf("scale pool: %d ---> %d, target: %d, maxActive: %d\n", from, current, n, p.opt.MaxActive)
+	atomic.StoreInt32(&p.current, current)
+	p.publishConns()
+	return err
+}
+
+// scaleBySchedule scales the pool by ScaleSchedule every ScaleScheduleInterval
+// until the pool is closed.
+func (p *pool) scaleBySchedule() {
+	interval := p.opt.ScaleScheduleInterval
+	if interval <= 0 {
+		interval = DefaultScaleScheduleInterval
+	}
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+			if err := p.ScaleTo(p.ctx, p.opt.ScaleSchedule(p.clock.Now())); err != nil {
+				log.Printf("scale pool by schedule failed, address: %s, err: %v\n", p.address, err)
+			}
+		}
+	}
+}
+
+// ScaleTo see Pool interface. every endpoint is scaled to n.
+func (mp *multiPool) ScaleTo(ctx context.Context, n int) error {
+	endpoints, _ := mp.snapshot()
+	errs := make([]error, 0, len(endpoints))
+	for _, e := range endpoints {
+		errs = append(errs, e.pool.ScaleTo(ctx, n))
+	}
+	return errors.Join(errs...)
+}
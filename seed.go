@@ -0,0 +1,41 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// seededRand is a rand.Rand safe for concurrent use, see Options.Seed.
+type seededRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newSeededRand(seed int64) *seededRand {
+	return &seededRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// random returns a number in [0, 1) from the source seeded by Seed, or from
+// the global one.
+func (p *pool) random() float64 {
+	if p.rand == nil {
+		return rand.Float64()
+	}
+	p.rand.mu.Lock()
+	defer p.rand.mu.Unlock()
+	return p.rand.r.Float64()
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeed(t *testing.T) {
+	drops := func(seed int64) (int, []float64) {
+		opt := DefaultOptions
+		opt.MaxIdle = 32
+		opt.Seed = seed
+		opt.Faults = NewFaults()
+		p, err := New(*endpoint, opt)
+		require.NoError(t, err)
+		defer p.Close()
+
+		dropped := opt.Faults.DropConnections(0.5, 0)
+		randoms := make([]float64, 8)
+		for i := range randoms {
+			randoms[i] = p.(*pool).random()
+		}
+		return dropped, randoms
+	}
+
+	dropped, randoms := drops(42)
+	for i := 0; i < 3; i++ {
+		d, r := drops(42)
+		require.Equal(t, dropped, d)
+		require.Equal(t, randoms, r)
+	}
+	_, r := drops(43)
+	require.NotEqual(t, randoms, r)
+}
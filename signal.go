@@ -0,0 +1,87 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HandleSignals drains p on the first of sigs, SIGTERM and os.Interrupt when
+// none, bounded by DrainGracePeriod, so that services shut down gracefully with
+// a one-liner. the signals stay handled until stop is called, the process isn't
+// terminated by them, so the caller exits once its own shutdown is done, e.g.
+// on the same signals of its signal.Notify. stop stops handling the signals,
+// and the drain if p isn't drained yet.
+func HandleSignals(p Pool, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+	go drainOn(p, ch, done)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// drainOn drains p on the first signal of ch, until done is closed. it returns
+// the signal p is drained on, nil if done is closed first.
+func drainOn(p Pool, ch <-chan os.Signal, done <-chan struct{}) os.Signal {
+	select {
+	case <-done:
+		return nil
+	case sig := <-ch:
+		grace := drainGracePeriodOf(p)
+		log.Printf("draining pool on %v, grace period: %v\n", sig, grace)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := p.Drain(ctx); err != nil {
+			log.Printf("drain pool on %v failed: %v\n", sig, err)
+		}
+		return sig
+	}
+}
+
+// graced is implemented by the pools of this package.
+type graced interface {
+	drainGracePeriod() time.Duration
+}
+
+// drainGracePeriodOf returns the DrainGracePeriod of p, the default if unset.
+func drainGracePeriodOf(p Pool) time.Duration {
+	if g, ok := p.(graced); ok && g.drainGracePeriod() > 0 {
+		return g.drainGracePeriod()
+	}
+	return DefaultDrainGracePeriod
+}
+
+func (p *pool) drainGracePeriod() time.Duration {
+	return p.opt.DrainGracePeriod
+}
+
+func (mp *multiPool) drainGracePeriod() time.Duration {
+	return mp.opt.DrainGracePeriod
+}
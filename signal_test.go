@@ -0,0 +1,98 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainOnSignal(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.DrainGracePeriod = 20 * time.Millisecond
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	require.Equal(t, 20*time.Millisecond, drainGracePeriodOf(p))
+
+	c, err := p.Get()
+	require.NoError(t, err)
+
+	ch := make(chan os.Signal, 1)
+	drained := make(chan os.Signal, 1)
+	go func() {
+		drained <- drainOn(p, ch, make(chan struct{}))
+	}()
+	ch <- syscall.SIGTERM
+
+	// the pool is closed once the grace period passes
+	start := time.Now()
+	require.Equal(t, syscall.SIGTERM, <-drained)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	_, err = p.Get()
+	require.Equal(t, ErrClosed, err)
+	require.NoError(t, c.Close())
+}
+
+func TestHandleSignalsStop(t *testing.T) {
+	p, err := New(*endpoint, DefaultOptions)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, DefaultDrainGracePeriod, drainGracePeriodOf(p))
+
+	stop := HandleSignals(p)
+	stop()
+	stop()
+	c, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+}
+
+func TestHandleSignalsNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals can't be sent on windows")
+	}
+	p, err := New(*endpoint, DefaultOptions)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the signal is delivered to the application's own channel too, and the
+	// process keeps running once the pool is drained
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	stop := HandleSignals(p, syscall.SIGHUP)
+	defer stop()
+
+	proc, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, proc.Signal(syscall.SIGHUP))
+	select {
+	case sig := <-ch:
+		require.Equal(t, syscall.SIGHUP, sig)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the signal isn't delivered to the application")
+	}
+	require.Eventually(t, func() bool {
+		_, err := p.Get()
+		return err == ErrClosed
+	}, 5*time.Second, time.Millisecond)
+}
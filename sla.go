@@ -0,0 +1,97 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySamples is the number of recent latencies kept per connection.
+	latencySamples = 64
+
+	// minLatencySamples is the number of samples needed before p99 is judged.
+	minLatencySamples = 10
+)
+
+// latencyWindow keeps the recent latencies of a connection in a ring.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	pos     int
+	count   int
+
+	// since when the p99 exceeds SLALatency, zero if it doesn't.
+	breachSince time.Time
+}
+
+// observe adds a latency at now and reports whether the p99 has exceeded sla
+// for window.
+func (w *latencyWindow) observe(now time.Time, d, sla, window time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.addLocked(d)
+	if w.count < minLatencySamples {
+		return false
+	}
+
+	if w.p99() <= sla {
+		w.breachSince = time.Time{}
+		return false
+	}
+	if w.breachSince.IsZero() {
+		w.breachSince = now
+	}
+	return now.Sub(w.breachSince) >= window
+}
+
+// add adds a latency to the window.
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.addLocked(d)
+}
+
+func (w *latencyWindow) addLocked(d time.Duration) {
+	w.samples[w.pos] = d
+	w.pos = (w.pos + 1) % latencySamples
+	if w.count < latencySamples {
+		w.count++
+	}
+}
+
+// percentile returns the p-th percentile of the latencies, zero if there are none.
+func (w *latencyWindow) percentile(p int) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.count == 0 {
+		return 0
+	}
+	return w.percentileLocked(p)
+}
+
+func (w *latencyWindow) percentileLocked(p int) time.Duration {
+	sorted := make([]time.Duration, w.count)
+	copy(sorted, w.samples[:w.count])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(w.count*p-1)/100]
+}
+
+func (w *latencyWindow) p99() time.Duration {
+	return w.percentileLocked(99)
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+)
+
+// smokeTest lists the services of the server through the first connection
+// dialed, see Options.SmokeTest. the pool is degraded if it fails.
+func (p *pool) smokeTest() {
+	for i := range p.report {
+		r := &p.report[i]
+		if r.State != SlotDialed {
+			continue
+		}
+		r.SmokeTested = true
+		r.SmokeErr = p.listServices(p.conns[i])
+		// the smoke test isn't the last RPC of TestOnReturn
+		if pc := p.conns[i]; pc.track != nil {
+			pc.track.lastErr.Store(nil)
+		}
+		if r.SmokeErr != nil {
+			log.Printf("pool smoke test failed, address: %s, err: %v\n", p.address, r.SmokeErr)
+			atomic.StoreInt32(&p.degraded, 1)
+		}
+		return
+	}
+}
+
+// listServices calls the ListServices of the server reflection through pc.
+func (p *pool) listServices(pc *physicalConn) error {
+	cc := pc.cc.Load()
+	if cc == nil {
+		return ErrConnReset
+	}
+	timeout := p.opt.DialTimeout
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+
+	stream, err := rpb.NewServerReflectionClient(cc).ServerReflectionInfo(ctx)
+	var res *rpb.ServerReflectionResponse
+	if err == nil {
+		// a failed Send surfaces as the error of Recv
+		stream.Send(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+		})
+		res, err = stream.Recv()
+	}
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if e := res.GetErrorResponse(); e != nil {
+		return fmt.Errorf("server reflection: %s", e.GetErrorMessage())
+	}
+	return nil
+}
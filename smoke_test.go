@@ -0,0 +1,72 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+func TestSmokeTest(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.SmokeTest = true
+	smokeTested := func(address string) (Pool, SlotDialResult) {
+		p, err := New(address, opt)
+		require.NoError(t, err)
+		t.Cleanup(func() { p.Close() })
+		report := p.InitialDialReport()
+		require.True(t, report[0].SmokeTested)
+		for _, r := range report[1:] {
+			require.False(t, r.SmokeTested)
+		}
+		return p, report[0]
+	}
+
+	// the server registers reflection
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	reflection.Register(s)
+	go s.Serve(listen)
+	t.Cleanup(s.Stop)
+	p, r := smokeTested(listen.Addr().String())
+	require.NoError(t, r.SmokeErr)
+	require.True(t, p.Healthy())
+
+	// reflection isn't registered, the RPC completes anyhow
+	p, r = smokeTested(startEchoServer(t))
+	require.NoError(t, r.SmokeErr)
+	require.True(t, p.Healthy())
+
+	// the server fails the RPCs
+	failing := startEchoServer(t, grpc.UnknownServiceHandler(func(interface{}, grpc.ServerStream) error {
+		return status.Error(codes.Internal, "broken")
+	}))
+	p, r = smokeTested(failing)
+	require.Equal(t, codes.Internal, status.Code(r.SmokeErr))
+	require.False(t, p.Healthy())
+	c, err := p.GetContext(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.True(t, p.Healthy())
+}
@@ -0,0 +1,298 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the state of pool.
+type Stats struct {
+	// Address is the server address of the pool.
+	Address string
+
+	// Key is the canonical address and the identity of the pool, the pools of a
+	// Manager are keyed by it. it's zero for a MultiPool.
+	Key Key
+
+	// Current is the number of physical connections of the pool.
+	Current int
+
+	// Ref is the number of logic connections checked out of the pool.
+	Ref int
+
+	// Expired is the number of checkouts held longer than MaxCheckoutDuration.
+	Expired int
+
+	// Utilization is Ref over the streams of MaxActive connections, it exceeds 1
+	// when the connections are reused beyond MaxConcurrentStreams.
+	Utilization float64
+
+	// Waiting is the number of Gets waiting for a connection or the Budget.
+	Waiting int
+
+	// Dialing is the number of dials in flight, including the replacements and
+	// the one-time connections. Growing is the number of Gets waiting for the
+	// pool to grow, they tell a pool growing on slow dials from one at capacity.
+	Dialing int
+	Growing int
+
+	// Draining is the number of evicted connections waiting for their checked
+	// out conns to be given back.
+	Draining int
+
+	// Flaps is the number of connections evicted within FlapThreshold of being
+	// dialed.
+	Flaps int
+
+	// Disconnects is the number of times the connections lost their transport
+	// after being ready, they're re-connected. the unused connections dropping
+	// to IDLE are skipped, as entering the idle mode, see IdleTimeout, looks the
+	// same as a lost transport nobody noticed. KeepaliveTimeouts and GoAways are
+	// the disconnects whose failed RPCs tell the cause: the keepalive pings
+	// unanswered, e.g. a middlebox dropping the idle connections, or the server
+	// going away, e.g. on deploys. the dial failures are Counters.DialErrors.
+	Disconnects       int
+	KeepaliveTimeouts int
+	GoAways           int
+
+	// RejectProbability is the probability Get is throttled, see ThrottleK. it's
+	// the highest of the endpoints of a MultiPool.
+	RejectProbability float64
+
+	// StreamLimit is the effective MaxConcurrentStreams of the connections, see
+	// AdaptiveStreamsLatency. it's the lowest of the endpoints of a MultiPool.
+	StreamLimit int
+
+	// BytesSent and BytesReceived are the bytes on the wire of all of the
+	// connections ever dialed, counted when TrackUsage is set.
+	BytesSent     int64
+	BytesReceived int64
+
+	// Connections are the usages of the pool's connections when TrackUsage is
+	// set, nil for a MultiPool.
+	Connections []ConnUsage
+
+	// Slots are the states of the connections in the pool's slots, nil for a
+	// MultiPool. the retired ones are counted in Draining.
+	Slots []ConnStatus
+
+	// AgedStreams is the number of streams exceeded MaxStreamAge, Streams are the
+	// ages of the active streams, when MaxStreamAge is set.
+	AgedStreams int
+	Streams     []StreamAge
+
+	// Degraded is true while the pool is degraded, see MaxGetFailures. it's true
+	// if all of the endpoints of a MultiPool are degraded.
+	Degraded bool
+
+	// Options is a summary of the options in effect, secrets are redacted.
+	Options string
+
+	// Fingerprint is a hash of Options, it tells which configuration is in effect.
+	Fingerprint string
+
+	// Endpoints are the states of the endpoints of a MultiPool.
+	Endpoints []EndpointStats
+}
+
+// Stats see Pool interface.
+func (p *pool) Stats() Stats {
+	if s := p.published.Load(); s != nil {
+		return s.clone()
+	}
+	return p.collect()
+}
+
+// clone returns a copy of s whose slices aren't shared with s, so the callers
+// can't modify the published stats.
+func (s Stats) clone() Stats {
+	s.Connections = slices.Clone(s.Connections)
+	s.Slots = slices.Clone(s.Slots)
+	s.Streams = slices.Clone(s.Streams)
+	s.Endpoints = slices.Clone(s.Endpoints)
+	return s
+}
+
+// collect reads the stats from the counters of the pool.
+func (p *pool) collect() Stats {
+	var connections []ConnUsage
+	if p.opt.TrackUsage {
+		connections = p.connUsage()
+	}
+	var streams []StreamAge
+	if p.opt.MaxStreamAge > 0 {
+		streams = p.streamAges()
+	}
+	return Stats{
+		Address:           p.address,
+		Key:               p.key,
+		Current:           int(atomic.LoadInt32(&p.current)),
+		Ref:               int(atomic.LoadInt32(&p.ref)),
+		Expired:           int(atomic.LoadInt32(&p.expired)),
+		Utilization:       p.utilization(),
+		Waiting:           int(atomic.LoadInt32(&p.waiting)),
+		Dialing:           int(atomic.LoadInt32(&p.dialing)),
+		Growing:           int(atomic.LoadInt32(&p.growing)),
+		Draining:          int(atomic.LoadInt32(&p.draining)),
+		Flaps:             int(atomic.LoadInt32(&p.flapped)),
+		Disconnects:       int(atomic.LoadInt32(&p.disconnects)),
+		KeepaliveTimeouts: int(atomic.LoadInt32(&p.keepaliveTimeouts)),
+		GoAways:           int(atomic.LoadInt32(&p.goAways)),
+		RejectProbability: p.rejectProbability(),
+		StreamLimit:       int(p.streamLimit()),
+		BytesSent:         atomic.LoadInt64(&p.bytesSent),
+		BytesReceived:     atomic.LoadInt64(&p.bytesReceived),
+		Connections:       connections,
+		Slots:             p.slotStatuses(),
+		AgedStreams:       int(atomic.LoadInt32(&p.agedStreamCount)),
+		Streams:           streams,
+		Degraded:          !p.Healthy(),
+		Options:           p.summary,
+		Fingerprint:       p.fingerprint,
+	}
+}
+
+// publish swaps in a new snapshot of the stats, see StatsInterval.
+func (p *pool) publish() {
+	s := p.collect()
+	p.published.Store(&s)
+}
+
+// publishStats publishes the stats every StatsInterval until the pool is closed.
+func (p *pool) publishStats() {
+	ticker := p.clock.NewTicker(p.opt.StatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+			p.publish()
+		}
+	}
+}
+
+// StreamCapacity is the capacity of a pool, see Pool.Capacity.
+type StreamCapacity struct {
+	// Connections is MaxActive, capped by HardMaxConnections.
+	Connections int
+
+	// StreamsPerConn is the effective MaxConcurrentStreams, see
+	// AdaptiveStreamsLatency. it's the lowest of the endpoints of a MultiPool.
+	StreamsPerConn int
+
+	// TotalStreams is Connections times StreamsPerConn, summed over the endpoints
+	// of a MultiPool.
+	TotalStreams int
+}
+
+// Capacity see Pool interface.
+func (p *pool) Capacity() StreamCapacity {
+	c := StreamCapacity{Connections: p.opt.MaxActive, StreamsPerConn: int(p.streamLimit())}
+	if p.opt.WatchMode {
+		c.Connections = p.opt.MaxIdle
+	}
+	if hard := p.opt.HardMaxConnections; hard > 0 && hard < c.Connections {
+		c.Connections = hard
+	}
+	c.TotalStreams = c.Connections * c.StreamsPerConn
+	return c
+}
+
+// utilization returns the stream utilization, see Stats.
+func (p *pool) utilization() float64 {
+	return float64(atomic.LoadInt32(&p.ref)) / float64(p.opt.MaxActive*p.opt.MaxConcurrentStreams)
+}
+
+// checkUtilization calls OnHighUtilization if a threshold is crossed, unless
+// it's called within HighUtilizationInterval.
+func (p *pool) checkUtilization() {
+	high, waiters := p.opt.HighUtilization, p.opt.HighWaiters
+	if high <= 0 && waiters <= 0 {
+		high = DefaultHighUtilization
+	}
+	if !(high > 0 && p.utilization() >= high ||
+		waiters > 0 && int(atomic.LoadInt32(&p.waiting)) >= waiters) {
+		return
+	}
+
+	interval := p.opt.HighUtilizationInterval
+	if interval <= 0 {
+		interval = DefaultHighUtilizationInterval
+	}
+	now := p.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&p.highUtilizationAt)
+	if last != 0 && now-last < int64(interval) || !atomic.CompareAndSwapInt64(&p.highUtilizationAt, last, now) {
+		return
+	}
+	stats := p.collect()
+	p.spawn("high-utilization", -2, func() { p.opt.OnHighUtilization(stats) })
+}
+
+// summarize returns a summary of the options. functions are summarized as set
+// or not, interfaces and pointers by their type, slices of them by length, maps
+// by their keys only, so secrets such as tokens in metadata never show up.
+func summarize(opt Options) string {
+	v := reflect.ValueOf(opt)
+	fields := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		var s string
+		switch f.Kind() {
+		case reflect.Func:
+			s = "nil"
+			if !f.IsNil() {
+				s = "set"
+			}
+		case reflect.Interface, reflect.Ptr:
+			s = "nil"
+			if !f.IsNil() {
+				s = fmt.Sprintf("%T", f.Interface())
+			}
+		case reflect.Slice:
+			s = fmt.Sprint(f.Interface())
+			switch f.Type().Elem().Kind() {
+			case reflect.Func, reflect.Interface, reflect.Ptr:
+				s = fmt.Sprintf("[%d]", f.Len())
+			}
+		case reflect.Map:
+			keys := make([]string, 0, f.Len())
+			for _, k := range f.MapKeys() {
+				keys = append(keys, fmt.Sprint(k.Interface()))
+			}
+			sort.Strings(keys)
+			s = "[" + strings.Join(keys, " ") + "]"
+		default:
+			s = fmt.Sprint(f.Interface())
+		}
+		fields = append(fields, v.Type().Field(i).Name+":"+s)
+	}
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// fingerprint returns a short hash of the summary of options.
+func fingerprint(summary string) string {
+	sum := sha256.Sum256([]byte(summary))
+	return hex.EncodeToString(sum[:8])
+}
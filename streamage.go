@@ -0,0 +1,150 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// streamWatch holds the active streams of a pool, see MaxStreamAge.
+type streamWatch struct {
+	mu      sync.Mutex
+	streams map[*agedStream]struct{}
+}
+
+// agedStream is an active stream watched for its age.
+type agedStream struct {
+	grpc.ClientStream
+	pc      *physicalConn
+	desc    *grpc.StreamDesc
+	method  string
+	started time.Time
+	cancel  context.CancelFunc
+
+	// set once the stream exceeds MaxStreamAge, so it's reported once.
+	aged bool
+}
+
+func (s *agedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.desc.ServerStreams {
+		s.cancel()
+	}
+	return err
+}
+
+// streamAgeInterceptor watches the age of the streams, they're unwatched once
+// they finish or their ctx is done.
+func (pc *physicalConn) streamAgeInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	p := pc.pool
+	s := &agedStream{ClientStream: cs, pc: pc, desc: desc, method: method, started: p.clock.Now(), cancel: cancel}
+	p.watch.mu.Lock()
+	if p.watch.streams == nil {
+		p.watch.streams = make(map[*agedStream]struct{})
+	}
+	p.watch.streams[s] = struct{}{}
+	p.watch.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		p.watch.mu.Lock()
+		delete(p.watch.streams, s)
+		p.watch.mu.Unlock()
+	})
+	return s, nil
+}
+
+// minStreamAgeInterval bounds how often the streams are checked, so a tiny
+// MaxStreamAge doesn't spin the watchdog nor make a ticker of zero.
+const minStreamAgeInterval = time.Millisecond
+
+// watchStreams checks the age of the active streams every half MaxStreamAge, at
+// least minStreamAgeInterval, until the pool is closed. the streams exceeding it
+// are logged, and canceled if CancelAgedStreams is set.
+func (p *pool) watchStreams() {
+	interval := p.opt.MaxStreamAge / 2
+	if interval < minStreamAgeInterval {
+		interval = minStreamAgeInterval
+	}
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+			for _, s := range p.agedStreams() {
+				log.Printf("stream exceeds max age, address: %s, slot: %d, method: %s, age: %v, cancel: %v\n",
+					p.address, s.pc.slot, s.method, p.clock.Now().Sub(s.started), p.opt.CancelAgedStreams)
+				if p.opt.CancelAgedStreams {
+					s.cancel()
+				}
+			}
+		}
+	}
+}
+
+// agedStreams returns the streams newly exceeding MaxStreamAge.
+func (p *pool) agedStreams() []*agedStream {
+	now := p.clock.Now()
+	p.watch.mu.Lock()
+	defer p.watch.mu.Unlock()
+
+	var aged []*agedStream
+	for s := range p.watch.streams {
+		if !s.aged && now.Sub(s.started) >= p.opt.MaxStreamAge {
+			s.aged = true
+			aged = append(aged, s)
+		}
+	}
+	atomic.AddInt32(&p.agedStreamCount, int32(len(aged)))
+	return aged
+}
+
+// StreamAge is the age of an active stream, see MaxStreamAge.
+type StreamAge struct {
+	// Address and Slot are the server address and the index of the pool's slot
+	// the stream is on.
+	Address string
+	Slot    int
+
+	Method string
+	Age    time.Duration
+}
+
+// streamAges returns the ages of the active streams.
+func (p *pool) streamAges() []StreamAge {
+	now := p.clock.Now()
+	p.watch.mu.Lock()
+	defer p.watch.mu.Unlock()
+
+	ages := make([]StreamAge, 0, len(p.watch.streams))
+	for s := range p.watch.streams {
+		ages = append(ages, StreamAge{Address: p.address, Slot: s.pc.slot, Method: s.method, Age: now.Sub(s.started)})
+	}
+	return ages
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaxStreamAge(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.MaxStreamAge = 20 * time.Millisecond
+	opt.CancelAgedStreams = true
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the streams finished are unwatched
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+	c, err := p.Get()
+	require.NoError(t, err)
+	defer c.Close()
+	desc := &grpc.StreamDesc{StreamName: "Say", ServerStreams: true}
+	cs, err := c.NewStream(ctx, desc, "/pb.Echo/Say")
+	require.NoError(t, err)
+	require.NoError(t, cs.SendMsg(&pb.EchoRequest{}))
+	require.NoError(t, cs.CloseSend())
+	require.NoError(t, cs.RecvMsg(&pb.EchoResponse{}))
+	require.Error(t, cs.RecvMsg(&pb.EchoResponse{}))
+	require.Eventually(t, func() bool { return len(p.Stats().Streams) == 0 }, time.Second, time.Millisecond)
+
+	// the leaked one is canceled once it's aged
+	leaked, err := c.NewStream(ctx, desc, "/pb.Echo/Say")
+	require.NoError(t, err)
+	streams := p.Stats().Streams
+	require.Len(t, streams, 1)
+	require.Equal(t, "/pb.Echo/Say", streams[0].Method)
+	require.Equal(t, c.Info().Slot, streams[0].Slot)
+
+	require.Equal(t, codes.Canceled, status.Code(leaked.RecvMsg(&pb.EchoResponse{})))
+	stats := p.Stats()
+	require.Equal(t, 1, stats.AgedStreams)
+	require.Eventually(t, func() bool { return len(p.Stats().Streams) == 0 }, time.Second, time.Millisecond)
+}
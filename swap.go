@@ -0,0 +1,172 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// Holder holds the pool in use, it's replaced by Swap or Store when the options
+// change in a way that can't be applied in place, the replaced pool is drained.
+// the callers Load it for every use rather than keeping the pool, it's lock-free.
+// the zero Holder holds no pool until Store or Swap.
+type Holder struct {
+	p atomic.Pointer[Pool]
+
+	// serializes the Swaps.
+	mu sync.Mutex
+
+	// the drains of the pools replaced, see Drain.
+	drains sync.WaitGroup
+}
+
+// NewHolder returns a holder of p.
+func NewHolder(p Pool) *Holder {
+	h := &Holder{}
+	h.p.Store(&p)
+	return h
+}
+
+// Load returns the pool held, nil if none.
+func (h *Holder) Load() Pool {
+	if p := h.p.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Store switches the holder to p, the old pool is drained in background within
+// its DrainGracePeriod, so it isn't leaked.
+func (h *Holder) Store(p Pool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.replace(p)
+}
+
+// Drain drains the pool held, see Pool.Drain, and waits for the drains of the
+// pools replaced within ctx.
+func (h *Holder) Drain(ctx context.Context) error {
+	var err error
+	if p := h.Load(); p != nil {
+		err = p.Drain(ctx)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.drains.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// replace switches the holder to p and drains the old pool in background, it
+// must be called with mu held.
+func (h *Holder) replace(p Pool) {
+	prev := h.p.Swap(&p)
+	if prev == nil || *prev == nil || *prev == p {
+		return
+	}
+	old := *prev
+	log.Printf("pool swapped: %s ---> %s\n", old.Stats().Fingerprint, p.Stats().Fingerprint)
+	h.drains.Add(1)
+	spawn(old, "drain-swapped", func() {
+		defer h.drains.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), drainGracePeriodOf(old))
+		defer cancel()
+		if err := old.Drain(ctx); err != nil && err != ErrClosed {
+			log.Printf("drain swapped pool failed, address: %s, err: %v\n", old.Stats().Address, err)
+		}
+	})
+}
+
+// Swap builds a new pool by build, warms it up, i.e. waits for its connections
+// to be ready within DialTimeout, switches holder to it, then drains the old one
+// in background within its DrainGracePeriod. the new pool is returned. if build
+// fails or the new pool doesn't warm up, it's closed and holder is kept.
+func Swap(holder *Holder, build func() (Pool, error)) (Pool, error) {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+
+	p, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if w, ok := p.(warmer); ok {
+		if err := w.warm(); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	holder.replace(p)
+	return p, nil
+}
+
+// warmer is implemented by the pools of this package.
+type warmer interface {
+	warm() error
+}
+
+// warm connects the pool's connections and waits for them to be ready within
+// DialTimeout, or the DialTimeout constant if it isn't set.
+func (p *pool) warm() error {
+	timeout := p.opt.DialTimeout
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+
+	for _, pc := range p.slots() {
+		cc := pc.cc.Load()
+		if cc == nil {
+			continue
+		}
+		cc.Connect()
+		for state := cc.GetState(); state != connectivity.Ready; state = cc.GetState() {
+			if !cc.WaitForStateChange(ctx, state) {
+				return fmt.Errorf("warm up %s: slot %d is %v: %w", p.address, pc.slot, state, ctx.Err())
+			}
+		}
+	}
+	return nil
+}
+
+// warm warms the endpoints up, it fails if none of them does.
+func (mp *multiPool) warm() error {
+	endpoints, _ := mp.snapshot()
+	errs := make([]error, 0, len(endpoints))
+	for _, e := range endpoints {
+		if err := e.pool.warm(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) < len(endpoints) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwap(t *testing.T) {
+	address := startEchoServer(t)
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	old, err := New(address, opt)
+	require.NoError(t, err)
+	holder := NewHolder(old)
+
+	// the old pool is kept if the new one fails
+	_, err = Swap(holder, func() (Pool, error) { return nil, ErrInvalidOptions })
+	require.ErrorIs(t, err, ErrInvalidOptions)
+	cold := opt
+	cold.DialTimeout = 50 * time.Millisecond
+	_, err = Swap(holder, func() (Pool, error) { return New("127.0.0.1:1", cold) })
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.True(t, holder.Load() == old)
+
+	c, err := old.Get()
+	require.NoError(t, err)
+	opt.MaxIdle = 2
+	p, err := Swap(holder, func() (Pool, error) { return New(address, opt) })
+	require.NoError(t, err)
+	defer p.Close()
+	require.True(t, holder.Load() == p)
+	require.Equal(t, 2, p.Options().MaxIdle)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, holder.Load().Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{}))
+
+	// the old pool is drained once its conns are given back
+	require.Eventually(t, func() bool {
+		return old.(*pool).stateErr() == ErrClosing
+	}, time.Second, time.Millisecond)
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool {
+		_, err := old.Get()
+		return err == ErrClosed
+	}, time.Second, time.Millisecond)
+}
+
+func TestHolderStore(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	old, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	holder := NewHolder(old)
+
+	// storing the pool held keeps it
+	holder.Store(old)
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, old.(*pool).stateErr())
+
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	holder.Store(p)
+	require.True(t, holder.Load() == p)
+	require.Eventually(t, func() bool {
+		return old.(*pool).stateErr() == ErrClosed
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, holder.Drain(context.Background()))
+	require.Equal(t, ErrClosed, p.(*pool).stateErr())
+}
+
+func TestHolderZero(t *testing.T) {
+	var holder Holder
+	require.Nil(t, holder.Load())
+	require.NoError(t, holder.Drain(context.Background()))
+
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	holder.Store(p)
+	require.True(t, holder.Load() == p)
+	require.NoError(t, holder.Drain(context.Background()))
+	require.Equal(t, ErrClosed, p.(*pool).stateErr())
+}
+
+func TestHolderDrainWaitsReplaced(t *testing.T) {
+	opt := DefaultOptions
+	opt.Dial = DialTest
+	opt.DrainGracePeriod = time.Minute
+	old, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	c, err := old.Get()
+	require.NoError(t, err)
+	holder := NewHolder(old)
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	holder.Store(p)
+
+	// the old pool is still draining its conn checked out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, holder.Drain(ctx), context.DeadlineExceeded)
+	require.Equal(t, ErrClosed, p.(*pool).stateErr())
+
+	require.NoError(t, c.Close())
+	require.Equal(t, ErrClosed, holder.Drain(context.Background()))
+	require.Equal(t, ErrClosed, old.(*pool).stateErr())
+}
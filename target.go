@@ -0,0 +1,184 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// ErrInvalidTarget is the error resulting if the target of New is malformed,
+// it's wrapped with the reason.
+var ErrInvalidTarget = errors.New("invalid target")
+
+// normalizeTarget validates target and returns it normalized: the host:port
+// targets have their host lowercased and IPv6 literals bracketed canonically,
+// the schemes are lowercased. the schemes without a registered resolver are
+// rejected if strict, i.e. the default dialer is used, a custom dialer may
+// bring its own resolvers.
+func normalizeTarget(target string, strict bool) (string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidTarget)
+	}
+	if strings.HasPrefix(strings.ToLower(target), "unix:") && !strings.Contains(target, "://") {
+		return "unix:" + target[len("unix:"):], nil
+	}
+	i := strings.Index(target, "://")
+	if i < 0 {
+		return normalizeHostPort(target, target)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %v", ErrInvalidTarget, target, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "dns", "passthrough":
+		endpoint, err := normalizeHostPort(target, strings.TrimPrefix(u.Path, "/"))
+		if err != nil {
+			return "", err
+		}
+		return scheme + "://" + u.Host + "/" + endpoint, nil
+	case "unix", "unix-abstract":
+		if u.Path == "" && u.Host == "" {
+			return "", fmt.Errorf("%w: %q: missing path", ErrInvalidTarget, target)
+		}
+	default:
+		if strict && resolver.Get(scheme) == nil {
+			return "", fmt.Errorf("%w: %q: unknown scheme %q", ErrInvalidTarget, target, scheme)
+		}
+	}
+	return scheme + target[i:], nil
+}
+
+// normalizeHostPort validates the endpoint host[:port] of target, the port is
+// optional as the resolvers default it.
+func normalizeHostPort(target, endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", fmt.Errorf("%w: %q: missing host", ErrInvalidTarget, target)
+	}
+	if strings.ContainsAny(endpoint, " \t/?#") {
+		return "", fmt.Errorf("%w: %q: invalid character in address", ErrInvalidTarget, target)
+	}
+	host, port := endpoint, ""
+	if strings.HasPrefix(endpoint, "[") || strings.Count(endpoint, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(endpoint); err != nil {
+			if !strings.HasSuffix(endpoint, "]") {
+				return "", fmt.Errorf("%w: %q: %v", ErrInvalidTarget, target, err)
+			}
+			host = strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+		}
+		if strings.HasPrefix(endpoint, "[") {
+			if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip == nil || ip.To4() != nil {
+				return "", fmt.Errorf("%w: %q: %q isn't an IPv6 literal", ErrInvalidTarget, target, host)
+			}
+		}
+	} else if strings.Contains(endpoint, ":") {
+		return "", fmt.Errorf("%w: %q: IPv6 literals must be bracketed, e.g. [::1]:50000",
+			ErrInvalidTarget, target)
+	}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			n, err = net.LookupPort("tcp", port)
+		}
+		if err != nil || n <= 0 || n > 65535 {
+			return "", fmt.Errorf("%w: %q: invalid port %q", ErrInvalidTarget, target, port)
+		}
+	}
+
+	host = strings.ToLower(host)
+	if zone := strings.SplitN(host, "%", 2); len(zone) == 2 {
+		host = net.ParseIP(zone[0]).String() + "%" + zone[1]
+	} else if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]", nil
+		}
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// defaultPort is the port of the host targets without one, grpc defaults to it.
+const defaultPort = "443"
+
+// canonicalTarget is normalizeTarget, the host targets get the port as well,
+// defaulted to 443 and in digits, so the spellings of the same target, e.g.
+// "HOST", "host:443" and "host:https", are alike, see Key.
+func canonicalTarget(target string, strict bool) (string, error) {
+	target, err := normalizeTarget(target, strict)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(target, "dns://"):
+		i := len("dns://") + strings.Index(target[len("dns://"):], "/") + 1
+		return target[:i] + canonicalHostPort(target[i:]), nil
+	case strings.HasPrefix(target, "unix:") || strings.Contains(target, "://"):
+		return target, nil
+	}
+	return canonicalHostPort(target), nil
+}
+
+// canonicalHostPort adds the port to the normalized host[:port] endpoint, and
+// resolves the named port.
+func canonicalHostPort(endpoint string) string {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]"), defaultPort
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		if n, err := net.LookupPort("tcp", port); err == nil {
+			port = strconv.Itoa(n)
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// normalizeKeys returns m with its keys canonicalized by canonicalTarget, so they
+// match the canonical addresses of the pools they're looked up by, with or
+// without the default port. it fails if a key is malformed or two of them are
+// the same target.
+func normalizeKeys[V any](name string, m map[string]V, strict bool) (map[string]V, error) {
+	if m == nil {
+		return nil, nil
+	}
+	keys := make(map[string]string, len(m))
+	normalized := make(map[string]V, len(m))
+	for key, v := range m {
+		target, err := canonicalTarget(key, strict)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidOptions, name, err)
+		}
+		if other, ok := keys[target]; ok {
+			return nil, fmt.Errorf("%w: %s: %q and %q are the same target", ErrInvalidOptions, name, other, key)
+		}
+		keys[target] = key
+		normalized[target] = v
+	}
+	return normalized, nil
+}
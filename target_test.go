@@ -0,0 +1,116 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestNormalizeTarget(t *testing.T) {
+	for target, want := range map[string]string{
+		"127.0.0.1:50000":             "127.0.0.1:50000",
+		" Example.COM:443 ":           "example.com:443",
+		"backend":                     "backend",
+		":50000":                      ":50000",
+		"[::1]:50000":                 "[::1]:50000",
+		"[0:0::1]":                    "[::1]",
+		"[fe80::1%eth0]:80":           "[fe80::1%eth0]:80",
+		"localhost:http":              "localhost:http",
+		"DNS:///Example.com:443":      "dns:///example.com:443",
+		"dns://8.8.8.8/example.com":   "dns://8.8.8.8/example.com",
+		"passthrough:///[::1]:50000":  "passthrough:///[::1]:50000",
+		"unix:///tmp/pool.sock":       "unix:///tmp/pool.sock",
+		"unix:pool.sock":              "unix:pool.sock",
+		"unix-abstract://pool-socket": "unix-abstract://pool-socket",
+	} {
+		got, err := normalizeTarget(target, true)
+		require.NoError(t, err, target)
+		require.Equal(t, want, got, target)
+	}
+
+	for _, target := range []string{
+		"",
+		"  ",
+		"::1",
+		"::1:50000",
+		"[127.0.0.1]:50000",
+		"127.0.0.1:0",
+		"127.0.0.1:65536",
+		"127.0.0.1:port",
+		"host name:80",
+		"dns:///",
+		"dns:///::1",
+		"unix://",
+		"etcd://cluster/service",
+	} {
+		_, err := normalizeTarget(target, true)
+		require.ErrorIs(t, err, ErrInvalidTarget, target)
+	}
+
+	// a custom dialer may resolve its schemes
+	got, err := normalizeTarget("etcd://cluster/service", false)
+	require.NoError(t, err)
+	require.Equal(t, "etcd://cluster/service", got)
+
+	opt := DefaultOptions
+	opt.Dial = nil
+	_, err = New("::1:50000", opt)
+	require.ErrorIs(t, err, ErrInvalidTarget)
+}
+
+func TestCanonicalTarget(t *testing.T) {
+	for target, want := range map[string]string{
+		"HOST:443":                "host:443",
+		"host":                    "host:443",
+		"host:https":              "host:443",
+		"[0:0::1]":                "[::1]:443",
+		"[fe80::1%eth0]":          "[fe80::1%eth0]:443",
+		"127.0.0.1:50000":         "127.0.0.1:50000",
+		"DNS:///Host":             "dns:///host:443",
+		"dns://8.8.8.8/host:http": "dns://8.8.8.8/host:80",
+		"passthrough:///host":     "passthrough:///host",
+		"unix:///tmp/pool.sock":   "unix:///tmp/pool.sock",
+	} {
+		got, err := canonicalTarget(target, true)
+		require.NoError(t, err, target)
+		require.Equal(t, want, got, target)
+	}
+}
+
+func TestEndpointKeys(t *testing.T) {
+	opt := DefaultOptions
+	opt.EndpointCompressors = map[string][]string{" Example.COM:443 ": {"gzip"}}
+	require.NoError(t, opt.validate())
+	require.Equal(t, map[string][]string{"example.com:443": {"gzip"}}, opt.clone().EndpointCompressors)
+
+	// the keys are looked up by the normalized address of the pool
+	p, err := New("EXAMPLE.com:443", opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, []string{"gzip"}, p.(*pool).compressors())
+
+	opt.EndpointCompressors = map[string][]string{"::1": nil}
+	require.ErrorIs(t, opt.validate(), ErrInvalidOptions)
+	opt.EndpointCompressors = nil
+	opt.EndpointTransportCredentials = map[string]credentials.TransportCredentials{
+		"host:443": insecure.NewCredentials(),
+		"HOST:443": insecure.NewCredentials(),
+	}
+	require.ErrorIs(t, opt.validate(), ErrInvalidOptions)
+}
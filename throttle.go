@@ -0,0 +1,107 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// throttle counts the requests and the accepted ones of a pool, for the
+// adaptive throttling of Site Reliability Engineering, chapter 21.
+type throttle struct {
+	requests decayCounter
+	accepts  decayCounter
+}
+
+// rejectProbability returns the probability a Get is throttled.
+func (p *pool) rejectProbability() float64 {
+	if p.opt.ThrottleK <= 0 {
+		return 0
+	}
+	now, halfLife := p.clock.Now(), p.errorHalfLife()
+	requests := p.throttle.requests.get(now, halfLife)
+	accepts := p.throttle.accepts.get(now, halfLife)
+	if prob := (requests - p.opt.ThrottleK*accepts) / (requests + 1); prob > 0 {
+		return prob
+	}
+	return 0
+}
+
+// throttled reports whether a Get is rejected locally, the rejected Gets count
+// as requests too.
+func (p *pool) throttled() bool {
+	if p.random() >= p.rejectProbability() {
+		return false
+	}
+	p.throttle.requests.add(p.clock.Now(), 1, p.errorHalfLife())
+	return true
+}
+
+// record counts an RPC finished with err.
+func (t *throttle) record(p *pool, err error) {
+	now, halfLife := p.clock.Now(), p.errorHalfLife()
+	t.requests.add(now, 1, halfLife)
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable:
+	default:
+		t.accepts.add(now, 1, halfLife)
+	}
+}
+
+// throttleInterceptor counts the unary RPCs for the adaptive throttling.
+func (p *pool) throttleInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	p.throttle.record(p, err)
+	return err
+}
+
+// throttleStreamInterceptor counts the streams, by the error they end with.
+func (p *pool) throttleStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		p.throttle.record(p, err)
+		return nil, err
+	}
+	return &throttleStream{ClientStream: s, pool: p, unary: !desc.ServerStreams}, nil
+}
+
+// throttleStream records the outcome of a stream once, as it's received, see
+// throttleStreamInterceptor. the streams without a stream of responses end with
+// their response.
+type throttleStream struct {
+	grpc.ClientStream
+	pool     *pool
+	unary    bool
+	recorded int32
+}
+
+func (s *throttleStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if (err != nil || s.unary) && atomic.CompareAndSwapInt32(&s.recorded, 0, 1) {
+		if err == io.EOF {
+			err = nil
+		}
+		s.pool.throttle.record(s.pool, err)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdaptiveThrottling(t *testing.T) {
+	overloaded := grpc.UnaryInterceptor(func(context.Context, interface{}, *grpc.UnaryServerInfo,
+		grpc.UnaryHandler) (interface{}, error) {
+		return nil, status.Error(codes.ResourceExhausted, "overloaded")
+	})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.ThrottleK = 2
+	p, err := New(startEchoServer(t, overloaded), opt)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Zero(t, p.Stats().RejectProbability)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var throttled int
+	for i := 0; i < 100; i++ {
+		err := p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{}, &pb.EchoResponse{})
+		if err == ErrThrottled {
+			throttled++
+			continue
+		}
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	}
+	require.Greater(t, throttled, 50)
+	require.Greater(t, p.Stats().RejectProbability, 0.9)
+}
+
+func TestAdaptiveThrottlingStreams(t *testing.T) {
+	overloaded := grpc.UnaryInterceptor(func(context.Context, interface{}, *grpc.UnaryServerInfo,
+		grpc.UnaryHandler) (interface{}, error) {
+		return nil, status.Error(codes.ResourceExhausted, "overloaded")
+	})
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.ThrottleK = 2
+	p, err := New(startEchoServer(t, overloaded), opt)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the streams count by the error they end with, not by being created
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	desc := &grpc.StreamDesc{StreamName: "Say"}
+	var throttled int
+	for i := 0; i < 100; i++ {
+		cs, err := p.NewStream(ctx, desc, "/pb.Echo/Say")
+		if err == ErrThrottled {
+			throttled++
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, cs.SendMsg(&pb.EchoRequest{}))
+		require.NoError(t, cs.CloseSend())
+		require.Equal(t, codes.ResourceExhausted, status.Code(cs.RecvMsg(&pb.EchoResponse{})))
+	}
+	require.Greater(t, throttled, 50)
+	require.Greater(t, p.Stats().RejectProbability, 0.9)
+}
+
+func TestRejectProbability(t *testing.T) {
+	opt := DefaultOptions
+	opt.MaxIdle = 1
+	opt.ThrottleK = 2
+	p, err := New(*endpoint, opt)
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	// the accepted RPCs keep it zero while requests are less than K*accepts
+	for i := 0; i < 10; i++ {
+		nativePool.throttle.record(nativePool, nil)
+	}
+	for i := 0; i < 9; i++ {
+		nativePool.throttle.record(nativePool, status.Error(codes.Unavailable, ""))
+	}
+	require.Zero(t, p.Stats().RejectProbability)
+	for i := 0; i < 21; i++ {
+		nativePool.throttle.record(nativePool, status.Error(codes.Unavailable, ""))
+	}
+	require.InDelta(t, 20.0/41, p.Stats().RejectProbability, 0.01)
+}
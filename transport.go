@@ -0,0 +1,111 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// errTransportOnly is the error of dialing the native gRPC transport of a
+// connection of DialTransport, its RPCs are issued through the TransportConn.
+var errTransportOnly = errors.New("native transport is disabled")
+
+// TransportConn is a connection speaking other than native gRPC through a
+// transport adapter, e.g. grpc-web or HTTP/1.1 upgrade, for the edge clients
+// behind restrictive proxies.
+type TransportConn interface {
+	grpc.ClientConnInterface
+
+	// Close is called once the pool closes the connection.
+	Close() error
+}
+
+// DialTransport adapts a dialer of TransportConns to DialFunc, so the pool's
+// capacity management works for them too. the pool's connections are shells
+// of grpc.ClientConn whose RPCs are issued through the TransportConn, after the
+// interceptors of the pool, e.g. for QuarantineErrors. the shells are never
+// connected, so the options of the native transport, e.g. StatsHandler and
+// IdleTimeout, are of no effect.
+func DialTransport(dial func(req DialRequest) (TransportConn, error)) func(req DialRequest) (*grpc.ClientConn, error) {
+	return func(req DialRequest) (*grpc.ClientConn, error) {
+		tc, err := dial(req)
+		if err != nil {
+			return nil, err
+		}
+		unary := func(ctx context.Context, method string, args, reply interface{}, _ *grpc.ClientConn,
+			_ grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return tc.Invoke(ctx, method, args, reply, opts...)
+		}
+		stream := func(ctx context.Context, desc *grpc.StreamDesc, _ *grpc.ClientConn, method string,
+			_ grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return tc.NewStream(ctx, desc, method, opts...)
+		}
+		opts := append(req.DialOptions[:len(req.DialOptions):len(req.DialOptions)],
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return nil, errTransportOnly
+			}),
+			grpc.WithChainUnaryInterceptor(unary),
+			grpc.WithChainStreamInterceptor(stream))
+		cc, err := grpc.NewClient("passthrough:///"+req.Target, opts...)
+		if err != nil {
+			tc.Close()
+			return nil, err
+		}
+		spawnDialed(req, "close-transport", func() { closeTransport(cc, tc) })
+		return cc, nil
+	}
+}
+
+// AdaptDialInterface adapts a dialer of grpc.ClientConnInterface to DialFunc by
+// DialTransport, see Options.DialInterface. closer may be nil. ctx may be done
+// once dial returns, the connections outliving it mustn't depend on it.
+func AdaptDialInterface(dial func(ctx context.Context, target string) (grpc.ClientConnInterface, io.Closer, error)) func(req DialRequest) (*grpc.ClientConn, error) {
+	return DialTransport(func(req DialRequest) (TransportConn, error) {
+		cc, closer, err := dial(req.Ctx, req.Target)
+		if err != nil {
+			return nil, err
+		}
+		return interfaceConn{ClientConnInterface: cc, closer: closer}, nil
+	})
+}
+
+// interfaceConn is the TransportConn of AdaptDialInterface.
+type interfaceConn struct {
+	grpc.ClientConnInterface
+	closer io.Closer
+}
+
+func (c interfaceConn) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// closeTransport closes tc once cc is shut down.
+func closeTransport(cc *grpc.ClientConn, tc TransportConn) {
+	for state := cc.GetState(); state != connectivity.Shutdown; state = cc.GetState() {
+		cc.WaitForStateChange(context.Background(), state)
+	}
+	tc.Close()
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shimingyah/pool/example/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// adapterConn stands for a transport adapter, it issues the RPCs on a native
+// connection and counts them.
+type adapterConn struct {
+	*grpc.ClientConn
+	calls  *int32
+	closed *int32
+}
+
+func (c adapterConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	atomic.AddInt32(c.calls, 1)
+	return c.ClientConn.Invoke(ctx, method, args, reply, opts...)
+}
+
+func (c adapterConn) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return c.ClientConn.Close()
+}
+
+func TestDialTransport(t *testing.T) {
+	var calls, closed int32
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.DialFunc = DialTransport(func(req DialRequest) (TransportConn, error) {
+		cc, err := DialTest(req.Target)
+		if err != nil {
+			return nil, err
+		}
+		return adapterConn{ClientConn: cc, calls: &calls, closed: &closed}, nil
+	})
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := &pb.EchoResponse{}
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+	require.Equal(t, "hi", string(res.Message))
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	require.NoError(t, p.Close())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&closed) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestDialTransportOptions(t *testing.T) {
+	// the spare capacity of the caller's DialOptions isn't written
+	spare := grpc.WithUserAgent("spare")
+	dialOptions := make([]grpc.DialOption, 1, 8)
+	dialOptions[0] = grpc.WithUserAgent("pool")
+	backing := append(dialOptions, spare)
+	cc, err := DialTransport(func(req DialRequest) (TransportConn, error) {
+		cc, err := DialTest(req.Target)
+		if err != nil {
+			return nil, err
+		}
+		return adapterConn{ClientConn: cc, calls: new(int32), closed: new(int32)}, nil
+	})(DialRequest{Target: *endpoint, DialOptions: dialOptions})
+	require.NoError(t, err)
+	defer cc.Close()
+	require.Equal(t, spare, backing[1])
+}
+
+func TestDialInterface(t *testing.T) {
+	var calls, closed int32
+	opt := DefaultOptions
+	opt.MaxIdle = 2
+	opt.DialInterface = func(ctx context.Context, target string) (grpc.ClientConnInterface, io.Closer, error) {
+		cc, err := DialTest(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		c := adapterConn{ClientConn: cc, calls: &calls, closed: &closed}
+		return c, c, nil
+	}
+	p, err := New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	require.Contains(t, p.Stats().Options, "DialInterface:set")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := &pb.EchoResponse{}
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+	require.Equal(t, "hi", string(res.Message))
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	require.NoError(t, p.Close())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&closed) == 2
+	}, time.Second, time.Millisecond)
+
+	// the closer is optional
+	opt.DialInterface = func(ctx context.Context, target string) (grpc.ClientConnInterface, io.Closer, error) {
+		cc, err := DialTest(target)
+		return cc, nil, err
+	}
+	p, err = New(startEchoServer(t), opt)
+	require.NoError(t, err)
+	require.NoError(t, p.Invoke(ctx, "/pb.Echo/Say", &pb.EchoRequest{Message: []byte("hi")}, res))
+	require.NoError(t, p.Close())
+}
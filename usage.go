@@ -0,0 +1,112 @@
+// Copyright 2019 shimingyah. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// ee the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc/stats"
+)
+
+// ConnUsage is the usage of a connection since it's dialed.
+type ConnUsage struct {
+	// Slot is the index of the pool's slot the connection is in.
+	Slot int
+
+	// Streams is the number of streams started, unary RPCs included.
+	Streams int64
+
+	// BytesSent is the number of bytes sent on the wire.
+	BytesSent int64
+
+	// BytesReceived is the number of bytes received on the wire.
+	BytesReceived int64
+}
+
+// usage counts the streams and bytes of a connection.
+type usage struct {
+	streams       int64
+	bytesSent     int64
+	bytesReceived int64
+}
+
+// usageHandler is the stats.Handler installed to count the usage of pc.
+type usageHandler struct {
+	pc *physicalConn
+}
+
+func (h usageHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h usageHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	u := &h.pc.track.usage
+	switch s := s.(type) {
+	case *stats.Begin:
+		atomic.AddInt64(&u.streams, 1)
+	case *stats.OutPayload:
+		atomic.AddInt64(&u.bytesSent, int64(s.WireLength))
+		atomic.AddInt64(&h.pc.pool.bytesSent, int64(s.WireLength))
+	case *stats.InPayload:
+		atomic.AddInt64(&u.bytesReceived, int64(s.WireLength))
+		atomic.AddInt64(&h.pc.pool.bytesReceived, int64(s.WireLength))
+	}
+}
+
+func (h usageHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h usageHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// trackingUsage reports whether the pool counts the usage of its connections.
+func (p *pool) trackingUsage() bool {
+	return p.opt.UsageReport != nil || p.opt.TrackUsage
+}
+
+// connUsage returns the usage of the pool's connections.
+func (p *pool) connUsage() []ConnUsage {
+	pcs := p.slots()
+	usages := make([]ConnUsage, 0, len(pcs))
+	for _, pc := range pcs {
+		usages = append(usages, ConnUsage{
+			Slot:          pc.slot,
+			Streams:       atomic.LoadInt64(&pc.track.usage.streams),
+			BytesSent:     atomic.LoadInt64(&pc.track.usage.bytesSent),
+			BytesReceived: atomic.LoadInt64(&pc.track.usage.bytesReceived),
+		})
+	}
+	return usages
+}
+
+// reportUsage calls UsageReport every UsageReportInterval until the pool is closed.
+func (p *pool) reportUsage() {
+	interval := p.opt.UsageReportInterval
+	if interval <= 0 {
+		interval = DefaultUsageReportInterval
+	}
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+			p.opt.UsageReport(p.connUsage())
+		}
+	}
+}